@@ -0,0 +1,349 @@
+// Command targz creates, extracts, lists and verifies tar archives with the
+// useTar package, the code path nodes use for genesis packages.
+//
+//	targz create  [-v] [-f file] [-C dir] [--exclude pattern]...
+//	              [--manifest] [--sign-key priv_validator.json] path
+//	targz extract [-v] [-f file] [-C dir] [--strip-components n] [--exclude pattern]...
+//	              [--max-total-size n] [--max-file-size n] [--max-entries n]
+//	              [--trusted-key hex]... [--keep-manifest]
+//	targz list    [-v] [-f file]
+//	targz verify  [-f file]
+//
+// The first argument may also be given in the bundled style of tar, such as
+// czvf, xzvf or tzvf, where f takes the next argument as the archive. A file
+// of "-" or no file means standard input or output. As with GNU tar the exit
+// status is 0 on success and 2 on a fatal error, including a usage error.
+//
+// Extraction refuses archives beyond useTar.DefaultLimits unless the limits
+// are raised, or set to 0 to lift them, as a node data backup may need.
+//
+// An archive made with --sign-key carries a manifest signed with the ed25519
+// key of a node's priv_validator.json. Extraction with --trusted-key, the hex
+// public key of a signer, refuses an archive not signed by one of them before
+// writing anything.
+package main
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lzwisbadbad/targz/useTar"
+)
+
+// Exit codes, as used by GNU tar.
+const (
+	exitOK    = 0
+	exitFatal = 2
+)
+
+// errUsage is returned after the flag package has already explained the problem.
+var errUsage = errors.New("usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err == nil {
+		os.Exit(exitOK)
+	}
+	if err != errUsage {
+		fmt.Fprintln(os.Stderr, "targz:", err)
+	}
+	os.Exit(exitFatal)
+}
+
+// run executes the command line args.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	args, err := expandBundled(args)
+	if err != nil {
+		fmt.Fprintln(stderr, "targz:", err)
+		return errUsage
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "usage: targz create|extract|list|verify [flags] [path]")
+		return errUsage
+	}
+
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("targz "+cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("f", "-", "archive file, - for standard input or output")
+	verbose := fs.Bool("v", false, "list entries as they are processed")
+	dir := fs.String("C", ".", "change to this directory first")
+	var excludes patterns
+	fs.Var(&excludes, "exclude", "skip entries matching this pattern (repeatable)")
+
+	switch cmd {
+	case "create", "c":
+		codec := fs.String("codec", useTar.CodecGzip, "compression codec")
+		level := fs.Int("level", 0, "compression level, 0 for the codec default")
+		workers := fs.Int("workers", 1, "compress on this many goroutines")
+		deterministic := fs.Bool("deterministic", false, "make a reproducible archive")
+		manifest := fs.Bool("manifest", false, "store a manifest of every entry first")
+		signKey := fs.String("sign-key", "", "sign the manifest with the key of this priv_validator.json")
+		if err := parse(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintln(stderr, "targz create: exactly one path to archive is expected")
+			return errUsage
+		}
+		opts := useTar.Options{
+			IncludeRoot:   true,
+			Exclude:       excludes,
+			Codec:         *codec,
+			Level:         *level,
+			Workers:       *workers,
+			Deterministic: *deterministic,
+			Manifest:      *manifest,
+		}
+		if *signKey != "" {
+			key, err := useTar.LoadPrivValidatorKey(*signKey)
+			if err != nil {
+				return err
+			}
+			opts.SignKey = key
+		}
+		// like tar, report to stderr when the archive itself goes to stdout
+		if *verbose {
+			out := stdout
+			if *file == "-" {
+				out = stderr
+			}
+			opts.Progress = func(hdr *tar.Header) { fmt.Fprintln(out, hdr.Name) }
+		}
+		// like tar, a relative path is stored as given, without leading ../
+		src := fs.Arg(0)
+		if !filepath.IsAbs(src) {
+			name := filepath.ToSlash(filepath.Clean(src))
+			for name == ".." || strings.HasPrefix(name, "../") {
+				name = strings.TrimPrefix(strings.TrimPrefix(name, ".."), "/")
+			}
+			if name != "" && name != "." {
+				opts.RootName = name
+			}
+			src = filepath.Join(*dir, src)
+		}
+		return create(*file, src, opts, stdout)
+
+	case "extract", "x":
+		strip := fs.Int("strip-components", 0, "drop this many leading path elements")
+		maxTotal := fs.Int64("max-total-size", useTar.DefaultLimits.MaxTotalSize, "refuse archives writing more bytes, 0 for no limit")
+		maxFile := fs.Int64("max-file-size", useTar.DefaultLimits.MaxFileSize, "refuse files larger than this, 0 for no limit")
+		maxEntries := fs.Int("max-entries", useTar.DefaultLimits.MaxEntries, "refuse archives with more entries, 0 for no limit")
+		var trusted patterns
+		fs.Var(&trusted, "trusted-key", "require a manifest signed by this hex ed25519 public key (repeatable)")
+		keepManifest := fs.Bool("keep-manifest", false, "write the manifest and its signature into the directory")
+		if err := parse(fs, args); err != nil {
+			return err
+		}
+		keys, err := publicKeys(trusted)
+		if err != nil {
+			fmt.Fprintln(stderr, "targz extract:", err)
+			return errUsage
+		}
+		opts := useTar.Options{
+			Exclude:         excludes,
+			StripComponents: *strip,
+			Limits: useTar.Limits{
+				MaxTotalSize: *maxTotal,
+				MaxFileSize:  *maxFile,
+				MaxEntries:   *maxEntries,
+			},
+			TrustedKeys:  keys,
+			KeepManifest: *keepManifest,
+		}
+		if *verbose {
+			opts.Progress = func(hdr *tar.Header) { fmt.Fprintln(stdout, hdr.Name) }
+		}
+		return withInput(*file, stdin, func(r io.Reader) error {
+			return useTar.UnTarGzFrom(r, *dir, opts)
+		})
+
+	case "list", "t":
+		if err := parse(fs, args); err != nil {
+			return err
+		}
+		return withInput(*file, stdin, func(r io.Reader) error {
+			headers, err := useTar.List(r)
+			if err != nil {
+				return err
+			}
+			printHeaders(stdout, headers, *verbose)
+			return nil
+		})
+
+	case "verify":
+		if err := parse(fs, args); err != nil {
+			return err
+		}
+		return withInput(*file, stdin, func(r io.Reader) error {
+			report, err := useTar.Verify(r)
+			if err != nil {
+				return err
+			}
+			for _, f := range report.Files {
+				fmt.Fprintf(stdout, "%s  %s\n", f.SHA256, f.Name)
+			}
+			if *verbose {
+				fmt.Fprintf(stdout, "%d entries, %d files, %d bytes\n", report.Entries, len(report.Files), report.Size)
+			}
+			return nil
+		})
+	}
+
+	fmt.Fprintf(stderr, "targz: unknown command %q\n", cmd)
+	return errUsage
+}
+
+// parse parses the flags of a subcommand, flags being allowed after the path.
+func parse(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return errUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return fs.Parse(append([]string{"--"}, positional...))
+}
+
+// create writes the archive of src to file.
+func create(file, src string, opts useTar.Options, stdout io.Writer) error {
+	if file == "-" {
+		return useTar.TarGzTo(stdout, src, opts)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := useTar.TarGzTo(f, src, opts); err != nil {
+		f.Close()
+		os.Remove(file)
+		return err
+	}
+	return f.Close()
+}
+
+// withInput calls fn with the archive file, or stdin for "-".
+func withInput(file string, stdin io.Reader, fn func(r io.Reader) error) error {
+	if file == "-" {
+		return fn(stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+// printHeaders lists entries as tar t does, in the long form of tar tv when
+// verbose is set.
+func printHeaders(w io.Writer, headers []*tar.Header, verbose bool) {
+	if !verbose {
+		for _, hdr := range headers {
+			fmt.Fprintln(w, hdr.Name)
+		}
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+	for _, hdr := range headers {
+		owner := hdr.Uname
+		if owner == "" {
+			owner = fmt.Sprint(hdr.Uid)
+		}
+		group := hdr.Gname
+		if group == "" {
+			group = fmt.Sprint(hdr.Gid)
+		}
+		name := hdr.Name
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			name += " -> " + hdr.Linkname
+		case tar.TypeLink:
+			name += " link to " + hdr.Linkname
+		}
+		fmt.Fprintf(tw, "%s\t %s/%s\t %d\t %s\t %s\t\n",
+			hdr.FileInfo().Mode(), owner, group, hdr.Size,
+			hdr.ModTime.Local().Format("2006-01-02 15:04"), name)
+	}
+	tw.Flush()
+}
+
+// expandBundled rewrites a tar style first argument such as "czvf out.tgz"
+// into the subcommand form. Only the letters c, x, t, z, v and f are known.
+func expandBundled(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	letters := strings.TrimPrefix(args[0], "-")
+	if len(letters) < 2 || strings.Trim(letters, "cxtzvf") != "" {
+		return args, nil
+	}
+
+	var cmd string
+	var flags []string
+	rest := args[1:]
+	for _, c := range letters {
+		switch c {
+		case 'c', 'x', 't':
+			if cmd != "" {
+				return nil, fmt.Errorf("only one of c, x and t may be given in %q", args[0])
+			}
+			cmd = string(c)
+		case 'v':
+			flags = append(flags, "-v")
+		case 'f':
+			if len(rest) == 0 {
+				return nil, fmt.Errorf("f in %q needs an archive argument", args[0])
+			}
+			flags = append(flags, "-f", rest[0])
+			rest = rest[1:]
+		case 'z':
+			// compression is detected on read and gzip by default on write
+		}
+	}
+	if cmd == "" {
+		return nil, fmt.Errorf("one of c, x and t is needed in %q", args[0])
+	}
+	return append(append([]string{cmd}, flags...), rest...), nil
+}
+
+// publicKeys decodes the hex ed25519 public keys given with --trusted-key.
+func publicKeys(hexKeys []string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, h := range hexKeys {
+		key, err := hex.DecodeString(h)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key %q", h)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// patterns collects a repeatable string flag.
+type patterns []string
+
+func (p *patterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patterns) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
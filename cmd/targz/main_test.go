@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandBundled(t *testing.T) {
+	cases := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"czvf", "out.tgz", "dir"}, []string{"c", "-v", "-f", "out.tgz", "dir"}},
+		{[]string{"-xzf", "in.tgz", "-C", "dst"}, []string{"x", "-f", "in.tgz", "-C", "dst"}},
+		{[]string{"tzv"}, []string{"t", "-v"}},
+		{[]string{"list", "-f", "in.tgz"}, []string{"list", "-f", "in.tgz"}},
+	}
+	for _, c := range cases {
+		got, err := expandBundled(c.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, want %v", c.args, got, c.want)
+		}
+	}
+
+	for _, args := range [][]string{{"cxf", "a"}, {"zvf"}, {"czf"}} {
+		if _, err := expandBundled(args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "chain")
+	if err := os.MkdirAll(filepath.Join(src, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "config", "genesis.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "chain.tar.gz")
+	dst := filepath.Join(dir, "dst")
+
+	var stdout, stderr bytes.Buffer
+	steps := [][]string{
+		{"czf", archive, "-C", dir, "chain"},
+		{"extract", "-f", archive, "-C", dst, "--strip-components", "1"},
+		{"tzvf", archive},
+		{"verify", "-f", archive},
+	}
+	for _, args := range steps {
+		if err := run(args, nil, &stdout, &stderr); err != nil {
+			t.Fatalf("%v: %v, %s", args, err, stderr.String())
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "config", "genesis.json")); err != nil || string(b) != "{}" {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if !strings.Contains(stdout.String(), "chain/config/genesis.json") {
+		t.Fatalf("unexpected output %s", stdout.String())
+	}
+
+	// a nested path is stored as given, relative to -C
+	nested := filepath.Join(dir, "nested.tar.gz")
+	stdout.Reset()
+	if err := run([]string{"czf", nested, "-C", dir, "chain/config"}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("nested path: %v, %s", err, stderr.String())
+	}
+	if err := run([]string{"tzf", nested}, nil, &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if got := stdout.String(); got != "chain/config/\nchain/config/genesis.json\n" {
+		t.Fatalf("nested path stored as %q", got)
+	}
+
+	// an absolute path is not taken relative to -C, and limits can be set
+	abs := filepath.Join(dir, "abs.tar.gz")
+	if err := run([]string{"czf", abs, filepath.Join(src, "config")}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("absolute path: %v, %s", err, stderr.String())
+	}
+	if err := run([]string{"xzf", abs, "-C", dst, "--max-file-size", "1"}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("file over --max-file-size extracted")
+	}
+	if err := run([]string{"xzf", abs, "-C", dst, "--max-file-size", "0", "--max-total-size", "0"}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("no limits: %v, %s", err, stderr.String())
+	}
+
+	// a signed archive is only extracted for a trusted key
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pv := filepath.Join(dir, "priv_validator.json")
+	pvJSON := `{"priv_key":{"type":"954568A3288910","value":"` + base64.StdEncoding.EncodeToString(priv) + `"}}`
+	if err := ioutil.WriteFile(pv, []byte(pvJSON), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signed := filepath.Join(dir, "signed.tar.gz")
+	if err := run([]string{"czf", signed, "-C", dir, "chain", "--sign-key", pv}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("sign: %v, %s", err, stderr.String())
+	}
+	if err := run([]string{"xzf", signed, "-C", t.TempDir(), "--trusted-key", hex.EncodeToString(priv[:32])}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("extracted for an untrusted key")
+	}
+	trusted := filepath.Join(dir, "trusted")
+	if err := run([]string{"xzf", signed, "-C", trusted, "--trusted-key", hex.EncodeToString(pub), "--keep-manifest"}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("trusted: %v, %s", err, stderr.String())
+	}
+	for _, name := range []string{".manifest.json", ".manifest.json.sig", "chain/config/genesis.json"} {
+		if _, err := os.Stat(filepath.Join(trusted, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := run([]string{"extract", "-f", filepath.Join(dir, "missing")}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := run([]string{"bogus"}, nil, &stdout, &stderr); err != errUsage {
+		t.Fatalf("got %v", err)
+	}
+}
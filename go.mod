@@ -0,0 +1,8 @@
+module github.com/lzwisbadbad/targz
+
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -1,12 +1,14 @@
 package blockchain
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
 
 	"github.com/bcbchain/bclib/tendermint/go-amino"
 	"github.com/bcbchain/tendermint/p2p"
+	"github.com/bcbchain/tendermint/sidechain"
 	sm "github.com/bcbchain/tendermint/state"
 	"github.com/bcbchain/tendermint/types"
 	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
@@ -306,6 +308,12 @@ FOR_LOOP:
 					// get the hash without persisting the state
 					var err error
 					state, err = bcR.blockExec.ApplyBlock(state, firstID, first)
+					if errors.Is(err, sidechain.ErrRestart) {
+						// the block made this node a side chain, the genesis is finished at the next boot
+						bcR.Logger.Info("Side chain genesis prepared, stopping to restart", "height", first.Height)
+						bcR.blockExec.Restart()
+						break FOR_LOOP
+					}
 					if err != nil {
 						// TODO This is bad, are we zombie?
 						cmn.PanicQ(cmn.Fmt("Failed to process committed block (%d:%X): %v",
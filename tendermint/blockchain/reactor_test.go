@@ -161,7 +161,7 @@ func makeTxs(height int64) (txs []types.Tx) {
 }
 
 func makeBlock(height int64, state sm.State) *types.Block {
-	block, _ := state.MakeBlock(height, makeTxs(height), new(types.Commit), "", "", nil, nil)
+	block, _ := state.MakeBlock(height, makeTxs(height), new(types.Commit), "", "", nil, nil, nil)
 	return block
 }
 
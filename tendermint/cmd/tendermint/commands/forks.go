@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	rpcclient "github.com/bcbchain/tendermint/rpc/client"
+	ctypes "github.com/bcbchain/tendermint/rpc/core/types"
+	"github.com/bcbchain/tendermint/softforks"
+	"github.com/bcbchain/tendermint/types"
+)
+
+// ForksCmd shows the fork schedule of a node
+var ForksCmd = &cobra.Command{
+	Use:   "forks",
+	Short: "Show the fork schedule and which forks are active",
+	Long: `List the forks known to the node at --node: their tag, effect height,
+feature and description, whether each is active at the latest block, and
+whether the signature of the forks file verified.
+
+The peers whose fork schedule differs from the schedule of the node are
+listed after it, and the command fails: they split from the chain at the
+first fork the schedules disagree on.
+
+With --offline the schedule is read from the forks file of --home as the
+node would at start, without asking a running node.`,
+	Args:         cobra.NoArgs,
+	RunE:         showForks,
+	SilenceUsage: true,
+}
+
+var (
+	forksNodeAddr string
+	forksOffline  bool
+)
+
+func init() {
+	ForksCmd.Flags().StringVar(&forksNodeAddr, "node", "tcp://localhost:46657", "Connect to a Tendermint node at this address")
+	ForksCmd.Flags().BoolVar(&forksOffline, "offline", false, "Read the forks file instead of asking the node")
+}
+
+func showForks(cmd *cobra.Command, args []string) error {
+	var result *ctypes.ResultForks
+	var err error
+	if forksOffline {
+		result, err = loadForks()
+	} else {
+		result, err = rpcclient.NewHTTP(forksNodeAddr, "/websocket").Forks()
+	}
+	if err != nil {
+		return err
+	}
+
+	signature := "not signed"
+	if result.Verified {
+		signature = "verified"
+	}
+	fmt.Printf("source: %s, signature %s\n", result.Source, signature)
+	fmt.Println("hash:", result.Hash)
+	if !forksOffline {
+		fmt.Println("height:", result.Height)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tHEIGHT\tFEATURE\tSTATUS\tDESCRIPTION")
+	for _, f := range result.Forks {
+		status := "pending"
+		if f.Active {
+			status = "active"
+		}
+		if forksOffline {
+			status = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", f.Tag, f.EffectBlockHeight, f.Feature, status, f.Description)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	for _, p := range result.Mismatched {
+		fmt.Printf("WARNING: peer %s (%s) has fork schedule %s\n", p.ID, p.Moniker, p.Hash)
+	}
+	if len(result.Mismatched) > 0 {
+		return fmt.Errorf("%d peers disagree on the fork schedule", len(result.Mismatched))
+	}
+	return nil
+}
+
+// loadForks reads the fork schedule of the node at --home
+func loadForks() (*ctypes.ResultForks, error) {
+	genDoc, err := types.GenesisDocFromFile(config)
+	if err != nil {
+		return nil, err
+	}
+	forks, err := softforks.Load(config.ForksFile(), genDoc.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	return &ctypes.ResultForks{
+		Source:   forks.Source(),
+		Verified: forks.Verified(),
+		Hash:     forks.Hash(),
+		Forks:    forks.Status(0),
+	}, nil
+}
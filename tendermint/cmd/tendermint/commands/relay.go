@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+
+	certclient "github.com/bcbchain/tendermint/lite/client"
+	"github.com/bcbchain/tendermint/relay"
+	rpcclient "github.com/bcbchain/tendermint/rpc/client"
+)
+
+// RelayCmd runs the relay of some queues as a process of its own
+var RelayCmd = &cobra.Command{
+	Use:   "relay",
+	Short: "Run a standalone relayer",
+	Long: `Relay the IBC packets of the given queues from the local chain to the
+remote chains, apart from any validator.
+
+The relayer reads the local chain through --local, signs the txs it
+sends to the remote chains with the key in --key, generated on first
+use, and keeps its checkpoints in the data directory of --home. Each
+--queue is the chain ID packets are relayed to, optionally followed by
+"=" and a comma separated list of its RPC URLs; without them the open
+URLs recorded on the local chain are used.
+
+Local blocks are verified by a lite client of --local before they are
+relayed. It certifies forward from the block given, on first start, by
+--trust-height and --trust-hash, which must be known out of band and come
+before the first packet to relay. The trust root and the commits it
+certifies are kept in <home>/relay-lite; giving another root drops them.`,
+	RunE:         runRelay,
+	SilenceUsage: true,
+}
+
+var (
+	relayLocalURL string
+	relayKeyFile  string
+	relayQueues   []string
+	relayInterval time.Duration
+	relayLaddr    string
+
+	relayTrustHeight int64
+	relayTrustHash   string
+)
+
+func init() {
+	RelayCmd.Flags().StringVar(&relayLocalURL, "local", "http://127.0.0.1:46657", "RPC URL of a node of the local chain")
+	RelayCmd.Flags().StringVar(&relayKeyFile, "key", "relayer_key.json", "Relayer key file, relative to --home")
+	RelayCmd.Flags().StringArrayVar(&relayQueues, "queue", nil, "Queue to relay, as <toChainID>[=<url>,<url>...], repeatable")
+	RelayCmd.Flags().DurationVar(&relayInterval, "interval", 3*time.Second, "How often the queues look for new packets")
+	RelayCmd.Flags().StringVar(&relayLaddr, "metrics_laddr", "", "Serve the relay metrics on this address, e.g. :26660")
+	RelayCmd.Flags().Int64Var(&relayTrustHeight, "trust-height", 0, "Height of the local block the lite client trusts, required on first start")
+	RelayCmd.Flags().StringVar(&relayTrustHash, "trust-hash", "", "Hex hash of the block at --trust-height")
+}
+
+func runRelay(cmd *cobra.Command, args []string) error {
+	if len(relayQueues) == 0 {
+		return fmt.Errorf("no --queue to relay")
+	}
+	trustHash, err := hex.DecodeString(strings.TrimPrefix(relayTrustHash, "0x"))
+	if err != nil {
+		return fmt.Errorf("invalid --trust-hash: %v", err)
+	}
+	if (relayTrustHeight == 0) != (len(trustHash) == 0) {
+		return fmt.Errorf("--trust-height and --trust-hash go together")
+	}
+
+	keyFile := relayKeyFile
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(config.RootDir, keyFile)
+	}
+	if err := cmn.EnsureDir(config.DBDir(), 0700); err != nil {
+		return err
+	}
+
+	rc, err := relay.NewStandalone(config, relayLocalURL, keyFile, logger.With("module", "relay"))
+	if err != nil {
+		return err
+	}
+
+	root := relay.TrustRoot{Height: relayTrustHeight, Hash: trustHash}
+	loader, err := liteValidatorsLoader(relayLocalURL, filepath.Join(config.RootDir, "relay-lite"), root)
+	if err != nil {
+		return err
+	}
+	rc.SetValidatorsLoader(loader)
+
+	if err := rc.Start(); err != nil {
+		return err
+	}
+	for _, q := range relayQueues {
+		toChainID, urls := parseRelayQueue(q)
+		if err := rc.AddQueue(toChainID, urls); err != nil {
+			_ = rc.Stop()
+			return err
+		}
+	}
+
+	if relayLaddr != "" {
+		go func() {
+			if err := http.ListenAndServe(relayLaddr, rc.Metrics()); err != nil {
+				logger.Error("Relay metrics server stopped", "err", err)
+			}
+		}()
+	}
+
+	go rc.Poll(relayInterval, rc.Quit())
+
+	cmn.TrapSignal(func(signal os.Signal) {
+		if err := rc.Stop(); err != nil {
+			logger.Error("Error stopping the relay", "err", err)
+		}
+	})
+
+	return nil
+}
+
+// parseRelayQueue splits <toChainID>[=<url>,<url>...]
+func parseRelayQueue(q string) (toChainID string, urls []string) {
+	i := strings.Index(q, "=")
+	if i < 0 {
+		return strings.TrimSpace(q), nil
+	}
+
+	for _, u := range strings.Split(q[i+1:], ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return strings.TrimSpace(q[:i]), urls
+}
+
+// liteValidatorsLoader returns the validator sets of the local chain as
+// certified by a lite client of localURL, forward from root. Without a node,
+// this is what the blocks the relayer carries are verified against.
+func liteValidatorsLoader(localURL, liteDir string, root relay.TrustRoot) (relay.ValidatorsLoader, error) {
+	u, err := url.Parse(localURL)
+	if err != nil {
+		return nil, err
+	}
+	nodeAddr := "tcp://" + u.Host
+
+	status, err := rpcclient.NewHTTP(nodeAddr, "/websocket").Status()
+	if err != nil {
+		return nil, err
+	}
+	source := certclient.NewHTTPProvider(nodeAddr)
+	return relay.LiteValidatorsLoader(liteDir, status.NodeInfo.Network, source, root)
+}
@@ -1,11 +1,13 @@
 package commands
 
 import (
+	"errors"
 	"fmt"
-	"github.com/bcbchain/tendermint/state"
+	"os"
 
 	"github.com/spf13/cobra"
 	nm "github.com/bcbchain/tendermint/node"
+	"github.com/bcbchain/tendermint/sidechain"
 	"github.com/bcbchain/tendermint/version"
 )
 
@@ -56,10 +58,14 @@ func NewRunNodeCmd(nodeProvider nm.NodeProvider) *cobra.Command {
 
 			// Create & start node
 			n, err := nodeProvider(config, logger)
+			if errors.Is(err, sidechain.ErrRestart) {
+				// a block replayed by the handshake made this node a side chain
+				logger.Info("Side chain genesis prepared, exiting to restart", "exitCode", sidechain.ExitCodeRestart)
+				os.Exit(sidechain.ExitCodeRestart)
+			}
 			if err != nil {
 				return fmt.Errorf("Failed to create node: %v", err)
 			}
-			state.NodeStop = n.OnStop
 
 			if err := n.Start(); err != nil {
 				return fmt.Errorf("Failed to start node: %v", err)
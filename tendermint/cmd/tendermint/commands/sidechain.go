@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	abci "github.com/bcbchain/bclib/tendermint/abci/types"
+
+	"github.com/bcbchain/tendermint/sidechain"
+)
+
+// SideChainCmd groups the side chain genesis tools
+var SideChainCmd = &cobra.Command{
+	Use:   "sidechain",
+	Short: "Side chain genesis tools",
+}
+
+var sideChainValidateCmd = &cobra.Command{
+	Use:   "validate <genesis file>",
+	Short: "Check a side chain genesis package before it takes effect",
+	Long: `Check the side chain genesis in the given file, without writing anything:
+the genesis doc, the code hashes of its contracts, that this node is one
+of its validators and that the config of the side chain renders. Then
+print what the genesis would change on this node.
+
+The file holds the side chain genesis of the governance tx as JSON, with
+the fields sideChainID, genesisInfo, contractData and validators.`,
+	Args:         cobra.ExactArgs(1),
+	RunE:         validateSideChain,
+	SilenceUsage: true,
+}
+
+var sideChainRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Restore the node as it was before the last side chain genesis",
+	Long: `Restore the config, the data and the forks files the node had before
+the last side chain genesis, from the tarball the genesis left in
+<home>/backup. The node must be stopped. What the side chain wrote is
+moved to <home>/backup/rollback-<time>.
+
+The app cleaned its data for the side chain, the node replays the blocks
+of the main chain to it at the next start.`,
+	Args:         cobra.NoArgs,
+	RunE:         rollbackSideChain,
+	SilenceUsage: true,
+}
+
+func init() {
+	SideChainCmd.AddCommand(sideChainValidateCmd, sideChainRollbackCmd)
+}
+
+func validateSideChain(cmd *cobra.Command, args []string) error {
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	genesisInfo := new(abci.SideChainGenesis)
+	if err = json.Unmarshal(b, genesisInfo); err != nil {
+		return fmt.Errorf("invalid side chain genesis file: %v", err)
+	}
+
+	preview, err := sidechain.NewSideChain(genesisInfo).Validate()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("side chain:", preview.ChainID)
+	for _, v := range preview.Validators {
+		fmt.Printf("validator: %s, power %d, reward to %s\n", v.Name, v.Power, v.RewardAddr)
+	}
+	for _, c := range preview.Contracts {
+		fmt.Println("contract:", c)
+	}
+	fmt.Println("changes:")
+	for _, line := range preview.Diff {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func rollbackSideChain(cmd *cobra.Command, args []string) error {
+	j, err := sidechain.Rollback()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rolled back the genesis of side chain %s from %s\n", j.SideChainID, j.Archive())
+	return nil
+}
@@ -34,7 +34,10 @@ func main() {
 		cmd.ShowValidatorCmd,
 		cmd.ShowNodeIDCmd,
 		cmd.VersionCmd,
-		cmd.GenValidatorCmd)
+		cmd.GenValidatorCmd,
+		cmd.RelayCmd,
+		cmd.SideChainCmd,
+		cmd.ForksCmd)
 
 	// NOTE:
 	// Users wishing to:
@@ -106,6 +106,10 @@ type BaseConfig struct {
 	// A Json file containing all the public keys and it's reward addresses
 	Validators string `mapstructure:"validators_file"`
 
+	// A signed JSON file with the fork schedule of the chain, next to the
+	// executable if empty
+	Forks string `mapstructure:"forks_file"`
+
 	// A custom human readable name for this node
 	Moniker string `mapstructure:"moniker"`
 
@@ -206,6 +210,15 @@ func (cfg BaseConfig) ValidatorsFile() string {
 	return rootify(cfg.Validators, cfg.RootDir)
 }
 
+// ForksFile returns the full path to the forks file, empty for the one next
+// to the executable
+func (cfg BaseConfig) ForksFile() string {
+	if cfg.Forks == "" {
+		return ""
+	}
+	return rootify(cfg.Forks, cfg.RootDir)
+}
+
 // DBDir returns the full path to the database directory
 func (cfg BaseConfig) DBDir() string {
 	return rootify(cfg.DBPath, cfg.RootDir)
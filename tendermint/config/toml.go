@@ -104,6 +104,10 @@ node_key_file = "{{ .BaseConfig.NodeKey}}"
 # Path to the Validators file containing all the genesis validators
 validators_file = "{{ .BaseConfig.Validators }}"
 
+# Path to the signed JSON file with the fork schedule of the chain,
+# tendermint-forks.json next to the executable if empty
+forks_file = "{{ .BaseConfig.Forks }}"
+
 # Mechanism to connect to the ABCI application: socket | grpc
 abci = "{{ .BaseConfig.ABCI }}"
 
@@ -20,6 +20,7 @@ import (
 	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
 
 	"github.com/pkg/errors"
+	"github.com/bcbchain/tendermint/softforks"
 	sm "github.com/bcbchain/tendermint/state"
 	"github.com/bcbchain/tendermint/types"
 	"github.com/bcbchain/tendermint/version"
@@ -201,6 +202,9 @@ type Handshaker struct {
 
 	rpcPort string
 	conf    *config.Config
+
+	forks *softforks.Registry
+	relay *relay.RelayController
 }
 
 func NewHandshaker(stateDBx dbm.DB, stateDB dbm.DB, state sm.State, store types.BlockStore, genDoc *types.GenesisDoc, conf *config.Config) *Handshaker {
@@ -234,6 +238,16 @@ func (h *Handshaker) SetLogger(l log.Logger) {
 	h.logger = l
 }
 
+// SetForks sets the fork schedule the blocks are replayed with
+func (h *Handshaker) SetForks(forks *softforks.Registry) {
+	h.forks = forks
+}
+
+// SetRelay sets the relay controller told about the blocks replayed
+func (h *Handshaker) SetRelay(rc *relay.RelayController) {
+	h.relay = rc
+}
+
 func (h *Handshaker) NBlocks() int {
 	return h.nBlocks
 }
@@ -261,7 +275,8 @@ func (h *Handshaker) Handshake(proxyApp proxy.AppConns) error {
 	// replay blocks up to the latest in the blockstore
 	_, err = h.ReplayBlocks(h.initialState, res.LastAppState, blockHeight, proxyApp)
 	if err != nil {
-		return fmt.Errorf("Error on replay(height:%d): %v", blockHeight, err)
+		// kept wrapped, a sidechain.ErrRestart makes the node exit to restart
+		return errors.Wrapf(err, "Error on replay(height:%d)", blockHeight)
 	}
 
 	h.logger.Info("Completed ABCI Handshake - Tendermint and App are synced", "appHeight", blockHeight, "appState", fmt.Sprintf("%X", res.LastAppState))
@@ -321,8 +336,6 @@ func (h *Handshaker) ReplayBlocks(state sm.State, appStateData []byte, appBlockH
 		h.logger.Info("after init", "appHash", appHash, " state.LastAppHash", state.LastAppHash)
 	}
 
-	relay.Init(h.conf, h.logger, proxyApp)
-
 	// First handle edge cases and constraints on the storeBlockHeight
 	if storeBlockHeight == 0 && len(state.LastAppHash) == 0 {
 		//Write GenAppState to stateDB for the first block
@@ -418,7 +431,7 @@ func (h *Handshaker) replayBlocks(state sm.State, proxyApp proxy.AppConns, appBl
 		h.logger.Info("Applying block", "height", i)
 		block := h.store.LoadBlock(i)
 		//note present block contains last apphash,so we should check it
-		res, err = sm.ExecCommitBlock(proxyApp.Consensus(), block, h.logger)
+		res, err = sm.ExecCommitBlock(proxyApp.Consensus(), block, h.logger, h.relay)
 		if err != nil {
 			return nil, err
 		}
@@ -451,6 +464,8 @@ func (h *Handshaker) replayBlock(state sm.State, height int64, proxyApp proxy.Ap
 	meta := h.store.LoadBlockMeta(height)
 
 	blockExec := sm.NewBlockExecutor(h.stateDBx, h.stateDB, h.logger, proxyApp, types.MockMempool{}, types.MockEvidencePool{})
+	blockExec.SetForks(h.forks)
+	blockExec.SetRelay(h.relay)
 
 	var err error
 	state, err = blockExec.ApplyBlock(state, meta.BlockID, block)
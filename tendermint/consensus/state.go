@@ -9,8 +9,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/bcbchain/tendermint/relay"
-
 	"github.com/bcbchain/bclib/tendermint/go-crypto"
 
 	"github.com/ebuchman/fail-test"
@@ -20,6 +18,7 @@ import (
 	cfg "github.com/bcbchain/tendermint/config"
 	cstypes "github.com/bcbchain/tendermint/consensus/types"
 	"github.com/bcbchain/tendermint/p2p"
+	"github.com/bcbchain/tendermint/sidechain"
 	sm "github.com/bcbchain/tendermint/state"
 	"github.com/bcbchain/tendermint/types"
 )
@@ -962,7 +961,10 @@ func (cs *ConsensusState) calcRelayer(height int64) (relayer *types.Relayer) {
 }
 
 func (cs *ConsensusState) needRelayer() bool {
-	rc := relay.GetRelayController()
+	rc := cs.blockExec.Relay()
+	if rc == nil {
+		return false
+	}
 
 	var count int
 
@@ -1082,7 +1084,7 @@ func (cs *ConsensusState) createProposalBlock() (block *types.Block, blockParts
 
 	relayer := cs.calcRelayer(cs.Height)
 
-	block, parts := cs.state.MakeBlock(cs.Height, txs, commit, cs.privValidator.GetAddress(), rewardAddr, cs.state.LastAllocation, relayer)
+	block, parts := cs.state.MakeBlock(cs.Height, txs, commit, cs.privValidator.GetAddress(), rewardAddr, cs.state.LastAllocation, relayer, cs.blockExec.Forks())
 	evidence := cs.evpool.PendingEvidence()
 	block.AddEvidence(evidence)
 	return block, parts
@@ -1489,6 +1491,12 @@ func (cs *ConsensusState) finalizeCommit(height int64) {
 	// NOTE: the block.AppHash wont reflect these txs until the next block
 	var err error
 	stateCopy, err = cs.blockExec.ApplyBlock(stateCopy, types.BlockID{Hash: block.Hash(), PartsHeader: blockParts.Header()}, block)
+	if errors.Is(err, sidechain.ErrRestart) {
+		// the block made this node a side chain, the genesis is finished at the next boot
+		cs.Logger.Info("Side chain genesis prepared, stopping to restart", "height", height)
+		cs.blockExec.Restart()
+		return
+	}
 	if err != nil {
 		cs.Logger.Error("Error on ApplyBlock. Did the application crash? Please restart tendermint", "err", err)
 		err := cmn.Kill()
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/bcbchain/tendermint/proxy"
 
@@ -78,6 +79,22 @@ func DefaultGenesisDocProviderFunc(config *cfg.Config) GenesisDocProvider {
 	}
 }
 
+// cleanAppData asks the app to drop its data, on a connection of its own as
+// the node does not run yet
+func cleanAppData(clientCreator proxy.ClientCreator, logger log.Logger) error {
+	client, err := clientCreator.NewABCIClient()
+	if err != nil {
+		return err
+	}
+	client.SetLogger(logger.With("module", "abci-client", "connection", "sidechain"))
+	if err = client.Start(); err != nil {
+		return err
+	}
+	defer client.Stop() // nolint: errcheck
+
+	return sm.CleanAppData(proxy.NewAppConnConsensus(client))
+}
+
 // NodeProvider takes a config and a logger and returns a ready to go Node.
 type NodeProvider func(*cfg.Config, log.Logger) (*Node, error)
 
@@ -87,12 +104,12 @@ type NodeProvider func(*cfg.Config, log.Logger) (*Node, error)
 func DefaultNewNode(config *cfg.Config, logger log.Logger) (*Node, error) {
 	switch len(config.ProxyApp) {
 	case 1, 3:
+		clientCreator := proxy.DefaultClientCreator(config.ProxyApp[0], config.ABCI, config.DBDir())
+
+		// finish a side chain genesis interrupted by the restart or a crash
 		sc := sidechain.NewSideChain(nil)
-		if sc.NeedSCGenesis() {
-			err := sc.Genesis()
-			if err != nil {
-				panic(err)
-			}
+		if err := sc.Resume(func() error { return cleanAppData(clientCreator, logger) }); err != nil {
+			return nil, err
 		}
 
 		if err := sc.CopyGenesisFiles(); err != nil {
@@ -101,7 +118,7 @@ func DefaultNewNode(config *cfg.Config, logger log.Logger) (*Node, error) {
 
 		return NewNode(config,
 			pvm.LoadOrGenFilePV(config.PrivValidatorFile()),
-			proxy.DefaultClientCreator(config.ProxyApp[0], config.ABCI, config.DBDir()),
+			clientCreator,
 			DefaultGenesisDocProviderFunc(config),
 			DefaultDBProvider,
 			logger)
@@ -140,6 +157,11 @@ type Node struct {
 	rpcListeners     []net.Listener         // rpc servers
 	txIndexer        txindex.TxIndexer
 	indexerService   *txindex.IndexerService
+	relay            *relay.RelayController // relays the ibc packets of the local chain
+	forks            *softforks.Registry    // fork schedule of the chain
+
+	restartC    chan struct{} // closed when a block asks the node to restart
+	restartOnce sync.Once
 }
 
 // NewNode returns a new, ready to go, Tendermint Node.
@@ -150,8 +172,6 @@ func NewNode(config *cfg.Config,
 	dbProvider DBProvider,
 	logger log.Logger) (*Node, error) {
 
-	softforks.Init()
-
 	// Get BlockStore
 	blockStoreDB, err := dbProvider(&DBContext{"blockstore", config})
 	if err != nil {
@@ -206,12 +226,19 @@ func NewNode(config *cfg.Config,
 		return nil, err
 	}
 
+	forks, err := softforks.Load(config.ForksFile(), genDoc.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	forks.LogSchedule(logger.With("module", "forks"), state.LastBlockHeight)
+
 	// Start the RPC server before the P2P server
 	// so we can eg. receive txs for the first block
-	node := &Node{config: config}
+	node := &Node{config: config, restartC: make(chan struct{})}
 	node.BaseService = *cmn.NewBaseService(logger, "Node", node)
 	rpccore.SetStateDB(stateDB)
 	rpccore.SetBlockStore(blockStore)
+	rpccore.SetForks(forks)
 	if config.RPC.ListenAddress != "" {
 		listeners, err := node.startRPC()
 		if err != nil {
@@ -226,16 +253,24 @@ func NewNode(config *cfg.Config,
 	consensusLogger := logger.With("module", "consensus")
 	handshaker := cs.NewHandshaker(stateDBx, stateDB, state, blockStore, genDoc, config)
 	handshaker.SetLogger(consensusLogger)
+	handshaker.SetForks(forks)
 	proxyApp := proxy.NewAppConns(clientCreator, handshaker)
 	proxyApp.SetLogger(logger.With("module", "proxy"))
 	rpccore.SetAppConns(proxyApp)
+
+	// the relay learns the open urls of the blocks replayed, and checks local
+	// blocks against the validators of our own state
+	node.relay = relay.New(config, logger, proxyApp)
+	node.relay.SetValidatorsLoader(func(height int64) (*types.ValidatorSet, error) {
+		return sm.LoadValidators(stateDB, height)
+	})
+	handshaker.SetRelay(node.relay)
+	rpccore.SetRelayController(node.relay)
 	if err := proxyApp.Start(); err != nil {
 		logger.Info("连接 abci 失败", "err", err)
-		return nil, fmt.Errorf("Error starting proxy app connections: %v", err)
+		return nil, fmt.Errorf("Error starting proxy app connections: %w", err)
 	}
 
-	relay.Init(config, logger, proxyApp)
-
 	// reload the state (it may have been updated by the handshake)
 	state = sm.LoadState(stateDBx)
 
@@ -304,6 +339,9 @@ func NewNode(config *cfg.Config,
 	blockExecLogger := logger.With("module", "state")
 	// make block executor for consensus and blockchain reactors to execute blocks
 	blockExec := sm.NewBlockExecutor(stateDBx, stateDB, blockExecLogger, proxyApp.Consensus(), mempool, evidencePool)
+	blockExec.SetForks(forks)
+	blockExec.SetRelay(node.relay)
+	blockExec.SetRestart(node.requestRestart)
 
 	// Make BlockchainReactor
 	bcReactor := bc.NewBlockchainReactor(state.Copy(), blockExec, blockStore, fastSync)
@@ -434,6 +472,7 @@ func NewNode(config *cfg.Config,
 	node.txIndexer = txIndexer
 	node.indexerService = indexerService
 	node.eventBus = eventBus
+	node.forks = forks
 
 	//node.BaseService = *cmn.NewBaseService(logger, "Node", node)
 	return node, nil
@@ -446,6 +485,11 @@ func (n *Node) OnStart() error {
 		return err
 	}
 
+	err = n.relay.Start()
+	if err != nil {
+		return err
+	}
+
 	aAddr := n.config.P2P.AAddress
 	if strings.Contains(aAddr, "0.0.0.0") {
 		aAddr = ""
@@ -512,6 +556,10 @@ func (n *Node) OnStop() {
 	n.BaseService.OnStop()
 
 	n.Logger.Info("Stopping Node")
+	// wait for the batches being relayed
+	if e := n.relay.Stop(); e != nil {
+		n.Logger.Error("Error stopping relay", "err", e)
+	}
 	// TODO: gracefully disconnect from peers.
 	if e := n.sw.Stop(); e != nil {
 		println("n.sw.Stop CAUSE ERROR")
@@ -538,8 +586,19 @@ func (n *Node) OnStop() {
 	}
 }
 
-// RunForever waits for an interrupt signal and stops the node.
+// RunForever waits for an interrupt signal and stops the node. A node asked
+// to restart by a side chain genesis stops and exits with
+// sidechain.ExitCodeRestart.
 func (n *Node) RunForever() {
+	go func() {
+		<-n.restartC
+		n.Logger.Warn("Side chain genesis prepared, stopping to restart", "exitCode", sidechain.ExitCodeRestart)
+		if e := n.Stop(); e != nil {
+			n.Logger.Error("Error stopping node", "err", e)
+		}
+		os.Exit(sidechain.ExitCodeRestart)
+	}()
+
 	// Sleep forever and then...
 	cmn.TrapSignal(func(sig os.Signal) {
 		n.Logger.Warn("TERM Signal received, exiting....", "sig", sig)
@@ -549,6 +608,12 @@ func (n *Node) RunForever() {
 	})
 }
 
+// requestRestart asks RunForever to stop the node for a restart, it is
+// called by the routine applying the block and can not wait for the stop
+func (n *Node) requestRestart() {
+	n.restartOnce.Do(func() { close(n.restartC) })
+}
+
 // AddListener adds a listener to accept inbound peer connections.
 // It should be called before starting the Node.
 // The first listener is the primary listener (in NodeInfo)
@@ -571,6 +636,8 @@ func (n *Node) ConfigureRPC() {
 	rpccore.SetProxyAppQuery(n.proxyApp.Query())
 	rpccore.SetTxIndexer(n.txIndexer)
 	rpccore.SetConsensusReactor(n.consensusReactor)
+	rpccore.SetForks(n.forks)
+	rpccore.SetRelayController(n.relay)
 	rpccore.SetEventBus(n.eventBus)
 	rpccore.SetLogger(n.Logger.With("module", "rpc"))
 	rpccore.SetPrivatePeerIDs(n.config.P2P.PrivatePeerIDs)
@@ -608,6 +675,14 @@ func (n *Node) startRPC() ([]net.Listener, error) {
 		wm.SetLogger(rpcLogger.With("protocol", "websocket"))
 		mux.HandleFunc("/websocket", wm.WebsocketHandler)
 		rpcserver.RegisterRPCFuncs(mux, rpccore.Routes, coreCodec, rpcLogger)
+		// the relay is created after the rpc server starts
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			if rc := n.relay; rc != nil {
+				rc.Metrics().ServeHTTP(w, r)
+				return
+			}
+			http.NotFound(w, r)
+		})
 
 		var listener net.Listener
 		var err error
@@ -686,6 +761,11 @@ func (n *Node) ProxyApp() proxy.AppConns {
 	return n.proxyApp
 }
 
+// RelayController returns the Node's RelayController.
+func (n *Node) RelayController() *relay.RelayController {
+	return n.relay
+}
+
 func (n *Node) makeNodeInfo(nodeID p2p.ID) p2p.NodeInfo {
 	txIndexerStatus := "on"
 	if _, ok := n.txIndexer.(*null.TxIndex); ok {
@@ -709,6 +789,7 @@ func (n *Node) makeNodeInfo(nodeID p2p.ID) p2p.NodeInfo {
 			cmn.Fmt("consensus_version=%v", cs.Version),
 			cmn.Fmt("rpc_version=%v/%v", rpc.Version, rpccore.Version),
 			cmn.Fmt("tx_index=%v", txIndexerStatus),
+			cmn.Fmt("%v=%v", softforks.NodeInfoKey, n.forks.Hash()),
 		},
 	}
 
@@ -0,0 +1,405 @@
+package relay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	dbm "github.com/bcbchain/bclib/tendermint/tmlibs/db"
+)
+
+func seqs(from, to uint64) []uint64 {
+	var s []uint64
+	for i := from; i <= to; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+func TestCarry(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 2)
+	h.local.emit(h.queueID, 1)
+
+	if sent := h.carry(); sent != 1 {
+		t.Fatalf("sent %d batches, want 1", sent)
+	}
+	if len(h.qr.inflight) != 1 || h.qr.currentNode.Nonce != 1 {
+		t.Fatalf("inflight %d, nonce %d", len(h.qr.inflight), h.qr.currentNode.Nonce)
+	}
+
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 3)) {
+		t.Fatalf("executed %v", got)
+	}
+	if len(h.qr.inflight) != 0 {
+		t.Fatalf("inflight %d after commit", len(h.qr.inflight))
+	}
+	cp := h.qr.Checkpoint()
+	if cp.Sequence != 3 || cp.Nonce != 1 || len(cp.TxHash) == 0 {
+		t.Fatalf("checkpoint %+v", cp)
+	}
+
+	// nothing new, nothing sent
+	if sent := h.carry(); sent != 0 {
+		t.Fatalf("sent %d batches without packets", sent)
+	}
+
+	qs := h.qr.metrics.Queues()
+	if len(qs) != 1 || qs[0].LocalSeq != 3 || qs[0].RemoteSeq != 3 || qs[0].BatchesSent != 1 {
+		t.Fatalf("status %+v", qs)
+	}
+}
+
+func TestCarryCorruptCheckpoint(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 2)
+	h.carry()
+	h.remote.commit()
+	h.carry()
+
+	// after a restart the checkpoint can not be read, the queue goes on from
+	// the remote sequence
+	db := dbm.NewMemDB()
+	db.SetSync(calcCheckpointKey(h.queueID), []byte("garbage"))
+	h.qr.checkpoints = newCheckpointStoreWithDB(db)
+	h.qr.reconciled = false
+	h.qr.currentNode.Nonce = 0
+	if _, ok, err := h.qr.checkpoints.load(h.queueID); ok || err == nil {
+		t.Fatalf("corrupt checkpoint loaded: %v", err)
+	}
+
+	h.local.emit(h.queueID, 1)
+	if sent := h.carry(); sent != 1 {
+		t.Fatalf("sent %d batches", sent)
+	}
+	if h.qr.inflight[0].firstSeq != 3 {
+		t.Fatalf("inflight %+v", h.qr.inflight[0])
+	}
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 3)) {
+		t.Fatalf("executed %v", got)
+	}
+	if cp, ok, err := newCheckpointStoreWithDB(db).load(h.queueID); !ok || err != nil || cp.Sequence != 3 || cp.Nonce != 2 {
+		t.Fatalf("checkpoint %+v, %v", cp, err)
+	}
+}
+
+func TestCarryPipeline(t *testing.T) {
+	h := newRelayHarness(t)
+
+	// each carry finds a block more, until the pipeline is full
+	for i := 0; i < maxInFlight+1; i++ {
+		h.local.emit(h.queueID, 1)
+		h.carry()
+	}
+	if len(h.qr.inflight) != maxInFlight {
+		t.Fatalf("inflight %d, want %d", len(h.qr.inflight), maxInFlight)
+	}
+	for i, b := range h.qr.inflight {
+		if b.nonce != uint64(i+1) || b.firstSeq != uint64(i+1) || b.lastSeq != uint64(i+1) {
+			t.Fatalf("batch %d: %+v", i, b)
+		}
+	}
+
+	h.remote.commit()
+	h.carry()
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, maxInFlight+1)) {
+		t.Fatalf("executed %v", got)
+	}
+}
+
+func TestCarryRemoteErrors(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 1)
+
+	// the remote sequence can not be read, nothing is sent
+	h.remote.inject(keyOfSequence(h.queueID), faultError, 1)
+	if sent := h.carry(); sent != 0 {
+		t.Fatalf("sent %d batches", sent)
+	}
+	if h.qr.reconciled {
+		t.Fatal("reconciled without the remote sequence")
+	}
+
+	// the local chain drops a block, the batch waits for it
+	h.local.inject("block_results", faultDrop, 1)
+	if sent := h.carry(); sent != 0 {
+		t.Fatalf("sent %d batches", sent)
+	}
+
+	h.carry()
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 1)) {
+		t.Fatalf("executed %v", got)
+	}
+}
+
+func TestCarryDroppedBroadcast(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 2)
+
+	// the remote node takes the tx but its answer is lost
+	h.remote.inject("broadcast_tx_sync", faultDrop, 1)
+	if sent := h.carry(); sent != 0 {
+		t.Fatalf("sent %d batches", sent)
+	}
+	if h.qr.remoteSeq != 0 || h.qr.currentNode.Nonce != 0 {
+		t.Fatalf("not rewound: remoteSeq %d, nonce %d", h.qr.remoteSeq, h.qr.currentNode.Nonce)
+	}
+
+	// sent again with the same nonce, the remote node refuses the duplicate
+	if sent := h.carry(); sent != 0 {
+		t.Fatalf("duplicate accepted")
+	}
+	if h.qr.remoteIBC != nil {
+		t.Fatal("remote ibc kept after a refused tx")
+	}
+
+	// the lost tx executes, the relay finds nothing left to send
+	h.remote.commit()
+	h.carry()
+	h.remote.commit()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 2)) {
+		t.Fatalf("executed %v", got)
+	}
+	if h.remote.failedTxs != 0 {
+		t.Fatalf("%d txs failed", h.remote.failedTxs)
+	}
+}
+
+func TestCarryNonceConflict(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 1)
+	h.carry()
+	h.remote.commit()
+	h.carry()
+
+	// the relayer key sent a tx of its own to the remote chain
+	h.remote.useNonce(h.qr.currentNode.Address)
+	h.local.emit(h.queueID, 1)
+	if sent := h.carry(); sent != 0 {
+		t.Fatal("tx with a spent nonce accepted")
+	}
+	if h.qr.currentNode.Nonce != 0 {
+		t.Fatalf("nonce %d kept after a conflict", h.qr.currentNode.Nonce)
+	}
+
+	if sent := h.carry(); sent != 1 {
+		t.Fatalf("sent %d batches after the conflict", sent)
+	}
+	if h.qr.currentNode.Nonce != 3 {
+		t.Fatalf("nonce %d, want 3", h.qr.currentNode.Nonce)
+	}
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 2)) {
+		t.Fatalf("executed %v", got)
+	}
+}
+
+func TestCarryReordered(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 1)
+	h.carry()
+	h.local.emit(h.queueID, 2)
+	h.carry()
+	if len(h.qr.inflight) != 2 {
+		t.Fatalf("inflight %d", len(h.qr.inflight))
+	}
+
+	// the second batch executes first and fails on its nonce
+	h.remote.reorder = true
+	h.remote.commit()
+	h.remote.reorder = false
+	if h.remote.failedTxs != 1 {
+		t.Fatalf("%d txs failed", h.remote.failedTxs)
+	}
+	h.carry()
+	if len(h.qr.inflight) != 1 || h.qr.inflight[0].firstSeq != 2 {
+		t.Fatalf("inflight %+v", h.qr.inflight)
+	}
+
+	// the lost batch times out, the queue rewinds to the remote sequence
+	h.qr.inflight[0].sentAt = h.qr.inflight[0].sentAt.Add(-2 * inflightTimeout)
+	h.carry()
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 3)) {
+		t.Fatalf("executed %v", got)
+	}
+	if cp := h.qr.Checkpoint(); cp.Sequence != 3 {
+		t.Fatalf("checkpoint %+v", cp)
+	}
+}
+
+func TestCarryStuckUnderLoad(t *testing.T) {
+	h := newRelayHarness(t)
+	clock := time.Now()
+	h.qr.packets.now = func() time.Time { return clock }
+	stuck := h.local.emit(h.queueID, 1)[0]
+	h.carry()
+
+	// the remote node loses the batch from its mempool, the batches after it
+	// are refused while new packets keep coming
+	h.remote.mtx.Lock()
+	h.remote.mempool = nil
+	h.remote.mtx.Unlock()
+	for i := 0; i < 3; i++ {
+		h.local.emit(h.queueID, 1)
+		h.carry()
+		h.remote.commit()
+	}
+	if got := h.remote.executedSeqs(h.queueID); len(got) != 0 {
+		t.Fatalf("executed %v", got)
+	}
+	if len(h.qr.inflight) == 0 {
+		t.Fatal("window empty before the packet is stuck")
+	}
+
+	// the first packet is stuck, the window is dropped long before it times out
+	clock = clock.Add(packetTimeout)
+	h.local.emit(h.queueID, 1)
+	h.carry()
+	if h.qr.resync {
+		t.Fatal("resync not acted on")
+	}
+	h.remote.commit()
+	h.local.emit(h.queueID, 1)
+	h.carry()
+	h.remote.commit()
+	h.carry()
+	if got := h.remote.executedSeqs(h.queueID); !reflect.DeepEqual(got, seqs(1, 6)) {
+		t.Fatalf("executed %v", got)
+	}
+	if ps, _ := h.qr.packets.get(stuck.IbcHash); ps.Stage != StageExecuted {
+		t.Fatalf("stuck packet: %+v", ps)
+	}
+}
+
+func TestCollectRejectsBadProof(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 1)
+
+	// the local chain shows blocks signed by other validators
+	other := newMockChain(t, "local")
+	h.qr.verifier.setLoader(other.validators)
+	h.carry()
+	if len(h.qr.inflight) != 0 {
+		t.Fatal("relayed a block the validators did not sign")
+	}
+	if qs := h.qr.metrics.Queues(); len(qs) != 1 || qs[0].ProofsRejected == 0 {
+		t.Fatalf("status %+v", qs)
+	}
+
+	h.qr.verifier.setLoader(h.local.validators)
+	if sent := h.carry(); sent != 1 {
+		t.Fatalf("sent %d batches", sent)
+	}
+}
+
+func TestCollectBatchLimit(t *testing.T) {
+	h := newRelayHarness(t)
+	h.local.emit(h.queueID, 1)
+	h.local.emit(h.queueID, 1)
+
+	h.qr.currentRoundURL = h.remote.URL()
+	h.qr.remoteIBC = &IBCContractInfo{Address: mockIBCAddr, MethodID: mustMethodID(), Gas: maxBatchGas}
+	proofs, headers := h.qr.collectIBCPktsProof(false)
+	if len(proofs) != 1 || len(headers) != 1 || h.qr.remoteSeq != 1 {
+		t.Fatalf("collected %d blocks up to %d over the gas limit", len(proofs), h.qr.remoteSeq)
+	}
+
+	h.qr.remoteIBC.Gas = 1
+	proofs, _ = h.qr.collectIBCPktsProof(false)
+	if len(proofs) != 2 || h.qr.remoteSeq != 2 {
+		t.Fatalf("collected %d blocks up to %d", len(proofs), h.qr.remoteSeq)
+	}
+}
+
+func TestProcessTxResult(t *testing.T) {
+	h := newRelayHarness(t)
+	qr := h.qr
+	qr.remoteIBC = &IBCContractInfo{Address: mockIBCAddr}
+	qr.currentNode.Nonce = 5
+
+	if err := qr.processTxResult(&ResultBroadcastTx{Code: 200}); err != nil || qr.currentNode.Nonce != 6 {
+		t.Fatalf("accepted: err %v, nonce %d", err, qr.currentNode.Nonce)
+	}
+
+	// refused with txs in flight, their nonces stay ours
+	qr.inflight = []*inflightTx{{nonce: 6}}
+	if err := qr.processTxResult(&ResultBroadcastTx{Code: 500, Log: "invalid nonce"}); err == nil {
+		t.Fatal("refused tx without error")
+	}
+	if qr.currentNode.Nonce != 6 || qr.remoteIBC != nil {
+		t.Fatalf("refused in flight: nonce %d, remote ibc %v", qr.currentNode.Nonce, qr.remoteIBC)
+	}
+
+	qr.inflight = nil
+	if err := qr.processTxResult(&ResultBroadcastTx{Code: 500, Log: "invalid nonce"}); err == nil || err.Error() != "invalid nonce" {
+		t.Fatalf("refused: %v", err)
+	}
+	if qr.currentNode.Nonce != 0 {
+		t.Fatalf("nonce %d not queried again", qr.currentNode.Nonce)
+	}
+}
+
+func TestFollowPacketsBounded(t *testing.T) {
+	h := newRelayHarness(t)
+	h.qr.currentRoundURL = h.remote.URL()
+	const n = 2*maxFollowScan + 20
+	for i := uint64(1); i <= n; i++ {
+		h.qr.packets.emitted(1, Packet{QueueID: h.queueID, Seq: i, IbcHash: []byte{byte(i >> 8), byte(i)}})
+	}
+	h.remote.mtx.Lock()
+	h.remote.setJSON(keyOfMessageIndex(h.queueID, n), MessageIndex{Height: 2, IbcHash: []byte{byte(n >> 8), byte(n)}})
+	h.remote.mtx.Unlock()
+
+	looked := func() (seqs []uint64) {
+		h.remote.mtx.Lock()
+		defer h.remote.mtx.Unlock()
+		for i := uint64(1); i <= n; i++ {
+			if h.remote.calls[keyOfMessageIndex(h.queueID, i)] > 0 {
+				seqs = append(seqs, i)
+			}
+		}
+		return seqs
+	}
+
+	// each carry looks up the next maxFollowScan packets
+	h.qr.followPackets()
+	if got := looked(); !reflect.DeepEqual(got, seqs(1, maxFollowScan)) {
+		t.Fatalf("looked up %v", got)
+	}
+	h.qr.followPackets()
+	h.qr.followPackets()
+	if got := looked(); !reflect.DeepEqual(got, seqs(1, n)) {
+		t.Fatalf("looked up %v", got)
+	}
+	if ps, _ := h.qr.packets.get([]byte{byte(n >> 8), byte(n)}); ps.Stage != StageExecuted {
+		t.Fatalf("last packet: %+v", ps)
+	}
+
+	// a failed lookup makes the url back off and ends the scan
+	next := h.qr.followSeq + 1
+	h.remote.inject(keyOfMessageIndex(h.queueID, next), faultError, 1)
+	h.qr.followPackets()
+	if h.qr.followSeq != next-1 {
+		t.Fatalf("followSeq %d, want %d", h.qr.followSeq, next-1)
+	}
+	if h.remote.calls[keyOfMessageIndex(h.queueID, next+1)] > 1 {
+		t.Fatal("scan went on after a failure")
+	}
+	if _, ok := h.qr.pool.pick(nil); ok {
+		t.Fatal("url not backing off after a failed lookup")
+	}
+	if rs := h.qr.metrics.Remotes(); len(rs) != 1 || rs[0].Failures != 1 {
+		t.Fatalf("remotes %+v", rs)
+	}
+}
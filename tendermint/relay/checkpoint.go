@@ -0,0 +1,134 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	dbm "github.com/bcbchain/bclib/tendermint/tmlibs/db"
+	cfg "github.com/bcbchain/tendermint/config"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Checkpoint is the progress of one queue, saved after every delivered batch
+type Checkpoint struct {
+	QueueID  string       `json:"queueID"`
+	Sequence uint64       `json:"sequence"` // last sequence delivered to the remote chain
+	Height   int64        `json:"height"`   // last local height whose packets were delivered
+	Nonce    uint64       `json:"nonce"`    // nonce of the last delivered tx
+	TxHash   cmn.HexBytes `json:"txHash"`   // hash of the last delivered tx
+	Time     time.Time    `json:"time"`
+}
+
+// Behind returns how many local blocks the queue has not scanned yet
+func (cp Checkpoint) Behind(localHeight int64) int64 {
+	if localHeight <= cp.Height {
+		return 0
+	}
+	return localHeight - cp.Height
+}
+
+// checkpointStore keeps the checkpoints of all queues in the relay db of the
+// node's data dir
+type checkpointStore struct {
+	mtx    sync.Mutex
+	db     dbm.DB
+	cache  map[string]Checkpoint
+	closed bool // a queue removed before the stop may still save its batch
+}
+
+func newCheckpointStore(config *cfg.Config) *checkpointStore {
+	dbType := dbm.DBBackendType(config.DBBackend)
+	return newCheckpointStoreWithDB(dbm.NewDB("relay", dbType, config.DBDir()))
+}
+
+func newCheckpointStoreWithDB(db dbm.DB) *checkpointStore {
+	return &checkpointStore{
+		db:    db,
+		cache: make(map[string]Checkpoint),
+	}
+}
+
+func calcCheckpointKey(queueID string) []byte {
+	return []byte(cmn.Fmt("relayCheckpoint:%v", queueID))
+}
+
+// load returns the checkpoint of queueID, ok is false if nothing was saved
+// yet or the record can not be decoded, then err tells why
+func (cs *checkpointStore) load(queueID string) (cp Checkpoint, ok bool, err error) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if cp, ok = cs.cache[queueID]; ok {
+		return
+	}
+
+	if cs.closed {
+		return Checkpoint{QueueID: queueID}, false, errors.New("checkpoint store is closed")
+	}
+	value := cs.db.Get(calcCheckpointKey(queueID))
+	if len(value) == 0 {
+		return Checkpoint{QueueID: queueID}, false, nil
+	}
+	if err = jsoniter.Unmarshal(value, &cp); err != nil {
+		return Checkpoint{QueueID: queueID}, false, fmt.Errorf("checkpoint of %s is corrupted: %v", queueID, err)
+	}
+	cs.cache[queueID] = cp
+	return cp, true, nil
+}
+
+// save writes cp synchronously, so it survives a crash right after the tx
+func (cs *checkpointStore) save(cp Checkpoint) error {
+	value, err := jsoniter.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if cs.closed {
+		return errors.New("checkpoint store is closed")
+	}
+	cs.db.SetSync(calcCheckpointKey(cp.QueueID), value)
+	cs.cache[cp.QueueID] = cp
+	return nil
+}
+
+// drop deletes the checkpoint of queueID, the queue starts over as a fresh one
+func (cs *checkpointStore) drop(queueID string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if !cs.closed {
+		cs.db.DeleteSync(calcCheckpointKey(queueID))
+	}
+	delete(cs.cache, queueID)
+}
+
+// close closes the db, the checkpoints in the cache can still be read
+func (cs *checkpointStore) close() {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if !cs.closed {
+		cs.db.Close()
+		cs.closed = true
+	}
+}
+
+// all returns the checkpoints loaded or saved so far, sorted by queueID
+func (cs *checkpointStore) all() []Checkpoint {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	cps := make([]Checkpoint, 0, len(cs.cache))
+	for _, cp := range cs.cache {
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i].QueueID < cps[j].QueueID })
+	return cps
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/bcbchain/bclib/tendermint/go-crypto"
 	tx3 "github.com/bcbchain/bclib/tx/v3"
 	"github.com/bcbchain/bclib/types"
-	cfg "github.com/bcbchain/tendermint/config"
 	pvm "github.com/bcbchain/tendermint/types/priv_validator"
 )
 
@@ -72,9 +71,8 @@ func queryIBCContract(url, orgID string) (*Contract, error) {
 	return nil, errors.New("can not get valid ibc contract address")
 }
 
-func getCurrentNodePrivKey(config *cfg.Config) crypto.PrivKey {
-	privValidatorFile := config.PrivValidatorFile()
-	return pvm.LoadFilePV(privValidatorFile).PrivKey
+func getCurrentNodePrivKey(pv *pvm.FilePV) crypto.PrivKey {
+	return pv.PrivKey
 }
 
 func getOtherOrgID(pktsProofs []*PktsProof, genesisOrgID string) (otherOrgID string) {
@@ -98,18 +96,17 @@ func makeQueueID(fromChainID, toChainID string) string {
 	return fromChainID + "->" + toChainID
 }
 
-func getNodeAddress(config *cfg.Config, currentChainID, toChainID string, addrVer int32) string {
-	privValidatorFile := config.PrivValidatorFile()
+func getNodeAddress(pv *pvm.FilePV, currentChainID, toChainID string, addrVer int32) string {
 	if len(toChainID) == 0 {
-		return pvm.LoadFilePV(privValidatorFile).GetAddress()
+		return pv.GetAddress()
 	}
 
 	if addrVer == 1 || !strings.Contains(toChainID, "[") {
-		return pvm.LoadFilePV(privValidatorFile).PubKey.Address(toChainID)
+		return pv.PubKey.Address(toChainID)
 	}
 
 	if addrVer == 0 {
-		cAddr := pvm.LoadFilePV(privValidatorFile).GetAddress()
+		cAddr := pv.GetAddress()
 		return strings.Replace(cAddr, currentChainID, toChainID, 1)
 	}
 
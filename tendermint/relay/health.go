@@ -0,0 +1,44 @@
+package relay
+
+import "time"
+
+const (
+	// a failed init is retried after initRetryInterval, doubled after each
+	// failure up to maxInitRetryInterval
+	initRetryInterval    = 5 * time.Second
+	maxInitRetryInterval = time.Minute
+)
+
+// Health tells whether the relay knows the queues of the local chain. It is
+// degraded while the app does not answer or the open URLs it needs are not
+// set yet, and the queries are retried in the background.
+type Health struct {
+	Ready       bool      `json:"ready"`
+	Error       string    `json:"error,omitempty"` // why the last init failed
+	Failures    int       `json:"failures"`        // failed inits so far
+	LastAttempt time.Time `json:"last_attempt"`
+}
+
+// Health returns the health of the relay
+func (rc *RelayController) Health() Health {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	return rc.health
+}
+
+// setHealth records the outcome of an init
+func (rc *RelayController) setHealth(err error) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	rc.health.LastAttempt = time.Now()
+	if err == nil {
+		rc.health.Ready = true
+		rc.health.Error = ""
+		return
+	}
+	rc.health.Ready = false
+	rc.health.Error = err.Error()
+	rc.health.Failures++
+}
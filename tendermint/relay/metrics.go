@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueStatus is what the relay knows about one queue
+type QueueStatus struct {
+	QueueID         string     `json:"queue_id"`
+	Running         bool       `json:"running"`
+	CurrentRoundURL string     `json:"current_round_url"`
+	RemoteIBC       string     `json:"remote_ibc"` // address of the ibc contract on the remote chain
+	Nonce           uint64     `json:"nonce"`
+	LocalSeq        uint64     `json:"local_seq"`  // last sequence sent on the local chain
+	RemoteSeq       uint64     `json:"remote_seq"` // last sequence received by the remote chain
+	Pending         uint64     `json:"pending"`    // packets not relayed yet
+	InFlight        int        `json:"in_flight"`  // txs sent and not executed yet
+	BatchesSent     uint64     `json:"batches_sent"`
+	BatchesFailed   uint64     `json:"batches_failed"`
+	ProofsRejected  uint64     `json:"proofs_rejected"` // local blocks that failed verification
+	LastError       string     `json:"last_error"`
+	LastErrorTime   time.Time  `json:"last_error_time"`
+	Checkpoint      Checkpoint `json:"checkpoint"`
+}
+
+// RemoteStatus is the call statistics of one remote URL
+type RemoteStatus struct {
+	URL          string        `json:"url"`
+	Calls        uint64        `json:"calls"`
+	Failures     uint64        `json:"failures"`
+	LastLatency  time.Duration `json:"last_latency"`
+	TotalLatency time.Duration `json:"total_latency"`
+}
+
+// Metrics collects the state of every queue and remote URL. It is served in
+// the Prometheus text format by ServeHTTP and as JSON by the relay_status RPC.
+type Metrics struct {
+	mtx     sync.Mutex
+	queues  map[string]*QueueStatus
+	remotes map[string]*RemoteStatus
+}
+
+// NewMetrics returns empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		queues:  make(map[string]*QueueStatus),
+		remotes: make(map[string]*RemoteStatus),
+	}
+}
+
+// update changes the status of queueID under the lock
+func (m *Metrics) update(queueID string, fn func(qs *QueueStatus)) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	qs, ok := m.queues[queueID]
+	if !ok {
+		qs = &QueueStatus{QueueID: queueID}
+		m.queues[queueID] = qs
+	}
+	fn(qs)
+	if qs.LocalSeq > qs.RemoteSeq {
+		qs.Pending = qs.LocalSeq - qs.RemoteSeq
+	} else {
+		qs.Pending = 0
+	}
+}
+
+func (m *Metrics) setRunning(queueID string, running bool) {
+	m.update(queueID, func(qs *QueueStatus) { qs.Running = running })
+}
+
+func (m *Metrics) batchSent(queueID string) {
+	m.update(queueID, func(qs *QueueStatus) { qs.BatchesSent++ })
+}
+
+func (m *Metrics) batchFailed(queueID string, err error) {
+	m.update(queueID, func(qs *QueueStatus) {
+		qs.BatchesFailed++
+		qs.LastError = err.Error()
+		qs.LastErrorTime = time.Now()
+	})
+}
+
+func (m *Metrics) proofRejected(queueID string, err error) {
+	m.update(queueID, func(qs *QueueStatus) {
+		qs.ProofsRejected++
+		qs.LastError = err.Error()
+		qs.LastErrorTime = time.Now()
+	})
+}
+
+// observeCall records a call to a remote URL that took d
+func (m *Metrics) observeCall(url string, d time.Duration, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	rs, ok := m.remotes[url]
+	if !ok {
+		rs = &RemoteStatus{URL: url}
+		m.remotes[url] = rs
+	}
+	rs.Calls++
+	if err != nil {
+		rs.Failures++
+	}
+	rs.LastLatency = d
+	rs.TotalLatency += d
+}
+
+// Queues returns a copy of the status of every queue, sorted by queueID
+func (m *Metrics) Queues() []QueueStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	queues := make([]QueueStatus, 0, len(m.queues))
+	for _, qs := range m.queues {
+		queues = append(queues, *qs)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].QueueID < queues[j].QueueID })
+	return queues
+}
+
+// Remotes returns a copy of the statistics of every remote URL, sorted by URL
+func (m *Metrics) Remotes() []RemoteStatus {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	remotes := make([]RemoteStatus, 0, len(m.remotes))
+	for _, rs := range m.remotes {
+		remotes = append(remotes, *rs)
+	}
+	sort.Slice(remotes, func(i, j int) bool { return remotes[i].URL < remotes[j].URL })
+	return remotes
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = m.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics to w in the Prometheus text format
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	queues := m.Queues()
+	remotes := m.Remotes()
+
+	bw := bufio.NewWriter(w)
+	queueMetric := func(name, typ, help string, value func(qs QueueStatus) float64) {
+		fmt.Fprintf(bw, "# HELP relay_%s %s\n# TYPE relay_%s %s\n", name, help, name, typ)
+		for _, qs := range queues {
+			fmt.Fprintf(bw, "relay_%s{queue=\"%s\"} %v\n", name, escapeLabel(qs.QueueID), value(qs))
+		}
+	}
+	remoteMetric := func(name, typ, help string, value func(rs RemoteStatus) float64) {
+		fmt.Fprintf(bw, "# HELP relay_%s %s\n# TYPE relay_%s %s\n", name, help, name, typ)
+		for _, rs := range remotes {
+			fmt.Fprintf(bw, "relay_%s{url=\"%s\"} %v\n", name, escapeLabel(rs.URL), value(rs))
+		}
+	}
+
+	queueMetric("running", "gauge", "Whether this node is relaying the queue.",
+		func(qs QueueStatus) float64 { return boolToFloat(qs.Running) })
+	queueMetric("local_sequence", "gauge", "Last sequence sent on the local chain.",
+		func(qs QueueStatus) float64 { return float64(qs.LocalSeq) })
+	queueMetric("remote_sequence", "gauge", "Last sequence received by the remote chain.",
+		func(qs QueueStatus) float64 { return float64(qs.RemoteSeq) })
+	queueMetric("packets_pending", "gauge", "Packets sent on the local chain but not relayed yet.",
+		func(qs QueueStatus) float64 { return float64(qs.Pending) })
+	queueMetric("txs_in_flight", "gauge", "Txs accepted by the remote mempool and not executed yet.",
+		func(qs QueueStatus) float64 { return float64(qs.InFlight) })
+	queueMetric("nonce", "gauge", "Nonce of the relayer account on the remote chain.",
+		func(qs QueueStatus) float64 { return float64(qs.Nonce) })
+	queueMetric("batches_sent_total", "counter", "Batches of packets delivered to the remote chain.",
+		func(qs QueueStatus) float64 { return float64(qs.BatchesSent) })
+	queueMetric("batches_failed_total", "counter", "Batches of packets the remote chain refused or did not get.",
+		func(qs QueueStatus) float64 { return float64(qs.BatchesFailed) })
+	queueMetric("proofs_rejected_total", "counter", "Local blocks whose precommits failed verification.",
+		func(qs QueueStatus) float64 { return float64(qs.ProofsRejected) })
+	queueMetric("last_error_timestamp_seconds", "gauge", "Unix time of the last failed batch, 0 if none.",
+		func(qs QueueStatus) float64 { return unixSeconds(qs.LastErrorTime) })
+
+	remoteMetric("remote_calls_total", "counter", "Calls made to the remote URL.",
+		func(rs RemoteStatus) float64 { return float64(rs.Calls) })
+	remoteMetric("remote_failures_total", "counter", "Calls to the remote URL that failed.",
+		func(rs RemoteStatus) float64 { return float64(rs.Failures) })
+	remoteMetric("remote_latency_seconds", "gauge", "Round-trip time of the last call to the remote URL.",
+		func(rs RemoteStatus) float64 { return rs.LastLatency.Seconds() })
+	remoteMetric("remote_latency_seconds_total", "counter", "Round-trip time of all calls to the remote URL.",
+		func(rs RemoteStatus) float64 { return rs.TotalLatency.Seconds() })
+
+	return bw.Flush()
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,525 @@
+package relay
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcbchain/bclib/rlp"
+	rpcclient "github.com/bcbchain/bclib/rpc/lib/client"
+	rpctypes "github.com/bcbchain/bclib/rpc/lib/types"
+	abci "github.com/bcbchain/bclib/tendermint/abci/types"
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	dbm "github.com/bcbchain/bclib/tendermint/tmlibs/db"
+	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
+	tx3 "github.com/bcbchain/bclib/tx/v3"
+	"github.com/bcbchain/tendermint/lite"
+	"github.com/bcbchain/tendermint/types"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// fault is what a mock chain does to the next calls of a method
+type fault int
+
+const (
+	faultError fault = iota // answer with an RPC error
+	faultDrop               // handle the call, then close the connection without an answer
+)
+
+const (
+	mockOrgID    = "orgMock"
+	mockIBCAddr  = "remoteIBCAddress"
+	mockMethodID = "1a2b3c4d"
+	mockIBCGas   = 500
+)
+
+// mockChain is an in-process chain serving, over JSON-RPC, the methods and
+// state keys the relay reads: block, block_results, abci_info, abci_query and
+// broadcast_tx_sync/commit. A local chain emits packets in signed blocks, a
+// remote chain executes the batches the relay sends to it, block by block on
+// commit.
+type mockChain struct {
+	t       *testing.T
+	chainID string
+
+	mtx     sync.Mutex
+	state   map[string][]byte // abci_query path => value
+	height  int64
+	blocks  map[int64]*ResultBlock
+	results map[int64]*ResultBlockResults
+	commits map[int64]lite.Commit
+	keys    lite.ValKeys
+	vals    *types.ValidatorSet
+	faults  map[string][]fault // method, or abci_query path => faults of the next calls
+	calls   map[string]int     // method, or abci_query path => calls served
+
+	// remote chain
+	seqs      map[string]uint64   // queueID => last sequence executed
+	nonces    map[string]uint64   // address => last nonce executed
+	mempool   []mockTx            // txs checked and not committed
+	executed  map[string][]uint64 // queueID => sequences in execution order
+	failedTxs int
+	reorder   bool // commit the mempool in reverse order
+
+	server *httptest.Server
+}
+
+// mockAccount is the account of a remote chain, as far as the relay reads it
+type mockAccount struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// mockTx is a batch received by a remote chain
+type mockTx struct {
+	address string
+	nonce   uint64
+	proofs  []*PktsProof
+}
+
+func newMockChain(t *testing.T, chainID string) *mockChain {
+	c := &mockChain{
+		t:        t,
+		chainID:  chainID,
+		state:    make(map[string][]byte),
+		blocks:   make(map[int64]*ResultBlock),
+		results:  make(map[int64]*ResultBlockResults),
+		commits:  make(map[int64]lite.Commit),
+		faults:   make(map[string][]fault),
+		calls:    make(map[string]int),
+		seqs:     make(map[string]uint64),
+		nonces:   make(map[string]uint64),
+		executed: make(map[string][]uint64),
+	}
+	c.keys = lite.GenValKeys(4)
+	c.vals = c.keys.ToValidators(20, 10)
+
+	c.setJSON(keyOfChainID(), chainID)
+	c.setJSON(keyOfGenesisOrgID(), mockOrgID)
+	c.setJSON(keyOfVersionList("ibc", mockOrgID), ContractVersionList{
+		Name:             "ibc",
+		ContractAddrList: []string{mockIBCAddr},
+		EffectHeights:    []int64{1},
+	})
+	c.setJSON(keyOfContract(mockIBCAddr), Contract{
+		Address: mockIBCAddr,
+		Name:    "ibc",
+		OrgID:   mockOrgID,
+		Methods: []Method{{MethodID: mockMethodID, Gas: mockIBCGas, ProtoType: "Input([]ibc.PktsProof,[]ibc.Header)"}},
+	})
+	c.grow(1)
+
+	c.server = httptest.NewServer(c)
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+// URL is the address of the chain's RPC
+func (c *mockChain) URL() string {
+	return c.server.URL
+}
+
+// validators loads the validator sets of the chain, for the proof verifier
+func (c *mockChain) validators(height int64) (*types.ValidatorSet, error) {
+	return c.vals, nil
+}
+
+// inject makes the next n calls of method, or of abci_query on path, fail with f
+func (c *mockChain) inject(method string, f fault, n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i := 0; i < n; i++ {
+		c.faults[method] = append(c.faults[method], f)
+	}
+}
+
+func (c *mockChain) nextFault(method string) (fault, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	fs := c.faults[method]
+	if len(fs) == 0 {
+		return 0, false
+	}
+	c.faults[method] = fs[1:]
+	return fs[0], true
+}
+
+func (c *mockChain) setJSON(path string, v interface{}) {
+	value, err := jsoniter.Marshal(v)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.state[path] = value
+}
+
+// grow adds n signed blocks without packets
+func (c *mockChain) grow(n int) {
+	for i := 0; i < n; i++ {
+		c.addBlock(nil)
+	}
+}
+
+// emit adds a block with packets on queueID, numbered from the last sequence
+// of the queue, and the two blocks after it the proof of the packets needs
+func (c *mockChain) emit(queueID string, n int) []Packet {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	fromChainID, toChainID := splitQueueID(queueID)
+	height := c.height + 1
+	var packets []Packet
+	var tags []cmn.KVPair
+	for i := 0; i < n; i++ {
+		c.seqs[queueID]++
+		seq := c.seqs[queueID]
+		p := Packet{
+			FromChainID:  fromChainID,
+			ToChainID:    toChainID,
+			QueueID:      queueID,
+			Seq:          seq,
+			OrgID:        mockOrgID,
+			ContractName: "transfer",
+			IbcHash:      cmn.HexBytes(fmt.Sprintf("%s/%d", queueID, seq)),
+			Type:         "notify",
+			State:        State{Status: statusNoAckWanted},
+		}
+		packets = append(packets, p)
+
+		packetBytes, _ := jsoniter.Marshal(p)
+		receiptBytes, _ := jsoniter.Marshal(Receipt{Name: "ibc::packet", Bytes: packetBytes})
+		tags = append(tags, cmn.KVPair{Key: []byte("/ibc::packet/" + queueID), Value: receiptBytes})
+		c.setJSON(keyOfMessageIndex(queueID, seq), MessageIndex{Height: height, IbcHash: p.IbcHash})
+	}
+	c.setJSON(keyOfSequence(queueID), c.seqs[queueID])
+
+	c.addBlockLocked([]*abci.ResponseDeliverTx{{Code: abci.CodeTypeOK, Tags: tags}})
+	c.addBlockLocked(nil)
+	c.addBlockLocked(nil)
+	return packets
+}
+
+func (c *mockChain) addBlock(deliverTxs []*abci.ResponseDeliverTx) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.addBlockLocked(deliverTxs)
+}
+
+func (c *mockChain) addBlockLocked(deliverTxs []*abci.ResponseDeliverTx) {
+	c.height++
+	h := c.height
+	commit := c.keys.GenCommit(c.chainID, h, nil, c.vals, nil, nil, nil, 0, len(c.keys))
+	c.signParts(commit.Commit)
+	c.commits[h] = commit
+
+	lastCommit := &types.Commit{}
+	if prev, ok := c.commits[h-1]; ok {
+		lastCommit = prev.Commit
+	}
+	c.blocks[h] = &ResultBlock{
+		BlockMeta: &types.BlockMeta{BlockID: commit.Commit.BlockID, Header: commit.Header},
+		Block:     &types.Block{Header: commit.Header, Data: &types.Data{}, LastCommit: lastCommit},
+	}
+	c.results[h] = &ResultBlockResults{Height: h, Results: &ABCIResponses{DeliverTx: deliverTxs}}
+}
+
+// signParts gives the commit the part set header a real block has and signs
+// the precommits again: an empty one does not survive the trip through the
+// RPC, and the signatures would no longer match.
+func (c *mockChain) signParts(commit *types.Commit) {
+	commit.BlockID.PartsHeader = types.PartSetHeader{Total: 1, Hash: commit.BlockID.Hash}
+	for _, key := range c.keys {
+		addr := key.PubKey().Address(crypto.GetChainId())
+		for _, vote := range commit.Precommits {
+			if vote != nil && vote.ValidatorAddress == addr {
+				vote.BlockID = commit.BlockID
+				vote.Signature = key.Sign(vote.SignBytes(c.chainID))
+			}
+		}
+	}
+}
+
+// useNonce makes address spend its next nonce on a tx of its own
+func (c *mockChain) useNonce(address string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.nonces[address]++
+	c.setJSON(keyOfAccountNonce(address), mockAccount{Nonce: c.nonces[address]})
+}
+
+// commit executes the mempool in a new block. A batch executes if its nonce
+// follows the last one of its sender and its packets follow the sequence of
+// their queue; a batch that fails still spends its nonce, like a failed tx.
+func (c *mockChain) commit() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	txs := c.mempool
+	c.mempool = nil
+	if c.reorder {
+		for i, j := 0, len(txs)-1; i < j; i, j = i+1, j-1 {
+			txs[i], txs[j] = txs[j], txs[i]
+		}
+	}
+
+	height := c.height + 1
+	for _, tx := range txs {
+		if tx.nonce != c.nonces[tx.address]+1 {
+			c.failedTxs++
+			continue
+		}
+		c.nonces[tx.address] = tx.nonce
+		c.setJSON(keyOfAccountNonce(tx.address), mockAccount{Nonce: tx.nonce})
+
+		if !c.inOrder(tx.proofs) {
+			c.failedTxs++
+			continue
+		}
+		for _, proof := range tx.proofs {
+			for _, p := range proof.Packets {
+				c.seqs[p.QueueID] = p.Seq
+				c.executed[p.QueueID] = append(c.executed[p.QueueID], p.Seq)
+				c.setJSON(keyOfSequence(p.QueueID), p.Seq)
+				c.setJSON(keyOfMessageIndex(p.QueueID, p.Seq), MessageIndex{Height: height, IbcHash: p.IbcHash})
+			}
+		}
+	}
+	c.addBlockLocked(nil)
+}
+
+func (c *mockChain) inOrder(proofs []*PktsProof) bool {
+	seqs := make(map[string]uint64)
+	for _, proof := range proofs {
+		for _, p := range proof.Packets {
+			last, ok := seqs[p.QueueID]
+			if !ok {
+				last = c.seqs[p.QueueID]
+			}
+			if p.Seq != last+1 {
+				return false
+			}
+			seqs[p.QueueID] = p.Seq
+		}
+	}
+	return true
+}
+
+// executedSeqs returns the sequences of queueID the chain executed, in order
+func (c *mockChain) executedSeqs(queueID string) []uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]uint64(nil), c.executed[queueID]...)
+}
+
+// checkTx takes a batch into the mempool if its nonce follows the ones of
+// its sender, counting the mempool
+func (c *mockChain) checkTx(tx []byte) *ResultBroadcastTx {
+	tx3.Init(c.chainID)
+	transaction, pubKey, err := tx3.TxParse(string(tx))
+	if err != nil {
+		return &ResultBroadcastTx{Code: 500, Log: err.Error()}
+	}
+	msg := transaction.Messages[0]
+	if msg.MethodID != mustMethodID() || !strings.HasSuffix(string(msg.Contract), mockIBCAddr) {
+		return &ResultBroadcastTx{Code: 500, Log: "not a call of the ibc contract"}
+	}
+	var proofs []*PktsProof
+	if err := rlp.DecodeBytes(msg.Items[0], &proofs); err != nil {
+		return &ResultBroadcastTx{Code: 500, Log: err.Error()}
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	address := pubKey.Address(c.chainID)
+	expected := c.nonces[address] + 1
+	for _, pending := range c.mempool {
+		if pending.address == address {
+			expected++
+		}
+	}
+	if transaction.Nonce != expected {
+		return &ResultBroadcastTx{Code: 500, Log: fmt.Sprintf("invalid nonce %d, expected %d", transaction.Nonce, expected)}
+	}
+
+	c.mempool = append(c.mempool, mockTx{address: address, nonce: transaction.Nonce, proofs: proofs})
+	hash := crypto.Ripemd160(tx)
+	return &ResultBroadcastTx{Code: 200, Hash: hash}
+}
+
+func mustMethodID() uint32 {
+	id, _ := strconv.ParseUint(mockMethodID, 16, 32)
+	return uint32(id)
+}
+
+// ServeHTTP answers the JSON-RPC calls of the relay
+func (c *mockChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req rpctypes.RPCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var params map[string]json.RawMessage
+	_ = json.Unmarshal(req.Params, &params)
+
+	faultKey := req.Method
+	if req.Method == "abci_query" {
+		var path string
+		_ = json.Unmarshal(params["path"], &path)
+		faultKey = path
+	}
+	c.mtx.Lock()
+	c.calls[faultKey]++
+	c.mtx.Unlock()
+	f, faulty := c.nextFault(faultKey)
+	if faulty && f == faultError {
+		c.reply(w, rpctypes.NewRPCErrorResponse(req.ID, -32603, "injected fault", faultKey))
+		return
+	}
+
+	result, err := c.call(req.Method, params)
+	if faulty && f == faultDrop {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				_ = conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		c.reply(w, rpctypes.NewRPCErrorResponse(req.ID, -32603, err.Error(), ""))
+		return
+	}
+	c.reply(w, rpctypes.NewRPCSuccessResponse(rpcclient.CDC, req.ID, result))
+}
+
+func (c *mockChain) reply(w http.ResponseWriter, resp rpctypes.RPCResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (c *mockChain) call(method string, params map[string]json.RawMessage) (interface{}, error) {
+	switch method {
+	case "abci_query":
+		var path string
+		_ = json.Unmarshal(params["path"], &path)
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return &ResultABCIQuery{Response: abci.ResponseQuery{Key: []byte(path), Value: c.state[path]}}, nil
+
+	case "abci_info":
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		return &ResultABCIInfo{Response: abci.ResponseInfo{LastBlockHeight: c.height}}, nil
+
+	case "block", "block_results":
+		var height int64
+		if err := json.Unmarshal(params["height"], &height); err != nil {
+			return nil, err
+		}
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if height > c.height {
+			return nil, errors.New("height must be less than or equal to the current blockchain height")
+		}
+		if method == "block" {
+			return c.blocks[height], nil
+		}
+		return c.results[height], nil
+
+	case "broadcast_tx_sync", "broadcast_tx_commit":
+		var tx []byte
+		if err := json.Unmarshal(params["tx"], &tx); err != nil {
+			return nil, err
+		}
+		result := c.checkTx(tx)
+		if method == "broadcast_tx_sync" || result.Code != 200 {
+			if method == "broadcast_tx_commit" {
+				return &ResultBroadcastTxCommit{CheckTx: abci.ResponseCheckTx{Code: result.Code, Log: result.Log}}, nil
+			}
+			return result, nil
+		}
+		c.commit()
+		return &ResultBroadcastTxCommit{
+			CheckTx:   abci.ResponseCheckTx{Code: 200},
+			DeliverTx: abci.ResponseDeliverTx{Code: 200},
+			Hash:      result.Hash,
+			Height:    c.height,
+		}, nil
+	}
+	return nil, errors.New("method not found: " + method)
+}
+
+// relayHarness relays the queue of a local mock chain to a remote one with
+// a QueueRelay driven by the test, one carry at a time
+type relayHarness struct {
+	local, remote *mockChain
+	qr            *QueueRelay
+	queueID       string
+	clock         time.Time // of the url pool
+}
+
+func newRelayHarness(t *testing.T) *relayHarness {
+	crypto.SetChainId("local")
+	local := newMockChain(t, "local")
+	remote := newMockChain(t, "remote")
+
+	privKey := crypto.GenPrivKeyEd25519()
+	queueID := makeQueueID("local", "remote")
+	verifier := newProofVerifier()
+	verifier.setLoader(local.validators)
+	urls := []string{remote.URL()}
+
+	qr := &QueueRelay{
+		LocalURL:     local.URL(),
+		RemoteURLs:   urls,
+		QueueID:      queueID,
+		genesisOrgID: mockOrgID,
+		signalChan:   make(chan bool, 100),
+		done:         make(chan struct{}),
+		pool:         newURLPool(urls),
+		currentNode: &CurrentNodeInfo{
+			Address:    privKey.PubKey().Address("remote"),
+			HexPrivKey: "0x" + hex.EncodeToString(privKey[:]),
+		},
+		checkpoints: newCheckpointStoreWithDB(dbm.NewMemDB()),
+		metrics:     NewMetrics(),
+		packets:     newPacketTracker(),
+		verifier:    verifier,
+		logger:      log.NewNopLogger(),
+	}
+	h := &relayHarness{local: local, remote: remote, qr: qr, queueID: queueID, clock: time.Now()}
+	qr.pool.now = func() time.Time { return h.clock }
+	return h
+}
+
+// carry runs carries the way Start does while running, until one returns
+// false, and returns how many batches were sent
+func (h *relayHarness) carry() int {
+	// a url that failed in the last round is tried again, as after a poll
+	h.clock = h.clock.Add(maxBackoff)
+
+	sent := 0
+	lastResult := false
+	for i := 0; i < 100; i++ {
+		lastResult = h.qr.carry(lastResult)
+		if !lastResult {
+			return sent
+		}
+		sent++
+	}
+	panic("carry does not stop")
+}
@@ -0,0 +1,346 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+)
+
+// PacketStage is where a packet is on its way from the local to the remote
+// chain and, if an ack is wanted, back
+type PacketStage string
+
+const (
+	StageEmitted  PacketStage = "emitted"  // found in a local block, not delivered yet
+	StageRelayed  PacketStage = "relayed"  // a tx carrying it was committed on the remote chain
+	StageExecuted PacketStage = "executed" // the remote chain indexed it under its sequence
+	StageAcked    PacketStage = "acked"    // the remote chain's answer reached the local chain
+	StageFailed   PacketStage = "failed"   // it can not be delivered, see Log
+)
+
+const (
+	// a packet that is neither executed nor failed is relayed again after
+	packetTimeout = 2 * time.Minute
+
+	// a packet relayed that many times without being executed has failed
+	maxRelayAttempts = 5
+
+	// number of packets whose status is kept, the oldest finished go first
+	maxTrackedPackets = 10000
+
+	// sequences of the reverse queue looked at per carry when waiting for acks
+	maxAckScan = 50
+
+	// packets looked up in the remote message index per carry
+	maxFollowScan = 50
+
+	// packet state status of packets that do not want an ack
+	statusNoAckWanted = "NoAckWanted"
+)
+
+// PacketStatus is the lifecycle of one packet, found by its IbcHash
+type PacketStatus struct {
+	IbcHash      cmn.HexBytes `json:"ibc_hash"`
+	QueueID      string       `json:"queue_id"`
+	Seq          uint64       `json:"seq"`
+	Height       int64        `json:"height"` // local height the packet was emitted at
+	Stage        PacketStage  `json:"stage"`
+	AckWanted    bool         `json:"ack_wanted"`
+	Attempts     int          `json:"attempts"` // txs that carried the packet
+	TxHash       cmn.HexBytes `json:"tx_hash"`  // last tx that carried the packet
+	RemoteHeight int64        `json:"remote_height"`
+	AckSeq       uint64       `json:"ack_seq"` // sequence of the answer in the reverse queue, 0 if none yet
+	Log          string       `json:"log"`
+	EmittedAt    time.Time    `json:"emitted_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+}
+
+// Final reports whether the packet will not change stage any more
+func (ps PacketStatus) Final() bool {
+	switch ps.Stage {
+	case StageAcked, StageFailed:
+		return true
+	case StageExecuted:
+		return !ps.AckWanted
+	}
+	return false
+}
+
+// packetTracker follows the packets of every queue
+type packetTracker struct {
+	mtx       sync.Mutex
+	packets   map[string]*PacketStatus // hex ibcHash => status
+	order     []string                 // ibcHashes, oldest first
+	ackCursor map[string]uint64        // reverse queueID => last sequence scanned on the remote chain
+	now       func() time.Time
+}
+
+func newPacketTracker() *packetTracker {
+	return &packetTracker{
+		packets:   make(map[string]*PacketStatus),
+		ackCursor: make(map[string]uint64),
+		now:       time.Now,
+	}
+}
+
+func packetKey(ibcHash []byte) string {
+	return strings.ToUpper(cmn.HexBytes(ibcHash).String())
+}
+
+// get returns the status of the packet with ibcHash
+func (pt *packetTracker) get(ibcHash []byte) (PacketStatus, bool) {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	ps, ok := pt.packets[packetKey(ibcHash)]
+	if !ok {
+		return PacketStatus{}, false
+	}
+	return *ps, true
+}
+
+// emitted starts following p, found at local height. A packet collected again
+// to be relayed once more keeps its status.
+func (pt *packetTracker) emitted(height int64, p Packet) {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	key := packetKey(p.IbcHash)
+	if _, ok := pt.packets[key]; ok {
+		return
+	}
+	now := pt.now()
+	pt.packets[key] = &PacketStatus{
+		IbcHash:   p.IbcHash,
+		QueueID:   p.QueueID,
+		Seq:       p.Seq,
+		Height:    height,
+		Stage:     StageEmitted,
+		AckWanted: p.State.Status != statusNoAckWanted,
+		EmittedAt: now,
+		UpdatedAt: now,
+	}
+	pt.order = append(pt.order, key)
+	pt.evict()
+}
+
+// relayed records that tx txHash carried packets, err is nil if the remote
+// chain committed it
+func (pt *packetTracker) relayed(packets []Packet, txHash []byte, err error) {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	now := pt.now()
+	for _, p := range packets {
+		ps, ok := pt.packets[packetKey(p.IbcHash)]
+		if !ok || ps.Final() {
+			continue
+		}
+		ps.Attempts++
+		if err != nil {
+			ps.Log = err.Error()
+			continue
+		}
+		ps.TxHash = txHash
+		ps.Log = ""
+		if ps.Stage == StageEmitted {
+			ps.Stage = StageRelayed
+			ps.UpdatedAt = now
+		}
+	}
+}
+
+// update changes the status of the packet with ibcHash
+func (pt *packetTracker) update(ibcHash []byte, fn func(ps *PacketStatus)) {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	if ps, ok := pt.packets[packetKey(ibcHash)]; ok {
+		fn(ps)
+		ps.UpdatedAt = pt.now()
+	}
+}
+
+// pending returns the packets of queueID that are not final, oldest first
+func (pt *packetTracker) pending(queueID string) []PacketStatus {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	var pss []PacketStatus
+	for _, key := range pt.order {
+		ps := pt.packets[key]
+		if ps.QueueID == queueID && !ps.Final() {
+			pss = append(pss, *ps)
+		}
+	}
+	return pss
+}
+
+// reset forgets every packet
+func (pt *packetTracker) reset() {
+	pt.mtx.Lock()
+	defer pt.mtx.Unlock()
+
+	pt.packets = make(map[string]*PacketStatus)
+	pt.order = nil
+	pt.ackCursor = make(map[string]uint64)
+}
+
+// evict drops the oldest packets, finished ones first, above maxTrackedPackets
+func (pt *packetTracker) evict() {
+	for len(pt.order) > maxTrackedPackets {
+		i := 0
+		for j, key := range pt.order {
+			if pt.packets[key].Final() {
+				i = j
+				break
+			}
+		}
+		delete(pt.packets, pt.order[i])
+		pt.order = append(pt.order[:i], pt.order[i+1:]...)
+	}
+}
+
+// followPackets moves the packets of the queue along their lifecycle, by
+// looking them up in the message index of both chains. At most maxFollowScan
+// packets are looked up on the remote chain per carry, the next carry goes on
+// after the last one. A packet stuck before execution for packetTimeout makes
+// the queue relay from the remote sequence again.
+func (qr *QueueRelay) followPackets() {
+	var waitAck, unexecuted []PacketStatus
+	for _, ps := range qr.packets.pending(qr.QueueID) {
+		if ps.Stage != StageExecuted {
+			unexecuted = append(unexecuted, ps)
+		} else if ps.AckSeq == 0 {
+			waitAck = append(waitAck, ps)
+		} else {
+			qr.checkAckReceived(ps)
+		}
+	}
+
+	// start after the last packet looked up, and wrap around
+	first := 0
+	for first < len(unexecuted) && unexecuted[first].Seq <= qr.followSeq {
+		first++
+	}
+	unexecuted = append(unexecuted[first:], unexecuted[:first]...)
+	if len(unexecuted) > maxFollowScan {
+		unexecuted = unexecuted[:maxFollowScan]
+	}
+
+	now := qr.packets.now()
+	for _, ps := range unexecuted {
+		msgIndex, err := qr.queryRemoteMsgIndex(qr.QueueID, ps.Seq)
+		if err != nil {
+			// the url backs off, the next carry goes on from this packet
+			return
+		}
+		qr.followSeq = ps.Seq
+		if msgIndex.Height > 0 {
+			qr.packets.update(ps.IbcHash, func(ps *PacketStatus) {
+				if bytes.Equal(msgIndex.IbcHash, ps.IbcHash) {
+					ps.Stage = StageExecuted
+					ps.RemoteHeight = msgIndex.Height
+				} else {
+					ps.Stage = StageFailed
+					ps.Log = "remote chain has packet " + msgIndex.IbcHash.String() + " at this sequence"
+				}
+			})
+			continue
+		}
+
+		if now.Sub(ps.UpdatedAt) < packetTimeout {
+			continue
+		}
+		if ps.Attempts >= maxRelayAttempts {
+			qr.packets.update(ps.IbcHash, func(ps *PacketStatus) {
+				ps.Stage = StageFailed
+				if ps.Log == "" {
+					ps.Log = "not executed by the remote chain"
+				}
+			})
+			qr.logger.Error("RELAY", "packet failed", ps.IbcHash, "queueID", qr.QueueID, "seq", ps.Seq)
+			continue
+		}
+		qr.logger.Warn("RELAY", "packet stuck, relay again", ps.IbcHash, "queueID", qr.QueueID,
+			"seq", ps.Seq, "stage", ps.Stage)
+		// restart its timeout, and relay again from the remote sequence
+		qr.packets.update(ps.IbcHash, func(ps *PacketStatus) {})
+		qr.resync = true
+	}
+
+	if len(waitAck) > 0 {
+		qr.scanAcks()
+	}
+}
+
+// scanAcks reads the message index of the reverse queue on the remote chain,
+// where the answers to our packets are emitted with the same IbcHash
+func (qr *QueueRelay) scanAcks() {
+	fromChainID, toChainID := splitQueueID(qr.QueueID)
+	reverseID := makeQueueID(toChainID, fromChainID)
+
+	qr.packets.mtx.Lock()
+	cursor, ok := qr.packets.ackCursor[reverseID]
+	qr.packets.mtx.Unlock()
+	if !ok {
+		// answers the local chain already has are not ours
+		seq, err := querySequence(qr.LocalURL, reverseID)
+		if err != nil {
+			return
+		}
+		cursor = seq
+	}
+
+	for i := 0; i < maxAckScan; i++ {
+		msgIndex, err := qr.queryRemoteMsgIndex(reverseID, cursor+1)
+		if err != nil || msgIndex.Height == 0 {
+			break
+		}
+		cursor++
+		ackSeq := cursor
+		qr.packets.update(msgIndex.IbcHash, func(ps *PacketStatus) {
+			if ps.Stage == StageExecuted && ps.AckSeq == 0 {
+				ps.AckSeq = ackSeq
+			}
+		})
+	}
+
+	qr.packets.mtx.Lock()
+	qr.packets.ackCursor[reverseID] = cursor
+	qr.packets.mtx.Unlock()
+}
+
+// queryRemoteMsgIndex reads the message index of queueID at seq on the
+// remote url of the round, a failure makes the url back off
+func (qr *QueueRelay) queryRemoteMsgIndex(queueID string, seq uint64) (*MessageIndex, error) {
+	start := time.Now()
+	msgIndex, err := queryIBCMsgIndex(qr.currentRoundURL, queueID, seq)
+	qr.observeCall(qr.currentRoundURL, start, err)
+	return msgIndex, err
+}
+
+// checkAckReceived marks ps acked once the local chain indexed its answer
+func (qr *QueueRelay) checkAckReceived(ps PacketStatus) {
+	fromChainID, toChainID := splitQueueID(qr.QueueID)
+	reverseID := makeQueueID(toChainID, fromChainID)
+
+	msgIndex, err := queryIBCMsgIndex(qr.LocalURL, reverseID, ps.AckSeq)
+	if err != nil || msgIndex.Height == 0 {
+		return
+	}
+	qr.packets.update(ps.IbcHash, func(ps *PacketStatus) { ps.Stage = StageAcked })
+}
+
+// Packet returns the lifecycle of the packet with ibcHash
+func (rc *RelayController) Packet(ibcHash []byte) (PacketStatus, error) {
+	ps, ok := rc.packets.get(ibcHash)
+	if !ok {
+		return ps, errors.New("packet " + packetKey(ibcHash) + " is not followed by this node")
+	}
+	return ps, nil
+}
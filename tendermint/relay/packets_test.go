@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPacketTracker(t *testing.T) {
+	pt := newPacketTracker()
+	noAck := Packet{QueueID: "a->b", Seq: 1, IbcHash: []byte{0x01}, State: State{Status: statusNoAckWanted}}
+	withAck := Packet{QueueID: "a->b", Seq: 2, IbcHash: []byte{0x02}, State: State{Status: "NoAck"}}
+
+	pt.emitted(10, noAck)
+	pt.emitted(11, withAck)
+	if pss := pt.pending("a->b"); len(pss) != 2 || pss[0].Seq != 1 || pss[1].Seq != 2 {
+		t.Fatalf("pending = %+v", pss)
+	}
+
+	pt.relayed([]Packet{noAck, withAck}, nil, errors.New("timeout"))
+	ps, _ := pt.get(noAck.IbcHash)
+	if ps.Stage != StageEmitted || ps.Attempts != 1 || ps.Log != "timeout" {
+		t.Fatalf("after a failed relay: %+v", ps)
+	}
+
+	pt.relayed([]Packet{noAck, withAck}, []byte{0xAA}, nil)
+	ps, _ = pt.get(withAck.IbcHash)
+	if ps.Stage != StageRelayed || ps.Attempts != 2 || ps.Log != "" || !ps.AckWanted {
+		t.Fatalf("after relay: %+v", ps)
+	}
+
+	// collecting a packet again keeps its status
+	pt.emitted(11, withAck)
+	if ps, _ = pt.get(withAck.IbcHash); ps.Stage != StageRelayed {
+		t.Fatalf("emitted again: %+v", ps)
+	}
+
+	// executed is final only without ack
+	pt.update(noAck.IbcHash, func(ps *PacketStatus) { ps.Stage = StageExecuted })
+	pt.update(withAck.IbcHash, func(ps *PacketStatus) { ps.Stage = StageExecuted })
+	if pss := pt.pending("a->b"); len(pss) != 1 || pss[0].Seq != 2 {
+		t.Fatalf("pending = %+v", pss)
+	}
+
+	if _, ok := pt.get([]byte{0x03}); ok {
+		t.Fatal("unknown packet found")
+	}
+}
+
+func TestPacketTrackerEvict(t *testing.T) {
+	pt := newPacketTracker()
+	for i := 0; i < maxTrackedPackets; i++ {
+		pt.emitted(1, Packet{QueueID: "a->b", Seq: uint64(i), IbcHash: []byte{byte(i >> 8), byte(i)}})
+	}
+	finished := []byte{0x00, 0x05}
+	pt.update(finished, func(ps *PacketStatus) { ps.Stage = StageFailed })
+
+	pt.emitted(2, Packet{QueueID: "a->b", Seq: maxTrackedPackets, IbcHash: []byte{0xFF, 0xFF, 0xFF}})
+	if _, ok := pt.get(finished); ok {
+		t.Fatal("finished packet kept over an unfinished one")
+	}
+	if _, ok := pt.get([]byte{0x00, 0x00}); !ok {
+		t.Fatal("unfinished packet evicted")
+	}
+
+	pt.emitted(2, Packet{QueueID: "a->b", Seq: maxTrackedPackets + 1, IbcHash: []byte{0xFF, 0xFF, 0xFE}})
+	if _, ok := pt.get([]byte{0x00, 0x00}); ok {
+		t.Fatal("oldest packet kept")
+	}
+}
@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"errors"
+	"time"
+
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// batches sent with broadcast_tx_sync and not yet executed by the remote
+	// chain, each with the nonce following the previous one
+	maxInFlight = 4
+
+	// a batch not executed after inflightTimeout is taken as lost, and it and
+	// the batches after it are sent again
+	inflightTimeout = time.Minute
+
+	// limits of one batch, in serialized bytes of the proofs and headers and
+	// in gas the remote ibc method is estimated to burn for its packets. A
+	// batch always holds at least one block.
+	maxBatchBytes       = 1 << 20
+	maxBatchGas   int64 = 1000000
+)
+
+var (
+	errInflightTimeout = errors.New("tx not executed by the remote chain in time")
+	errInflightResync  = errors.New("tx dropped, a packet is stuck before it")
+)
+
+// inflightTx is a batch accepted by the remote mempool whose execution is not
+// confirmed yet
+type inflightTx struct {
+	nonce    uint64
+	firstSeq uint64 // first and last sequence of the packets it carries
+	lastSeq  uint64
+	height   int64 // last local height of the batch
+	txHash   cmn.HexBytes
+	packets  []Packet
+	sentAt   time.Time
+}
+
+// batchCost returns the size and the estimated gas a block's proof adds to a batch
+func (qr *QueueRelay) batchCost(pktsProof *PktsProof, header *Header_2_2) (int, int64) {
+	proofBytes, _ := jsoniter.Marshal(pktsProof)
+	headerBytes, _ := jsoniter.Marshal(header)
+
+	var gas int64
+	if qr.remoteIBC != nil {
+		gas = qr.remoteIBC.Gas * int64(len(pktsProof.Packets))
+	}
+	return len(proofBytes) + len(headerBytes), gas
+}
+
+// confirmInflight retires the batches the remote chain executed, as told by
+// its sequence, and checkpoints them. If the oldest batch timed out, or a
+// stuck packet asks for a resync, the pipeline is rewound to the remote
+// sequence and nonce.
+func (qr *QueueRelay) confirmInflight() error {
+	if len(qr.inflight) == 0 {
+		return nil
+	}
+
+	seq, err := qr.getRemoteSequence()
+	if err != nil {
+		return err
+	}
+
+	for len(qr.inflight) > 0 && seq >= qr.inflight[0].lastSeq {
+		b := qr.inflight[0]
+		qr.inflight = qr.inflight[1:]
+		qr.confirmedSeq = b.lastSeq
+		qr.saveCheckpoint(b)
+		qr.packets.relayed(b.packets, b.txHash, nil)
+	}
+
+	if len(qr.inflight) == 0 {
+		return nil
+	}
+	// the batches after a stuck packet can not execute before it, under
+	// continuous load they would keep the window full and never time out
+	rewind := errInflightResync
+	if !qr.resync {
+		if time.Since(qr.inflight[0].sentAt) <= inflightTimeout {
+			return nil
+		}
+		rewind = errInflightTimeout
+	}
+	qr.logger.Warn("RELAY", "rewind txs in flight", qr.inflight[0].txHash, "reason", rewind,
+		"queueID", qr.QueueID, "remoteSeq", seq, "nonce", qr.inflight[0].nonce)
+	qr.metrics.batchFailed(qr.QueueID, rewind)
+	for _, b := range qr.inflight {
+		qr.packets.relayed(b.packets, nil, rewind)
+	}
+	qr.inflight = nil
+	qr.remoteSeq = seq
+	qr.confirmedSeq = seq
+	// query the nonce again, the remote chain may have used some of ours
+	qr.currentNode.Nonce = 0
+	return nil
+}
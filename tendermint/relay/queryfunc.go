@@ -23,9 +23,16 @@ func queryCurrentHeight(url string) (int64, error) {
 	return result.Response.LastBlockHeight, nil
 }
 
+// queryIBCMsgIndex returns an empty index, with height 0, for a sequence not
+// indexed yet
 func queryIBCMsgIndex(url, queueID string, seq uint64) (*MessageIndex, error) {
 	msgIndex := new(MessageIndex)
-	err := abciQueryAndParse(url, keyOfMessageIndex(queueID, seq), msgIndex)
+	resultQuery, err := abciQuery(url, keyOfMessageIndex(queueID, seq))
+	if err != nil || len(resultQuery.Response.GetValue()) == 0 {
+		return msgIndex, err
+	}
+
+	err = jsoniter.Unmarshal(resultQuery.Response.GetValue(), msgIndex)
 	return msgIndex, err
 }
 
@@ -1,15 +1,15 @@
 package relay
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/binary"
+	"context"
 	"errors"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/bcbchain/bclib/tendermint/abci/types"
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
 	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type QueueRelay struct {
@@ -20,13 +20,28 @@ type QueueRelay struct {
 	genesisOrgID string
 
 	signalChan chan bool
+	cancel     context.CancelFunc // stops the queue
+	done       chan struct{}      // closed when Start returns
 
 	remoteSeq       uint64
 	currentRoundURL string
+	pool            *urlPool
 	remoteIBC       *IBCContractInfo
 
 	currentNode *CurrentNodeInfo
 
+	checkpoints   *checkpointStore
+	reconciled    bool   // remoteSeq and nonce were resumed from the checkpoint
+	scannedHeight int64  // last local height collected into the pending batch
+	confirmedSeq  uint64 // last sequence known to be received by the remote chain
+	followSeq     uint64 // last sequence followPackets looked up on the remote chain
+
+	metrics  *Metrics
+	packets  *packetTracker
+	verifier *proofVerifier
+	resync   bool // query the remote sequence again before the next batch
+	inflight []*inflightTx
+
 	logger log.Logger
 }
 
@@ -39,22 +54,31 @@ type CurrentNodeInfo struct {
 type IBCContractInfo struct {
 	Address  string
 	MethodID uint32
+	Gas      int64
 }
 
-// Start start relay goroutine for queueID
-func (qr *QueueRelay) Start() {
+// Start start relay goroutine for queueID, it returns when ctx is done and
+// the batch being carried, if any, is sent
+func (qr *QueueRelay) Start(ctx context.Context) {
+	defer close(qr.done)
+	defer qr.metrics.setRunning(qr.QueueID, false)
 
 	running := false
 	lastResult := false
 
-	for {
+	for ctx.Err() == nil {
 		if running {
 			lastResult = qr.carry(lastResult)
 			if lastResult == false {
 				running = false
 			}
 		} else {
-			running = <-qr.signalChan
+			select {
+			case running = <-qr.signalChan:
+			case <-ctx.Done():
+				return
+			}
+			qr.metrics.setRunning(qr.QueueID, running)
 			lastResult = false
 		}
 
@@ -62,6 +86,7 @@ func (qr *QueueRelay) Start() {
 		for {
 			select {
 			case running = <-qr.signalChan:
+				qr.metrics.setRunning(qr.QueueID, running)
 				continue
 			default:
 			}
@@ -71,22 +96,25 @@ func (qr *QueueRelay) Start() {
 	}
 }
 
-func (qr *QueueRelay) calcRoundURL() {
-	r := make([]byte, 4)
-	_, e := rand.Read(r)
-	if e != nil {
-		panic(e)
+// observeCall records the outcome of a call to a remote URL that began at start
+func (qr *QueueRelay) observeCall(url string, start time.Time, err error) {
+	d := time.Since(start)
+	qr.metrics.observeCall(url, d, err)
+	if err != nil {
+		qr.pool.failure(url)
+	} else {
+		qr.pool.success(url, d)
 	}
-
-	buf := bytes.NewBuffer(r)
-	var random uint8
-	_ = binary.Read(buf, binary.BigEndian, &random)
-
-	qr.currentRoundURL = qr.RemoteURLs[int(random)%len(qr.RemoteURLs)]
 }
 
 func (qr *QueueRelay) carry(lastResult bool) bool {
-	qr.calcRoundURL()
+	url, ok := qr.pool.pick(nil)
+	if !ok {
+		qr.logger.Debug("RELAY", "no healthy remote url", qr.QueueID)
+		return false
+	}
+	qr.currentRoundURL = url
+	defer qr.publish()
 
 	if qr.remoteIBC == nil {
 		if err := qr.getTargetIBCContract(); err != nil {
@@ -95,6 +123,25 @@ func (qr *QueueRelay) carry(lastResult bool) bool {
 		}
 	}
 
+	if !qr.reconciled {
+		if err := qr.reconcile(); err != nil {
+			qr.logger.Debug("RELAY", "reconcile checkpoint failed", err)
+			return false
+		}
+		// remoteSeq is set, there is no need to query it again
+		lastResult = true
+	}
+
+	qr.followPackets()
+	if err := qr.confirmInflight(); err != nil {
+		qr.logger.Debug("RELAY", "confirm txs in flight failed", err)
+		return false
+	}
+	if qr.resync {
+		qr.resync = false
+		lastResult = false
+	}
+
 	if qr.currentNode.Nonce == 0 {
 		if err := qr.getNonce(); err != nil {
 			qr.logger.Debug("RELAY", "get nonce failed", err)
@@ -102,6 +149,12 @@ func (qr *QueueRelay) carry(lastResult bool) bool {
 		}
 	}
 
+	if len(qr.inflight) >= maxInFlight {
+		// wait for the remote chain to execute some
+		qr.logger.Debug("RELAY", "pipeline full")
+		return false
+	}
+
 	pktsProof, headers := qr.collectIBCPktsProof(lastResult)
 	if len(pktsProof) == 0 {
 		// 此时说明还没有发生跨链交易
@@ -109,47 +162,109 @@ func (qr *QueueRelay) carry(lastResult bool) bool {
 		return false
 	}
 
-	if err := qr.sendIBCPackets(pktsProof, headers); err != nil {
+	var packets []Packet
+	for _, pktProof := range pktsProof {
+		packets = append(packets, pktProof.Packets...)
+	}
+	firstSeq := qr.remoteSeq - uint64(len(packets)) + 1
+
+	txHash, err := qr.sendIBCPackets(pktsProof, headers)
+	if err != nil {
 		// 不能发送跨链交易到目标链
 		qr.logger.Debug("RELAY", "send tx failed", err)
+		qr.metrics.batchFailed(qr.QueueID, err)
+		qr.packets.relayed(packets, nil, err)
+		// the batch is built again from its first packet
+		qr.remoteSeq = firstSeq - 1
 		return false
 	}
+	qr.metrics.batchSent(qr.QueueID)
+	qr.inflight = append(qr.inflight, &inflightTx{
+		nonce:    qr.currentNode.Nonce,
+		firstSeq: firstSeq,
+		lastSeq:  qr.remoteSeq,
+		height:   qr.scannedHeight,
+		txHash:   txHash,
+		packets:  packets,
+		sentAt:   time.Now(),
+	})
 	return true
 }
 
-func (qr *QueueRelay) sendIBCPackets(pktsProofs []*PktsProof, headers []*Header_2_2) error {
+// publish updates the metrics with the current state of the queue
+func (qr *QueueRelay) publish() {
+	localSeq, err := querySequence(qr.LocalURL, qr.QueueID)
+	if err != nil {
+		qr.logger.Debug("RELAY", "query local sequence err", err)
+	}
+
+	qr.metrics.update(qr.QueueID, func(qs *QueueStatus) {
+		qs.CurrentRoundURL = qr.currentRoundURL
+		qs.RemoteIBC = ""
+		if qr.remoteIBC != nil {
+			qs.RemoteIBC = qr.remoteIBC.Address
+		}
+		qs.Nonce = qr.currentNode.Nonce
+		if err == nil {
+			qs.LocalSeq = localSeq
+		}
+		qs.RemoteSeq = qr.confirmedSeq
+		qs.InFlight = len(qr.inflight)
+		qs.Checkpoint = qr.Checkpoint()
+	})
+}
+
+// sendIBCPackets hands a batch to the remote mempool and returns the hash of its tx
+func (qr *QueueRelay) sendIBCPackets(pktsProofs []*PktsProof, headers []*Header_2_2) (cmn.HexBytes, error) {
 	tx, err := qr.packTx(pktsProofs, headers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	result := new(ResultBroadcastTxCommit)
-	client := getClient(qr.currentRoundURL)
-	if _, err = client.Call(
-		"broadcast_tx_commit",
-		map[string]interface{}{"tx": []byte(tx)},
-		result); err != nil {
+	// the tx carries its nonce, so sending it again to another url after a
+	// timeout can not execute it twice
+	tried := make(map[string]bool)
+	for {
+		url := qr.currentRoundURL
+		tried[url] = true
+
+		result := new(ResultBroadcastTx)
+		client := getClient(url)
+		start := time.Now()
+		_, err = client.Call(
+			"broadcast_tx_sync",
+			map[string]interface{}{"tx": []byte(tx)},
+			result)
+		qr.observeCall(url, start, err)
+		if err == nil {
+			return result.Hash, qr.processTxResult(result)
+		}
 
-		return err
+		next, ok := qr.pool.pick(tried)
+		if !ok {
+			return nil, err
+		}
+		qr.logger.Debug("RELAY", "send tx failed, retry on another url", err, "url", next)
+		qr.currentRoundURL = next
 	}
-	return qr.processTxResult(result)
 }
 
-func (qr *QueueRelay) processTxResult(result *ResultBroadcastTxCommit) error {
+// processTxResult takes the CheckTx result of a batch, the remote chain
+// executes it later
+func (qr *QueueRelay) processTxResult(result *ResultBroadcastTx) error {
 
-	if result.CheckTx.Code == 200 && result.DeliverTx.Code == 200 {
+	if result.Code == 200 {
 		qr.currentNode.Nonce++
 		return nil
 	}
 
 	qr.remoteIBC = nil
-	qr.currentNode.Nonce = 0
-
-	if result.CheckTx.Code != 200 {
-		return errors.New(result.CheckTx.Log)
-	} else {
-		return errors.New(result.DeliverTx.Log)
+	// the txs in flight hold the nonces before ours, without them ask the chain
+	if len(qr.inflight) == 0 {
+		qr.currentNode.Nonce = 0
 	}
+
+	return errors.New(result.Log)
 }
 
 func (qr *QueueRelay) packTx(pktsProofs []*PktsProof, headers []*Header_2_2) (string, error) {
@@ -172,14 +287,18 @@ func (qr *QueueRelay) packTx(pktsProofs []*PktsProof, headers []*Header_2_2) (st
 }
 
 func (qr *QueueRelay) collectIBCPktsProof(lastResult bool) (pktsProofs []*PktsProof, headers []*Header_2_2) {
-	if lastResult == false {
+	// with txs in flight the remote sequence is behind ours
+	if lastResult == false && len(qr.inflight) == 0 {
 		if seq, err := qr.getRemoteSequence(); err != nil {
 			return
 		} else {
 			qr.remoteSeq = seq
+			qr.confirmedSeq = seq
 		}
 	}
 
+	var size int
+	var gas int64
 	for {
 		height := qr.getHeight(qr.remoteSeq + 1)
 		if height == 0 {
@@ -190,13 +309,22 @@ func (qr *QueueRelay) collectIBCPktsProof(lastResult bool) (pktsProofs []*PktsPr
 		if pktsProof == nil {
 			return
 		}
+		proofSize, proofGas := qr.batchCost(pktsProof, header)
+		if len(pktsProofs) > 0 && (size+proofSize > maxBatchBytes || gas+proofGas > maxBatchGas) {
+			// the block goes in the next batch
+			return
+		}
+		size += proofSize
+		gas += proofGas
+
+		for _, packet := range pktsProof.Packets {
+			qr.packets.emitted(height, packet)
+		}
 		qr.remoteSeq += ibcMsgCount
+		qr.scannedHeight = height
 
 		pktsProofs = append(pktsProofs, pktsProof)
 		headers = append(headers, header)
-		if len(pktsProofs) == 10 {
-			return
-		}
 	}
 }
 
@@ -230,6 +358,18 @@ func (qr *QueueRelay) getProof(headerHeight int64) (pktsProof *PktsProof, header
 		return
 	}
 
+	if block1.BlockMeta == nil || block2.Block == nil {
+		err = errors.New("incomplete block from local RPC")
+		return
+	}
+	localChainID, _ := splitQueueID(qr.QueueID)
+	if err = qr.verifier.verify(localChainID, block1.BlockMeta.Header, block2.Block.LastCommit); err != nil {
+		// the local RPC gave a header the validators did not sign
+		qr.logger.Error("RELAY", "local block failed verification, refuse to relay", err, "height", headerHeight)
+		qr.metrics.proofRejected(qr.QueueID, err)
+		return
+	}
+
 	headerBytes, err := jsoniter.Marshal(block1.BlockMeta.Header)
 	if err != nil {
 		return
@@ -255,7 +395,9 @@ func (qr *QueueRelay) getProof(headerHeight int64) (pktsProof *PktsProof, header
 }
 
 func (qr *QueueRelay) getRemoteSequence() (sequence uint64, err error) {
+	start := time.Now()
 	sequence, err = querySequence(qr.currentRoundURL, qr.QueueID)
+	qr.observeCall(qr.currentRoundURL, start, err)
 	return
 }
 
@@ -317,7 +459,9 @@ func (qr *QueueRelay) getPacketsFromTx(deliverTx *types.ResponseDeliverTx) []Pac
 }
 
 func (qr *QueueRelay) getTargetIBCContract() error {
+	start := time.Now()
 	contract, err := queryIBCContract(qr.currentRoundURL, qr.genesisOrgID)
+	qr.observeCall(qr.currentRoundURL, start, err)
 	if err != nil {
 		qr.logger.Debug("RELAY", "query ibc err", err)
 		return err
@@ -336,16 +480,89 @@ func (qr *QueueRelay) getTargetIBCContract() error {
 	qr.remoteIBC = &IBCContractInfo{
 		Address:  contract.Address,
 		MethodID: uint32(methodID),
+		Gas:      item.Gas,
 	}
 	return nil
 }
 
 func (qr *QueueRelay) getNonce() error {
+	start := time.Now()
 	nonce, err := queryAccountNonce(qr.currentRoundURL, qr.currentNode.Address)
+	qr.observeCall(qr.currentRoundURL, start, err)
 	if err != nil {
 		return err
 	}
 
+	// a remote node that has not seen our last tx yet reports an old nonce
+	if cp, ok, _ := qr.checkpoints.load(qr.QueueID); ok && cp.Nonce > nonce {
+		nonce = cp.Nonce
+	}
+
 	qr.currentNode.Nonce = nonce
 	return nil
 }
+
+// reconcile resumes the queue from its checkpoint after a restart. The remote
+// sequence is authoritative once the remote node has seen the last delivered
+// tx, i.e. once its account nonce reached the checkpoint. Otherwise the node
+// lags behind and trusting it would deliver the same packets twice.
+func (qr *QueueRelay) reconcile() error {
+	seq, err := qr.getRemoteSequence()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	nonce, err := queryAccountNonce(qr.currentRoundURL, qr.currentNode.Address)
+	qr.observeCall(qr.currentRoundURL, start, err)
+	if err != nil {
+		return err
+	}
+
+	cp, ok, err := qr.checkpoints.load(qr.QueueID)
+	if err != nil {
+		// resume as a fresh queue, from the remote sequence
+		qr.logger.Error("RELAY", "drop checkpoint", err)
+		qr.checkpoints.drop(qr.QueueID)
+	}
+	if ok {
+		if nonce < cp.Nonce {
+			qr.logger.Warn("RELAY", "remote node is behind checkpoint", qr.currentRoundURL,
+				"remoteSeq", seq, "remoteNonce", nonce, "checkpoint", cp)
+			nonce = cp.Nonce
+			if seq < cp.Sequence {
+				seq = cp.Sequence
+			}
+		} else if seq != cp.Sequence {
+			// another relayer delivered packets, or the remote chain was reset
+			qr.logger.Info("RELAY", "remote sequence differs from checkpoint", qr.QueueID,
+				"remoteSeq", seq, "checkpoint", cp.Sequence)
+		}
+	}
+
+	qr.remoteSeq = seq
+	qr.confirmedSeq = seq
+	qr.currentNode.Nonce = nonce
+	qr.reconciled = true
+	return nil
+}
+
+// saveCheckpoint records the batch b, executed by the remote chain
+func (qr *QueueRelay) saveCheckpoint(b *inflightTx) {
+	cp, _, _ := qr.checkpoints.load(qr.QueueID)
+	cp.Sequence = b.lastSeq
+	if b.height > cp.Height {
+		cp.Height = b.height
+	}
+	cp.Nonce = b.nonce
+	cp.TxHash = b.txHash
+	cp.Time = time.Now()
+	if err := qr.checkpoints.save(cp); err != nil {
+		qr.logger.Error("RELAY", "save checkpoint failed", err, "queueID", qr.QueueID)
+	}
+}
+
+// Checkpoint returns the saved progress of the queue
+func (qr *QueueRelay) Checkpoint() Checkpoint {
+	cp, _, _ := qr.checkpoints.load(qr.QueueID)
+	return cp
+}
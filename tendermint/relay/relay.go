@@ -1,7 +1,9 @@
 package relay
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	types2 "github.com/bcbchain/bclib/tendermint/abci/types"
@@ -9,59 +11,116 @@ import (
 	cfg "github.com/bcbchain/tendermint/config"
 	"github.com/bcbchain/tendermint/proxy"
 	"github.com/bcbchain/tendermint/types"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
 	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
 	"strings"
 	"sync"
+	"time"
 )
 
+// RelayController runs a QueueRelay for every queue of the local chain. It is
+// a Service: queues only run between Start and Stop, and Stop waits for the
+// batches being sent.
 type RelayController struct {
+	cmn.BaseService
+
 	LocalURL         string   // local url
 	ChainIDToURLs    sync.Map // chainID => openURLs
 	ChainIDToAddrVer sync.Map // chainID => addressVersion
 
+	mtx                 sync.Mutex
 	QueueIDToQueueRelay map[string]*QueueRelay // queueID => QueueRelay
+	ctx                 context.Context        // done when the controller stops
+	cancel              context.CancelFunc
+	health              Health
 
 	currentNodeAddress string
+	checkpoints        *checkpointStore
+	metrics            *Metrics
+	packets            *packetTracker
+	verifier           *proofVerifier
 	config             *cfg.Config
+	privValidator      *pvm.FilePV
 	abciClient         proxy.AppConns
 	logger             log.Logger
 }
 
-var (
-	gRelay   *RelayController
-	initOnce sync.Once
-)
+// New returns the relay controller of a node, whose app connections conns
+// answer the queries of the local state. The queues of the local chain are
+// looked up when it starts.
+func New(config *cfg.Config, logger log.Logger, conns proxy.AppConns) *RelayController {
+	temp := strings.Split(config.RPC.ListenAddress, ":")
+	localURL := "http://127.0.0.1:" + temp[len(temp)-1]
+	pv := pvm.LoadFilePV(config.PrivValidatorFile())
+
+	rc := &RelayController{
+		LocalURL:           localURL,
+		currentNodeAddress: getNodeAddress(pv, "", "", 0),
+		checkpoints:        newCheckpointStore(config),
+		metrics:            NewMetrics(),
+		packets:            newPacketTracker(),
+		verifier:           newProofVerifier(),
+		config:             config,
+		privValidator:      pv,
+		abciClient:         conns,
+		logger:             logger,
+	}
+	rc.BaseService = *cmn.NewBaseService(logger, "RelayController", rc)
+	return rc
+}
 
-// Init init relay controller
-func Init(config *cfg.Config, logger log.Logger, conns proxy.AppConns) *RelayController {
-	initOnce.Do(func() {
-		temp := strings.Split(config.RPC.ListenAddress, ":")
-		localURL := "http://127.0.0.1:" + temp[len(temp)-1]
-
-		gRelay = &RelayController{
-			LocalURL:           localURL,
-			currentNodeAddress: getNodeAddress(config, "", "", 0),
-			config:             config,
-			abciClient:         conns,
-			logger:             logger,
+// OnStart implements cmn.Service
+func (rc *RelayController) OnStart() error {
+	if !rc.Health().Ready {
+		err := rc.init()
+		if err != nil {
+			rc.logger.Error("RELAY init failed, retry", "err", err)
 		}
+		rc.setHealth(err)
+	}
 
-		gRelay.init()
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
 
-		logger.Info("RELAY init", "gRelay", gRelay)
-	})
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	if !rc.health.Ready {
+		go rc.retryInit(rc.Quit())
+	}
+	return nil
+}
 
-	return gRelay
+// OnStop implements cmn.Service. It stops every queue and waits for them, a
+// queue sending a batch returns once the remote node answered.
+func (rc *RelayController) OnStop() {
+	rc.mtx.Lock()
+	rc.cancel()
+	queues := rc.QueueIDToQueueRelay
+	rc.QueueIDToQueueRelay = make(map[string]*QueueRelay)
+	rc.mtx.Unlock()
+
+	for _, qr := range queues {
+		<-qr.done
+	}
+	// another controller of the same data dir may open it now
+	if rc.checkpoints != nil {
+		rc.checkpoints.close()
+	}
 }
 
-// GetRelayController get instance
-func GetRelayController() *RelayController {
-	return gRelay
+// OnReset implements cmn.Service. The queues are created again on the next
+// start, resuming from their checkpoints.
+func (rc *RelayController) OnReset() error {
+	rc.packets.reset()
+	if rc.config != nil {
+		rc.checkpoints = newCheckpointStore(rc.config)
+	}
+	return nil
 }
 
 // SetNewHeader determines whether to start or stop a relay by header
 func (rc *RelayController) SetNewHeader(header *types.Header) {
-	if header.Relayer == nil {
+	if header.Relayer == nil || !rc.IsRunning() {
 		return
 	}
 
@@ -75,168 +134,282 @@ func (rc *RelayController) SetNewHeader(header *types.Header) {
 	}
 }
 
+// Checkpoints returns the saved progress of every queue, sorted by queueID
+func (rc *RelayController) Checkpoints() []Checkpoint {
+	return rc.checkpoints.all()
+}
+
+// Metrics returns the metrics of all queues
+func (rc *RelayController) Metrics() *Metrics {
+	return rc.metrics
+}
+
+// SetValidatorsLoader sets where the validator sets that local blocks are
+// verified against come from. No block is relayed until it is set.
+func (rc *RelayController) SetValidatorsLoader(loader ValidatorsLoader) {
+	rc.verifier.setLoader(loader)
+}
+
 // UpdateOpenURL update relay controller.ChainIDToURLS, overwrite existing data.
 func (rc *RelayController) UpdateOpenURL(chainID string, urls []string, addrVer int32) {
 	rc.logger.Info("RELAY UpdateOpenURL", "chainID", chainID, "urls", urls)
 	localChainID := rc.getLocalChainID()
 
-	if localChainID == chainID {
+	if len(localChainID) == 0 || localChainID == chainID {
 		return
 	}
 
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
 	if _, ok := rc.ChainIDToURLs.Load(chainID); ok {
 		queueID := makeQueueID(localChainID, chainID)
 		qr, ok := rc.QueueIDToQueueRelay[queueID]
-		if !ok {
-			return
+		if ok {
+			qr.RemoteURLs = urls
+			qr.pool.setURLs(urls)
 		}
-		qr.RemoteURLs = urls
-		rc.QueueIDToQueueRelay[queueID] = qr
-
 	} else {
-		rc.addQueueRelay(localChainID, chainID, urls, addrVer)
+		rc.ChainIDToAddrVer.Store(chainID, AddressVersion(addrVer))
+		if rc.IsRunning() {
+			rc.addQueueRelay(localChainID, chainID, urls, addrVer)
+		}
 	}
 
 	rc.ChainIDToURLs.Store(chainID, urls)
 }
 
+// RemoveQueue stops relaying to chainID, whose side chain is no longer
+// active. It does not wait for the queue to return.
+func (rc *RelayController) RemoveQueue(chainID string) {
+	rc.logger.Info("RELAY RemoveQueue", "chainID", chainID)
+	queueID := makeQueueID(rc.getLocalChainID(), chainID)
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	rc.ChainIDToURLs.Delete(chainID)
+	rc.ChainIDToAddrVer.Delete(chainID)
+	if qr, ok := rc.QueueIDToQueueRelay[queueID]; ok {
+		delete(rc.QueueIDToQueueRelay, queueID)
+		qr.cancel()
+	}
+}
+
 // relayControler initialize
-func (rc *RelayController) init() {
+func (rc *RelayController) init() error {
 	localChainID := rc.getLocalChainID()
 	if len(localChainID) == 0 {
-		panic("can not get local chainID.")
+		return errors.New("can not get local chainID")
 	}
 
 	if strings.Contains(localChainID, "[") {
 		// side chain
-		rc.getMainChainURLs(getMainChaidID(localChainID))
-	} else {
-		// main chain
-		rc.getSideChainOpenURL()
+		return rc.getMainChainURLs(getMainChaidID(localChainID))
+	}
+	// main chain
+	return rc.getSideChainOpenURL()
+}
+
+// retryInit runs init again until it succeeds or quit is closed. Until then
+// the relay is degraded: it knows no queue, or not all of them.
+func (rc *RelayController) retryInit(quit <-chan struct{}) {
+	interval := initRetryInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-quit:
+			return
+		}
+
+		err := rc.init()
+		rc.setHealth(err)
+		if err == nil {
+			rc.logger.Info("RELAY init succeeded", "failures", rc.Health().Failures)
+			return
+		}
+		rc.logger.Error("RELAY init failed", "err", err, "retry in", interval)
+
+		interval *= 2
+		if interval > maxInitRetryInterval {
+			interval = maxInitRetryInterval
+		}
 	}
 }
 
 func (rc *RelayController) addQueueRelay(localChainID, toChainID string, urls []string, addrVer int32) {
-	queueID := makeQueueID(localChainID, toChainID)
-	qr := QueueRelay{
+	qr := rc.newQueueRelay(makeQueueID(localChainID, toChainID), urls, addrVer)
+	rc.launch(qr)
+
+	rc.logger.Debug("RELAY addQueueRelay", "queueRelay", qr)
+}
+
+// launch runs qr until the controller stops or the queue is removed. It is
+// called with rc.mtx held.
+func (rc *RelayController) launch(qr *QueueRelay) {
+	if len(rc.QueueIDToQueueRelay) == 0 {
+		rc.QueueIDToQueueRelay = make(map[string]*QueueRelay)
+	}
+	rc.QueueIDToQueueRelay[qr.QueueID] = qr
+
+	var ctx context.Context
+	ctx, qr.cancel = context.WithCancel(rc.ctx)
+	go qr.Start(ctx)
+	qr.signalChan <- true
+}
+
+// newQueueRelay returns the relay of queueID, not started yet
+func (rc *RelayController) newQueueRelay(queueID string, urls []string, addrVer int32) *QueueRelay {
+	return &QueueRelay{
 		LocalURL:     rc.LocalURL,
 		RemoteURLs:   urls,
+		pool:         newURLPool(urls),
 		QueueID:      queueID,
-		genesisOrgID: gRelay.queryGenesisOrgID(),
+		genesisOrgID: rc.queryGenesisOrgID(),
 		signalChan:   make(chan bool, 100),
+		done:         make(chan struct{}),
 		currentNode:  rc.getCurrentNode(queueID, addrVer),
+		checkpoints:  rc.checkpoints,
+		metrics:      rc.metrics,
+		packets:      rc.packets,
+		verifier:     rc.verifier,
 		logger:       rc.logger,
 	}
-
-	go qr.Start()
-	qr.signalChan <- true
-
-	if len(rc.QueueIDToQueueRelay) == 0 {
-		rc.QueueIDToQueueRelay = make(map[string]*QueueRelay)
-	}
-	rc.QueueIDToQueueRelay[qr.QueueID] = &qr
-
-	rc.logger.Debug("RELAY addQueueRelay", "queueRelay", qr)
 }
 
-func (rc *RelayController) getMainChainURLs(mainChainID string) {
-	var urls []string
-	rc.abciQueryAndParse(keyOfOpenURLs(mainChainID), &urls)
+func (rc *RelayController) getMainChainURLs(mainChainID string) error {
+	urls, err := rc.getOepnURLs(mainChainID)
+	if err != nil {
+		return err
+	}
 	if len(urls) == 0 {
-		panic("can not get main chain URL")
+		return errors.New("can not get main chain URL")
 	}
 
 	rc.ChainIDToURLs.Store(mainChainID, urls)
+	return nil
 }
 
-func (rc *RelayController) getSideChainOpenURL() {
-	sideChainIDs := rc.getSideChainIDs()
+func (rc *RelayController) getSideChainOpenURL() error {
+	sideChainIDs, err := rc.getSideChainIDs()
+	if err != nil {
+		return err
+	}
 
 	for _, chainID := range sideChainIDs {
 
-		status, addrVer := rc.getSideChainStatusAndAddrVer(chainID)
+		status, addrVer, err := rc.getSideChainStatusAndAddrVer(chainID)
+		if err != nil {
+			return err
+		}
 		if status != "ready" && status != "clear" {
 			continue
 		}
 
-		urls := rc.getOepnURLs(chainID)
+		urls, err := rc.getOepnURLs(chainID)
+		if err != nil {
+			return err
+		}
+		if len(urls) == 0 {
+			// the queue is added when its urls are set
+			continue
+		}
 
 		rc.ChainIDToURLs.Store(chainID, urls)
 		rc.ChainIDToAddrVer.Store(chainID, addrVer)
 	}
+	return nil
 }
 
-func (rc *RelayController) getOepnURLs(chainID string) []string {
-	urls := new([]string)
-	rc.abciQueryAndParse(keyOfOpenURLs(chainID), urls)
-	return *urls
+func (rc *RelayController) getOepnURLs(chainID string) ([]string, error) {
+	var urls []string
+	err := rc.abciQueryAndParse(keyOfOpenURLs(chainID), &urls)
+	return urls, err
 }
 
-func (rc *RelayController) getSideChainIDs() []string {
-	sideChainIDs := new([]string)
-	rc.abciQueryAndParse(keyOfSideChainIDs(), &sideChainIDs)
-	return *sideChainIDs
+func (rc *RelayController) getSideChainIDs() ([]string, error) {
+	var sideChainIDs []string
+	err := rc.abciQueryAndParse(keyOfSideChainIDs(), &sideChainIDs)
+	return sideChainIDs, err
 }
 
-func (rc *RelayController) getSideChainStatusAndAddrVer(chainID string) (string, AddressVersion) {
+func (rc *RelayController) getSideChainStatusAndAddrVer(chainID string) (string, AddressVersion, error) {
 	ci := new(ChainInfo)
-	rc.abciQueryAndParse(keyOfChainInfo(chainID), ci)
-	return ci.Status, ci.AddrVersion
+	err := rc.abciQueryAndParse(keyOfChainInfo(chainID), ci)
+	return ci.Status, ci.AddrVersion, err
 }
 
-func (rc *RelayController) abciQueryAndParse(key string, data interface{}) {
-	r, err := rc.abciClient.Query().QuerySync(types2.RequestQuery{
-		Path: key,
-	})
+// abciQueryAndParse parses the value of key in the local state into data. A
+// missing key leaves data as it is.
+func (rc *RelayController) abciQueryAndParse(key string, data interface{}) error {
+	value, err := rc.queryLocal(key)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	if len(r.GetValue()) == 0 {
-		return
+	if len(value) == 0 {
+		return nil
 	}
 
-	_ = jsoniter.Unmarshal(r.GetValue(), data)
+	_ = jsoniter.Unmarshal(value, data)
+	return nil
+}
+
+// queryLocal queries the state of the local chain, through the app connection
+// inside a node or through the local RPC in a standalone relayer
+func (rc *RelayController) queryLocal(path string) ([]byte, error) {
+	if rc.abciClient == nil {
+		r, err := abciQuery(rc.LocalURL, path)
+		if err != nil {
+			return nil, err
+		}
+		return r.Response.Value, nil
+	}
+
+	r, err := rc.abciClient.Query().QuerySync(types2.RequestQuery{
+		Path: path,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.GetValue(), nil
 }
 
 func (rc *RelayController) startRelay() {
 	localChainID := rc.getLocalChainID()
+	if len(localChainID) == 0 {
+		return
+	}
 
-	if len(rc.QueueIDToQueueRelay) == 0 {
-		rc.QueueIDToQueueRelay = make(map[string]*QueueRelay)
-		rc.ChainIDToURLs.Range(func(chanID, urls interface{}) bool {
-			queueID := makeQueueID(localChainID, chanID.(string))
-
-			var addrVer AddressVersion
-			v, ok := rc.ChainIDToAddrVer.Load(chanID)
-			if ok {
-				addrVer = v.(AddressVersion)
-			}
-
-			qr := QueueRelay{
-				LocalURL:     rc.LocalURL,
-				RemoteURLs:   urls.([]string),
-				QueueID:      queueID,
-				genesisOrgID: gRelay.queryGenesisOrgID(),
-				signalChan:   make(chan bool, 100),
-				currentNode:  rc.getCurrentNode(queueID, int32(addrVer)),
-				logger:       rc.logger,
-			}
-			rc.QueueIDToQueueRelay[qr.QueueID] = &qr
-
-			go qr.Start()
-			qr.signalChan <- true
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	for _, v := range rc.QueueIDToQueueRelay {
+		v.signalChan <- true
+	}
+
+	// queues of chains known before the controller started
+	rc.ChainIDToURLs.Range(func(chanID, urls interface{}) bool {
+		queueID := makeQueueID(localChainID, chanID.(string))
+		if _, ok := rc.QueueIDToQueueRelay[queueID]; ok {
 			return true
-		})
+		}
 
-	} else {
-		for _, v := range rc.QueueIDToQueueRelay {
-			v.signalChan <- true
+		var addrVer AddressVersion
+		v, ok := rc.ChainIDToAddrVer.Load(chanID)
+		if ok {
+			addrVer = v.(AddressVersion)
 		}
-	}
+
+		rc.launch(rc.newQueueRelay(queueID, urls.([]string), int32(addrVer)))
+		return true
+	})
 }
 
 func (rc *RelayController) stopRelay() {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
 	for _, v := range rc.QueueIDToQueueRelay {
 		v.signalChan <- false
 	}
@@ -244,31 +417,29 @@ func (rc *RelayController) stopRelay() {
 
 func (rc *RelayController) getLocalChainID() string {
 	chainID := new(string)
-	r, e := rc.abciClient.Query().QuerySync(types2.RequestQuery{
-		Path: keyOfChainID(),
-	})
+	value, e := rc.queryLocal(keyOfChainID())
 	if e != nil {
 		rc.logger.Error("RELAY", "can not get local chainID", e)
 		return ""
 	}
 
-	e = jsoniter.Unmarshal(r.GetValue(), chainID)
+	e = jsoniter.Unmarshal(value, chainID)
 	if e != nil {
 		// 正式链 1.0 和 2.0 的格式不一样
-		return string(r.GetValue())
+		return string(value)
 	}
 	return *chainID
 }
 
 func (rc *RelayController) getCurrentNode(queueID string, addrVer int32) *CurrentNodeInfo {
-	privKey := getCurrentNodePrivKey(rc.config)
+	privKey := getCurrentNodePrivKey(rc.privValidator)
 	priKey := privKey.(crypto.PrivKeyEd25519)
 	p := "0x" + hex.EncodeToString(priKey[:])
 
 	fromChainID, toChainID := splitQueueID(queueID)
 
 	currentNodeInfo := &CurrentNodeInfo{
-		Address:    getNodeAddress(rc.config, fromChainID, toChainID, addrVer),
+		Address:    getNodeAddress(rc.privValidator, fromChainID, toChainID, addrVer),
 		HexPrivKey: p,
 		Nonce:      0,
 	}
@@ -276,16 +447,14 @@ func (rc *RelayController) getCurrentNode(queueID string, addrVer int32) *Curren
 }
 
 func (rc *RelayController) queryGenesisOrgID() string {
-	r, e := rc.abciClient.Query().QuerySync(types2.RequestQuery{
-		Path: keyOfGenesisOrgID(),
-	})
+	value, e := rc.queryLocal(keyOfGenesisOrgID())
 	if e != nil {
 		rc.logger.Error("RELAY", "can not get local genesis org ID", e)
 		return ""
 	}
 
 	genesisOrgID := new(string)
-	e = jsoniter.Unmarshal(r.GetValue(), genesisOrgID)
+	e = jsoniter.Unmarshal(value, genesisOrgID)
 	if e != nil {
 		return ""
 	}
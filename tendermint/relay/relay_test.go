@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
+	cfg "github.com/bcbchain/tendermint/config"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
+)
+
+func newTestController() *RelayController {
+	rc := &RelayController{
+		metrics: NewMetrics(),
+		packets: newPacketTracker(),
+		logger:  log.NewNopLogger(),
+	}
+	rc.BaseService = *cmn.NewBaseService(nil, "RelayController", rc)
+	return rc
+}
+
+func newTestQueueRelay(rc *RelayController, queueID string) *QueueRelay {
+	return &QueueRelay{
+		QueueID:    queueID,
+		pool:       newURLPool(nil),
+		signalChan: make(chan bool, 100),
+		done:       make(chan struct{}),
+		metrics:    rc.metrics,
+		packets:    rc.packets,
+		logger:     rc.logger,
+	}
+}
+
+func waitDone(t *testing.T, qr *QueueRelay) {
+	select {
+	case <-qr.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("queue %s still running", qr.QueueID)
+	}
+}
+
+func TestControllerLifecycle(t *testing.T) {
+	rc := newTestController()
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	qr1 := newTestQueueRelay(rc, "a->b")
+	qr2 := newTestQueueRelay(rc, "a->c")
+	rc.mtx.Lock()
+	rc.launch(qr1)
+	rc.launch(qr2)
+	rc.mtx.Unlock()
+
+	// a removed queue returns on its own
+	rc.mtx.Lock()
+	delete(rc.QueueIDToQueueRelay, qr2.QueueID)
+	rc.mtx.Unlock()
+	qr2.cancel()
+	waitDone(t, qr2)
+
+	if err := rc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, qr1)
+	if len(rc.QueueIDToQueueRelay) != 0 {
+		t.Errorf("queues left after stop: %v", rc.QueueIDToQueueRelay)
+	}
+	for _, qs := range rc.Metrics().Queues() {
+		if qs.Running {
+			t.Errorf("queue %s running after stop", qs.QueueID)
+		}
+	}
+
+	// stopping is not starting again
+	if err := rc.Start(); err == nil {
+		t.Fatal("started a stopped controller")
+	}
+	if err := rc.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	qr3 := newTestQueueRelay(rc, "a->b")
+	rc.mtx.Lock()
+	rc.launch(qr3)
+	rc.mtx.Unlock()
+	if err := rc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, qr3)
+}
+
+func TestControllerDegraded(t *testing.T) {
+	rc := newTestController()
+	// nothing listens there
+	rc.LocalURL = "http://127.0.0.1:1"
+
+	err := rc.init()
+	if err == nil {
+		t.Fatal("init without the local chain")
+	}
+	rc.setHealth(err)
+	rc.setHealth(rc.init())
+
+	h := rc.Health()
+	if h.Ready || h.Error == "" || h.Failures != 2 || h.LastAttempt.IsZero() {
+		t.Errorf("degraded health: %+v", h)
+	}
+
+	// a degraded controller starts, and stops its retries
+	if err := rc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.setHealth(nil)
+	if h := rc.Health(); !h.Ready || h.Error != "" {
+		t.Errorf("healthy: %+v", h)
+	}
+}
+
+func TestControllerPerNode(t *testing.T) {
+	crypto.SetChainId("local")
+	config := cfg.DefaultConfig().SetRoot(t.TempDir())
+	// nothing listens there, the controllers start degraded
+	config.RPC.ListenAddress = "tcp://127.0.0.1:1"
+	if err := cmn.EnsureDir(filepath.Dir(config.PrivValidatorFile()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	pvm.GenFilePV(config.PrivValidatorFile()).Save()
+
+	// a node started and stopped, then another one in the same process
+	rc1 := New(config, log.NewNopLogger(), nil)
+	if err := rc1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc1.checkpoints.save(Checkpoint{QueueID: "a->b", Sequence: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc1.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc2 := New(config, log.NewNopLogger(), nil)
+	if rc2 == rc1 {
+		t.Fatal("controller shared by the nodes")
+	}
+	if err := rc2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer rc2.Stop()
+	if cp, ok, err := rc2.checkpoints.load("a->b"); !ok || err != nil || cp.Sequence != 7 {
+		t.Fatalf("checkpoint %+v, %v", cp, err)
+	}
+}
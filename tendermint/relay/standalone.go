@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
+	cfg "github.com/bcbchain/tendermint/config"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
+)
+
+// NewStandalone returns a relay controller that runs apart from any node. It
+// reads the local chain through the RPC at localURL, signs with the key in
+// keyFile, which is generated if it does not exist, and keeps its checkpoints
+// under the data directory of config. Queues are added with AddQueue once it
+// is started, they do not follow the relayer elected in the block headers.
+func NewStandalone(config *cfg.Config, localURL, keyFile string, logger log.Logger) (*RelayController, error) {
+	rc := &RelayController{
+		LocalURL:            localURL,
+		QueueIDToQueueRelay: make(map[string]*QueueRelay),
+		metrics:             NewMetrics(),
+		packets:             newPacketTracker(),
+		verifier:            newProofVerifier(),
+		config:              config,
+		logger:              logger,
+	}
+	rc.BaseService = *cmn.NewBaseService(logger, "RelayController", rc)
+
+	localChainID := rc.getLocalChainID()
+	if len(localChainID) == 0 {
+		return nil, fmt.Errorf("can not get chainID from %s", localURL)
+	}
+	// the relayer key is a key of the local chain
+	crypto.SetChainId(localChainID)
+
+	rc.privValidator = pvm.LoadOrGenFilePV(keyFile)
+	rc.currentNodeAddress = getNodeAddress(rc.privValidator, "", "", 0)
+	rc.checkpoints = newCheckpointStore(config)
+	rc.setHealth(nil)
+
+	logger.Info("RELAY standalone", "chainID", localChainID, "relayer", rc.currentNodeAddress)
+	return rc, nil
+}
+
+// AddQueue starts relaying the queue from the local chain to toChainID. If
+// urls is empty, the open URLs the local chain records for toChainID are used.
+func (rc *RelayController) AddQueue(toChainID string, urls []string) error {
+	if !rc.IsRunning() {
+		return errors.New("relay controller is not running")
+	}
+
+	localChainID := rc.getLocalChainID()
+	if len(localChainID) == 0 {
+		return errors.New("can not get local chainID")
+	}
+	if toChainID == localChainID {
+		return fmt.Errorf("queue to the local chain %s", toChainID)
+	}
+
+	queueID := makeQueueID(localChainID, toChainID)
+	rc.mtx.Lock()
+	_, ok := rc.QueueIDToQueueRelay[queueID]
+	rc.mtx.Unlock()
+	if ok {
+		return fmt.Errorf("queue %s added twice", queueID)
+	}
+
+	if len(urls) == 0 {
+		if err := rc.abciQueryAndParse(keyOfOpenURLs(toChainID), &urls); err != nil {
+			return err
+		}
+		if len(urls) == 0 {
+			return fmt.Errorf("no open URL of %s on the local chain", toChainID)
+		}
+	}
+
+	// side chains record their address version on the main chain
+	var addrVer AddressVersion
+	if !strings.Contains(localChainID, "[") {
+		ci := new(ChainInfo)
+		if err := rc.abciQueryAndParse(keyOfChainInfo(toChainID), ci); err != nil {
+			return err
+		}
+		addrVer = ci.AddrVersion
+	}
+
+	qr := rc.newQueueRelay(queueID, urls, int32(addrVer))
+	rc.ChainIDToURLs.Store(toChainID, urls)
+	rc.ChainIDToAddrVer.Store(toChainID, addrVer)
+
+	rc.mtx.Lock()
+	rc.launch(qr)
+	rc.mtx.Unlock()
+
+	rc.logger.Info("RELAY AddQueue", "queueID", queueID, "urls", urls,
+		"relayer", qr.currentNode.Address)
+	return nil
+}
+
+// Poll wakes every queue up each interval until quit is closed. It takes the
+// place of the block headers that drive the relay inside a node.
+func (rc *RelayController) Poll(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rc.mtx.Lock()
+			for _, qr := range rc.QueueIDToQueueRelay {
+				select {
+				case qr.signalChan <- true:
+				default:
+					// the queue is busy, it is woken up again later
+				}
+			}
+			rc.mtx.Unlock()
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
+	"github.com/bcbchain/tendermint/lite"
+	"github.com/bcbchain/tendermint/lite/files"
+	"github.com/bcbchain/tendermint/types"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// trustRootFile keeps the trust root in the lite directory
+const trustRootFile = "trust_root.json"
+
+// TrustRoot is the block of the local chain a lite client certifies forward
+// from, given by its height and hash as known out of band. Blocks below it
+// can not be certified.
+type TrustRoot struct {
+	Height int64        `json:"height"`
+	Hash   cmn.HexBytes `json:"hash"`
+}
+
+// LiteValidatorsLoader returns the validator sets of the local chain as
+// certified by a lite client of source, forward from root. The root and the
+// commits it certifies are kept in liteDir; a zero root uses the root kept
+// there. A new root drops the commits certified before, from another root.
+func LiteValidatorsLoader(liteDir, chainID string, source lite.Provider, root TrustRoot) (ValidatorsLoader, error) {
+	if err := cmn.EnsureDir(liteDir, 0700); err != nil {
+		return nil, err
+	}
+	rootFile := filepath.Join(liteDir, trustRootFile)
+	stored, err := loadTrustRoot(rootFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc lite.FullCommit
+	if root.Height == 0 {
+		if stored == nil {
+			return nil, errors.New("no trust root in " + liteDir + ", give the height and hash of a block before the first packet to relay")
+		}
+		root = *stored
+		fc, err = files.NewProvider(liteDir).GetByHeight(root.Height)
+	} else {
+		fc, err = source.GetByHeight(root.Height)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = checkTrustRoot(fc, chainID, root); err != nil {
+		return nil, err
+	}
+
+	// commits kept without a root, or certified from another one, are not trusted
+	if stored == nil || stored.Height != root.Height || !bytes.Equal(stored.Hash, root.Hash) {
+		for _, dir := range []string{files.ValDir, files.CheckDir} {
+			if err = os.RemoveAll(filepath.Join(liteDir, dir)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	trust := lite.NewCacheProvider(
+		lite.NewMemStoreProvider(),
+		files.NewProvider(liteDir),
+	)
+	cert, err := lite.NewInquiringCertifier(chainID, fc, trust, source)
+	if err != nil {
+		return nil, err
+	}
+	if err = saveTrustRoot(rootFile, root); err != nil {
+		return nil, err
+	}
+
+	// the certifier is shared by all queues
+	var mtx sync.Mutex
+	return func(height int64) (*types.ValidatorSet, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if height < root.Height {
+			return nil, fmt.Errorf("height %d is below the trust root at %d", height, root.Height)
+		}
+		fc, err := source.GetByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		if fc.Height() != height {
+			return nil, fmt.Errorf("no commit of height %d", height)
+		}
+		if err := cert.Certify(fc.Commit); err != nil {
+			return nil, err
+		}
+		return cert.Validators(), nil
+	}, nil
+}
+
+// checkTrustRoot makes sure fc is the block of root, signed by its validators
+func checkTrustRoot(fc lite.FullCommit, chainID string, root TrustRoot) error {
+	if fc.Height() != root.Height {
+		return fmt.Errorf("no commit of height %d", root.Height)
+	}
+	if err := lite.NewStaticCertifier(chainID, fc.Validators).Certify(fc.Commit); err != nil {
+		return err
+	}
+	if hash := fc.Header.Hash(); !bytes.Equal(hash, root.Hash) {
+		return fmt.Errorf("block %d has hash %X, not the trusted %X", root.Height, hash, root.Hash)
+	}
+	return nil
+}
+
+// loadTrustRoot returns nil if there is no trust root in rootFile
+func loadTrustRoot(rootFile string) (*TrustRoot, error) {
+	data, err := ioutil.ReadFile(rootFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	root := new(TrustRoot)
+	if err = jsoniter.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func saveTrustRoot(rootFile string, root TrustRoot) error {
+	data, err := jsoniter.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return cmn.WriteFileAtomic(rootFile, data, 0600)
+}
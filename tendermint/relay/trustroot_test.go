@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bcbchain/tendermint/lite"
+	"github.com/bcbchain/tendermint/lite/files"
+)
+
+func TestLiteValidatorsLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay-lite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const chainID = "local"
+	keys := lite.GenValKeys(4)
+	vals := keys.ToValidators(20, 10)
+	source := lite.NewMemStoreProvider()
+	hashes := make(map[int64][]byte)
+	for h := int64(1); h <= 10; h++ {
+		fc := keys.GenFullCommit(chainID, h, nil, vals, []byte("params"), []byte("res"), nil, 0, len(keys))
+		if err = source.StoreCommit(fc); err != nil {
+			t.Fatal(err)
+		}
+		hashes[h] = fc.Header.Hash()
+	}
+
+	// commits kept by an older relayer, trusted from whatever --local said
+	other := lite.GenValKeys(4)
+	fake := other.GenFullCommit(chainID, 20, nil, other.ToValidators(20, 10), nil, nil, nil, 0, len(other))
+	if err = files.NewProvider(dir).StoreCommit(fake); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LiteValidatorsLoader(dir, chainID, source, TrustRoot{}); err == nil {
+		t.Fatal("loader without a trust root")
+	}
+	if _, err = LiteValidatorsLoader(dir, chainID, source, TrustRoot{Height: 5, Hash: hashes[4]}); err == nil {
+		t.Fatal("loader with the hash of another block")
+	}
+
+	loader, err := LiteValidatorsLoader(dir, chainID, source, TrustRoot{Height: 5, Hash: hashes[5]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc, err := files.NewProvider(dir).GetByHeight(20); err != nil || fc.Height() != 5 {
+		t.Fatalf("commits trusted without a root kept: height %d, %v", fc.Height(), err)
+	}
+	for _, h := range []int64{5, 10, 7} {
+		got, err := loader(h)
+		if err != nil {
+			t.Fatalf("height %d: %v", h, err)
+		}
+		if string(got.Hash()) != string(vals.Hash()) {
+			t.Fatalf("height %d: validators %X", h, got.Hash())
+		}
+	}
+	if _, err = loader(4); err == nil {
+		t.Fatal("height below the trust root certified")
+	}
+
+	// the next start uses the root kept in dir
+	loader, err = LiteValidatorsLoader(dir, chainID, source, TrustRoot{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loader(6); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loader(3); err == nil {
+		t.Fatal("height below the kept trust root certified")
+	}
+
+	// a lower root certifies the heights below the first one
+	loader, err = LiteValidatorsLoader(dir, chainID, source, TrustRoot{Height: 1, Hash: hashes[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loader(3); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -108,6 +108,13 @@ type ResultBroadcastTxCommit struct {
 	Height    int64                  `json:"height,omitempt"`
 }
 
+type ResultBroadcastTx struct {
+	Code uint32       `json:"code"`
+	Data cmn.HexBytes `json:"data"`
+	Log  string       `json:"log"`
+	Hash cmn.HexBytes `json:"hash"`
+}
+
 type MessageIndex struct {
 	Height  int64        `json:"height"`
 	IbcHash cmn.HexBytes `json:"ibcHash"`
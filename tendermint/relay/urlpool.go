@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// a failed URL is skipped for baseBackoff, doubled on every further failure
+	baseBackoff = time.Second
+
+	// after breakerThreshold failures in a row the circuit of a URL opens, and
+	// it is only tried again, once, every maxBackoff
+	breakerThreshold = 5
+	maxBackoff       = 2 * time.Minute
+
+	// weight of the last call in the moving average of the latency
+	latencyWeight = 0.3
+)
+
+// endpoint is the health of one remote URL
+type endpoint struct {
+	failures  int           // failures in a row
+	openUntil time.Time     // not tried before this time
+	latency   time.Duration // moving average, 0 until the first success
+}
+
+// urlPool chooses the remote URL of a queue. It prefers the fastest URL that
+// is not backing off after a failure.
+type urlPool struct {
+	mtx       sync.Mutex
+	urls      []string
+	endpoints map[string]*endpoint
+	now       func() time.Time
+}
+
+func newURLPool(urls []string) *urlPool {
+	pool := &urlPool{
+		endpoints: make(map[string]*endpoint),
+		now:       time.Now,
+	}
+	pool.setURLs(urls)
+	return pool
+}
+
+// setURLs replaces the URLs, keeping the health of the ones still there
+func (pool *urlPool) setURLs(urls []string) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	endpoints := make(map[string]*endpoint, len(urls))
+	for _, url := range urls {
+		if ep, ok := pool.endpoints[url]; ok {
+			endpoints[url] = ep
+		} else {
+			endpoints[url] = new(endpoint)
+		}
+	}
+	pool.urls = append([]string(nil), urls...)
+	pool.endpoints = endpoints
+}
+
+// pick returns the URL to use, skipping those in tried. URLs never called
+// come first so that every one gets measured, then the fastest. ok is false
+// if every URL is backing off or was tried.
+func (pool *urlPool) pick(tried map[string]bool) (url string, ok bool) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	now := pool.now()
+	var best *endpoint
+	for _, u := range pool.urls {
+		ep := pool.endpoints[u]
+		if tried[u] || now.Before(ep.openUntil) {
+			continue
+		}
+		if best == nil || ep.latency < best.latency {
+			best, url = ep, u
+		}
+	}
+	return url, best != nil
+}
+
+// success records a call to url that took d
+func (pool *urlPool) success(url string, d time.Duration) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	ep, ok := pool.endpoints[url]
+	if !ok {
+		return
+	}
+	ep.failures = 0
+	ep.openUntil = time.Time{}
+	if ep.latency == 0 {
+		ep.latency = d
+	} else {
+		ep.latency = time.Duration(latencyWeight*float64(d) + (1-latencyWeight)*float64(ep.latency))
+	}
+}
+
+// failure records a failed call to url and makes it back off
+func (pool *urlPool) failure(url string) {
+	pool.mtx.Lock()
+	defer pool.mtx.Unlock()
+
+	ep, ok := pool.endpoints[url]
+	if !ok {
+		return
+	}
+	ep.failures++
+	backoff := maxBackoff
+	if ep.failures < breakerThreshold {
+		backoff = baseBackoff << uint(ep.failures-1)
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	ep.openUntil = pool.now().Add(backoff)
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestURLPool(t *testing.T) {
+	now := time.Unix(1000, 0)
+	pool := newURLPool([]string{"a", "b", "c"})
+	pool.now = func() time.Time { return now }
+
+	// unmeasured urls first, in order
+	if url, _ := pool.pick(nil); url != "a" {
+		t.Fatalf("first pick = %q, want a", url)
+	}
+	pool.success("a", 300*time.Millisecond)
+	if url, _ := pool.pick(nil); url != "b" {
+		t.Fatalf("pick = %q, want unmeasured b", url)
+	}
+	pool.success("b", 100*time.Millisecond)
+	pool.success("c", 200*time.Millisecond)
+
+	// the fastest wins, unless it was already tried
+	if url, _ := pool.pick(nil); url != "b" {
+		t.Fatalf("pick = %q, want fastest b", url)
+	}
+	if url, _ := pool.pick(map[string]bool{"b": true}); url != "c" {
+		t.Fatalf("pick = %q, want c", url)
+	}
+
+	// a failed url backs off, doubling each time
+	pool.failure("b")
+	if url, _ := pool.pick(nil); url != "c" {
+		t.Fatalf("pick = %q, want c while b backs off", url)
+	}
+	now = now.Add(baseBackoff)
+	if url, _ := pool.pick(nil); url != "b" {
+		t.Fatalf("pick = %q, want b after its backoff", url)
+	}
+	pool.failure("b")
+	now = now.Add(baseBackoff)
+	if url, _ := pool.pick(nil); url == "b" {
+		t.Fatal("b picked before its second backoff elapsed")
+	}
+	now = now.Add(baseBackoff)
+	if url, _ := pool.pick(nil); url != "b" {
+		t.Fatalf("pick = %q, want b after its second backoff", url)
+	}
+
+	// the circuit opens after breakerThreshold failures
+	for i := 0; i < breakerThreshold; i++ {
+		pool.failure("a")
+	}
+	pool.failure("b")
+	pool.failure("c")
+	now = now.Add(maxBackoff - time.Second)
+	if url, _ := pool.pick(nil); url == "a" {
+		t.Fatal("a picked while its circuit is open")
+	}
+	now = now.Add(time.Second)
+	if url, ok := pool.pick(map[string]bool{"b": true, "c": true}); !ok || url != "a" {
+		t.Fatalf("pick = %q, %v, want a once its circuit half-opens", url, ok)
+	}
+
+	// a success closes it, and the health of kept urls survives an update
+	pool.success("a", 50*time.Millisecond)
+	pool.setURLs([]string{"d", "a"})
+	if url, _ := pool.pick(nil); url != "d" {
+		t.Fatalf("pick = %q, want new url d", url)
+	}
+	pool.failure("d")
+	if url, _ := pool.pick(nil); url != "a" {
+		t.Fatalf("pick = %q, want a", url)
+	}
+
+	pool.failure("a")
+	if _, ok := pool.pick(nil); ok {
+		t.Fatal("pick succeeded while every url backs off")
+	}
+}
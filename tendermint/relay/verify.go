@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/bcbchain/tendermint/lite"
+	"github.com/bcbchain/tendermint/types"
+)
+
+// number of validator sets whose certifier is kept
+const maxCertifiers = 64
+
+// ValidatorsLoader returns the validator set that signed the block at height
+type ValidatorsLoader func(height int64) (*types.ValidatorSet, error)
+
+// proofVerifier checks, before a header and its precommits are relayed, that
+// the precommits carry +2/3 of the voting power of the validator set the node
+// itself knows for that height. The local RPC only supplies the blocks, so a
+// compromised one can not make the relayer pay gas for bogus proofs.
+type proofVerifier struct {
+	mtx    sync.Mutex
+	loader ValidatorsLoader
+	certs  map[string]*lite.StaticCertifier // chainID + validators hash => certifier
+}
+
+func newProofVerifier() *proofVerifier {
+	return &proofVerifier{
+		certs: make(map[string]*lite.StaticCertifier),
+	}
+}
+
+func (pv *proofVerifier) setLoader(loader ValidatorsLoader) {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+
+	pv.loader = loader
+}
+
+// verify checks that commit signs header, a block of chainID
+func (pv *proofVerifier) verify(chainID string, header *types.Header, commit *types.Commit) error {
+	if header == nil || commit == nil {
+		return errors.New("block without header or commit")
+	}
+
+	pv.mtx.Lock()
+	loader := pv.loader
+	pv.mtx.Unlock()
+	if loader == nil {
+		return errors.New("no validator set to verify the block against")
+	}
+
+	vals, err := loader(header.Height)
+	if err != nil {
+		return err
+	}
+
+	return pv.certifier(chainID, vals).Certify(lite.Commit{Header: header, Commit: commit})
+}
+
+// certifier returns the certifier of vals, which are reused for many blocks
+func (pv *proofVerifier) certifier(chainID string, vals *types.ValidatorSet) *lite.StaticCertifier {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+
+	key := chainID + "/" + string(vals.Hash())
+	cert, ok := pv.certs[key]
+	if !ok {
+		// validator sets rarely change, forget them all now and then
+		if len(pv.certs) >= maxCertifiers {
+			pv.certs = make(map[string]*lite.StaticCertifier)
+		}
+		cert = lite.NewStaticCertifier(chainID, vals)
+		pv.certs[key] = cert
+	}
+	return cert
+}
@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	"github.com/bcbchain/tendermint/lite"
+	"github.com/bcbchain/tendermint/types"
+)
+
+func TestProofVerifier(t *testing.T) {
+	const chainID = "local"
+	crypto.SetChainId(chainID)
+	keys := lite.GenValKeys(4)
+	vals := keys.ToValidators(20, 10)
+	others := lite.GenValKeys(4).ToValidators(20, 10)
+
+	pv := newProofVerifier()
+	good := keys.GenCommit(chainID, 10, nil, vals, nil, nil, nil, 0, len(keys))
+	if err := pv.verify(chainID, good.Header, good.Commit); err == nil {
+		t.Fatal("verified without validators")
+	}
+
+	pv.setLoader(func(height int64) (*types.ValidatorSet, error) {
+		if height != 10 {
+			return nil, errors.New("unknown height")
+		}
+		return vals, nil
+	})
+	if err := pv.verify(chainID, good.Header, good.Commit); err != nil {
+		t.Fatalf("good commit: %v", err)
+	}
+
+	cases := map[string]lite.Commit{
+		"one third signed": keys.GenCommit(chainID, 10, nil, vals, nil, nil, nil, 0, 1),
+		"other validators": lite.GenValKeys(4).GenCommit(chainID, 10, nil, others, nil, nil, nil, 0, 4),
+		"other chain":      keys.GenCommit("remote", 10, nil, vals, nil, nil, nil, 0, len(keys)),
+		"unknown height":   keys.GenCommit(chainID, 11, nil, vals, nil, nil, nil, 0, len(keys)),
+	}
+	for name, c := range cases {
+		if err := pv.verify(chainID, c.Header, c.Commit); err == nil {
+			t.Errorf("%s: verified", name)
+		}
+	}
+
+	// a commit of another header
+	other := keys.GenCommit(chainID, 10, types.Txs{types.Tx("tx")}, vals, nil, nil, nil, 0, len(keys))
+	if err := pv.verify(chainID, good.Header, other.Commit); err == nil {
+		t.Error("commit of another header verified")
+	}
+	if err := pv.verify(chainID, nil, good.Commit); err == nil {
+		t.Error("missing header verified")
+	}
+}
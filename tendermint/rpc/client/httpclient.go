@@ -160,6 +160,15 @@ func (c *HTTP) Health() (*ctypes.ResultHealth, error) {
 	return result, nil
 }
 
+func (c *HTTP) Forks() (*ctypes.ResultForks, error) {
+	result := new(ctypes.ResultForks)
+	_, err := c.rpc.Call("forks", map[string]interface{}{}, result)
+	if err != nil {
+		return nil, errors.Wrap(err, "Forks")
+	}
+	return result, nil
+}
+
 func (c *HTTP) BlockchainInfo(minHeight, maxHeight int64) (*ctypes.ResultBlockchainInfo, error) {
 	result := new(ctypes.ResultBlockchainInfo)
 	_, err := c.rpc.Call("blockchain",
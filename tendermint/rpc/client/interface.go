@@ -86,6 +86,7 @@ type NetworkClient interface {
 	NetInfo() (*ctypes.ResultNetInfo, error)
 	DumpConsensusState() (*ctypes.ResultDumpConsensusState, error)
 	Health() (*ctypes.ResultHealth, error)
+	Forks() (*ctypes.ResultForks, error)
 }
 
 // EventsClient is reactive, you can subscribe to any message, given the proper
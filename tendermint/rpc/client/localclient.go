@@ -101,6 +101,10 @@ func (Local) Health() (*ctypes.ResultHealth, error) {
 	return core.Health()
 }
 
+func (Local) Forks() (*ctypes.ResultForks, error) {
+	return core.Forks()
+}
+
 func (Local) DialSeeds(seeds []string) (*ctypes.ResultDialSeeds, error) {
 	return core.UnsafeDialSeeds(seeds)
 }
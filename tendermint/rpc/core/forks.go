@@ -0,0 +1,107 @@
+package core
+
+import (
+	"strings"
+
+	ctypes "github.com/bcbchain/tendermint/rpc/core/types"
+	"github.com/bcbchain/tendermint/softforks"
+)
+
+// Get the fork schedule of the node: where it comes from, whether the
+// signature of the forks file verified, and each fork with whether it is
+// active at the latest block height. Peers advertise the hash of their
+// schedule in their node info; the peers whose hash differs from the hash of
+// this node are listed in mismatched_peers, they would split from the chain
+// at the first fork the schedules disagree on. Peers that do not advertise a
+// schedule are not listed.
+//
+// ```shell
+// curl 'localhost:46657/forks'
+// ```
+//
+// > The above command returns JSON structured like this:
+//
+// ```json
+//
+//	{
+//	  "error": "",
+//	  "result": {
+//	    "source": "/usr/local/bin/tendermint-forks.json",
+//	    "verified": true,
+//	    "hash": "3f2b6cbd5c1b3fbb1c5a3f7dd0fa57f52e5d1c0d2a9c3c2ad8e3f1b0b6a1c4d2",
+//	    "height": 16300,
+//	    "forks": [
+//	      {
+//	        "tag": "fork-block#1.0.2.3233",
+//	        "effectBlockHeight": 3233,
+//	        "description": "blocks carry a random number",
+//	        "feature": "block_random",
+//	        "active": true
+//	      },
+//	      {
+//	        "tag": "fork-block#2.1.1.16261",
+//	        "effectBlockHeight": 16261,
+//	        "description": "no validator without power",
+//	        "feature": "no_zero_power_validator",
+//	        "active": true
+//	      }
+//	    ],
+//	    "mismatched_peers": [
+//	      {
+//	        "id": "8b1f2c0e5d9a4f7b3c6e1d2a9f8b7c6d5e4f3a2b",
+//	        "moniker": "node-3",
+//	        "hash": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+//	      }
+//	    ]
+//	  },
+//	  "id": "",
+//	  "jsonrpc": "2.0"
+//	}
+//
+// ```
+func Forks() (*ctypes.ResultForks, error) {
+	var height int64
+	if blockStore != nil {
+		height = blockStore.Height()
+	}
+
+	result := &ctypes.ResultForks{
+		Source:     forks.Source(),
+		Verified:   forks.Verified(),
+		Hash:       forks.Hash(),
+		Height:     height,
+		Forks:      forks.Status(height),
+		Mismatched: []ctypes.ForkPeer{},
+	}
+	if p2pSwitch == nil {
+		return result, nil
+	}
+
+	for _, peer := range p2pSwitch.Peers().List() {
+		if isPrivate(peer) {
+			continue
+		}
+		info := peer.NodeInfo()
+		hash := forksHash(info.Other)
+		if hash == "" || hash == result.Hash {
+			continue
+		}
+		result.Mismatched = append(result.Mismatched, ctypes.ForkPeer{
+			ID:      info.ID,
+			Moniker: info.Moniker,
+			Hash:    hash,
+		})
+	}
+	return result, nil
+}
+
+// forksHash returns the schedule hash among the Other fields of a node info
+func forksHash(other []string) string {
+	prefix := softforks.NodeInfoKey + "="
+	for _, o := range other {
+		if strings.HasPrefix(o, prefix) {
+			return o[len(prefix):]
+		}
+	}
+	return ""
+}
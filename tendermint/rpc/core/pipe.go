@@ -8,6 +8,8 @@ import (
 	"github.com/bcbchain/tendermint/consensus"
 	"github.com/bcbchain/tendermint/p2p"
 	"github.com/bcbchain/tendermint/proxy"
+	"github.com/bcbchain/tendermint/relay"
+	"github.com/bcbchain/tendermint/softforks"
 	sm "github.com/bcbchain/tendermint/state"
 	"github.com/bcbchain/tendermint/state/txindex"
 	"github.com/bcbchain/tendermint/types"
@@ -58,6 +60,8 @@ var (
 	addrBook         p2p.AddrBook
 	txIndexer        txindex.TxIndexer
 	consensusReactor *consensus.ConsensusReactor
+	forks            *softforks.Registry
+	relayController  *relay.RelayController
 	eventBus         *types.EventBus // thread safe
 
 	logger log.Logger
@@ -123,6 +127,14 @@ func SetConsensusReactor(conR *consensus.ConsensusReactor) {
 	consensusReactor = conR
 }
 
+func SetForks(r *softforks.Registry) {
+	forks = r
+}
+
+func SetRelayController(rc *relay.RelayController) {
+	relayController = rc
+}
+
 func SetLogger(l log.Logger) {
 	logger = l
 }
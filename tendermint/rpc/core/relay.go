@@ -0,0 +1,139 @@
+package core
+
+import (
+	"encoding/hex"
+	"strings"
+
+	ctypes "github.com/bcbchain/tendermint/rpc/core/types"
+	"github.com/pkg/errors"
+)
+
+// Get the status of every cross-chain queue relayed by this node. Running is
+// true while the node is the relayer of the queue; pending is the number of
+// packets sent on the local chain that the remote chain has not received.
+// Health is not ready while the queues of the local chain are not all known.
+// The same figures are served in the Prometheus text format on /metrics.
+//
+// ```shell
+// curl 'localhost:46657/relay_status'
+// ```
+//
+// > The above command returns JSON structured like this:
+//
+// ```json
+//
+//	{
+//	  "error": "",
+//	  "result": {
+//	    "health": {
+//	      "ready": true,
+//	      "failures": 0,
+//	      "last_attempt": "2020-06-01T07:59:30Z"
+//	    },
+//	    "queues": [
+//	      {
+//	        "queue_id": "bcb->bcb[sidechain]",
+//	        "running": true,
+//	        "current_round_url": "https://side.example.com:46657",
+//	        "remote_ibc": "bcbLVgb3odTfKC9Y9GeFnNWL9wmR4pwWiqwe",
+//	        "nonce": 12,
+//	        "local_seq": 30,
+//	        "remote_seq": 28,
+//	        "pending": 2,
+//	        "batches_sent": 12,
+//	        "batches_failed": 0,
+//	        "last_error": "",
+//	        "last_error_time": "0001-01-01T00:00:00Z",
+//	        "checkpoint": {
+//	          "queueID": "bcb->bcb[sidechain]",
+//	          "sequence": 28,
+//	          "height": 1520,
+//	          "nonce": 12,
+//	          "txHash": "6A1E3D6DA9C0D27B6A4C1F0AA9D4DC4F11DF1D3DC0E8E9F4A39B3A8F8A7C9D2E",
+//	          "time": "2020-06-01T08:00:00Z"
+//	        }
+//	      }
+//	    ],
+//	    "remotes": [
+//	      {
+//	        "url": "https://side.example.com:46657",
+//	        "calls": 24,
+//	        "failures": 0,
+//	        "last_latency": 1052000000,
+//	        "total_latency": 25080000000
+//	      }
+//	    ]
+//	  },
+//	  "id": "",
+//	  "jsonrpc": "2.0"
+//	}
+//
+// ```
+func RelayStatus() (*ctypes.ResultRelayStatus, error) {
+	rc := relayController
+	if rc == nil {
+		return nil, errors.New("relay is not initialized")
+	}
+
+	metrics := rc.Metrics()
+	return &ctypes.ResultRelayStatus{
+		Health:  rc.Health(),
+		Queues:  metrics.Queues(),
+		Remotes: metrics.Remotes(),
+	}, nil
+}
+
+// Get the lifecycle of a cross-chain packet sent by this chain, by its IbcHash.
+// The stage is one of emitted, relayed, executed, acked and failed; executed
+// is final for packets that want no ack. Only packets relayed by this node
+// since it started are known.
+//
+// ```shell
+// curl 'localhost:46657/relay_packet?ibc_hash="9F2C1A0E5B7D43A8C6E1F0B2D4A6C8E0F1A3B5C7D9E1F3A5B7C9D1E3F5A7B9C1"'
+// ```
+//
+// > The above command returns JSON structured like this:
+//
+// ```json
+//
+//	{
+//	  "error": "",
+//	  "result": {
+//	    "packet": {
+//	      "ibc_hash": "9F2C1A0E5B7D43A8C6E1F0B2D4A6C8E0F1A3B5C7D9E1F3A5B7C9D1E3F5A7B9C1",
+//	      "queue_id": "bcb->bcb[sidechain]",
+//	      "seq": 29,
+//	      "height": 1520,
+//	      "stage": "acked",
+//	      "ack_wanted": true,
+//	      "attempts": 1,
+//	      "tx_hash": "6A1E3D6DA9C0D27B6A4C1F0AA9D4DC4F11DF1D3DC0E8E9F4A39B3A8F8A7C9D2E",
+//	      "remote_height": 873,
+//	      "ack_seq": 17,
+//	      "log": "",
+//	      "emitted_at": "2020-06-01T08:00:00Z",
+//	      "updated_at": "2020-06-01T08:00:12Z"
+//	    }
+//	  },
+//	  "id": "",
+//	  "jsonrpc": "2.0"
+//	}
+//
+// ```
+func RelayPacket(ibcHash string) (*ctypes.ResultRelayPacket, error) {
+	rc := relayController
+	if rc == nil {
+		return nil, errors.New("relay is not initialized")
+	}
+
+	hash, err := hex.DecodeString(strings.TrimPrefix(ibcHash, "0x"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ibc_hash")
+	}
+
+	packet, err := rc.Packet(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &ctypes.ResultRelayPacket{Packet: packet}, nil
+}
@@ -28,6 +28,9 @@ var Routes = map[string]*rpc.RPCFunc{
 	"dump_consensus_state": rpc.NewRPCFunc(DumpConsensusState, ""),
 	"unconfirmed_txs":      rpc.NewRPCFunc(UnconfirmedTxs, ""),
 	"num_unconfirmed_txs":  rpc.NewRPCFunc(NumUnconfirmedTxs, ""),
+	"relay_status":         rpc.NewRPCFunc(RelayStatus, ""),
+	"relay_packet":         rpc.NewRPCFunc(RelayPacket, "ibc_hash"),
+	"forks":                rpc.NewRPCFunc(Forks, ""),
 
 	// broadcast API
 	"broadcast_tx_commit": rpc.NewRPCFunc(BroadcastTxCommit, "tx"),
@@ -60,6 +60,12 @@ import (
 //        "value": "PpDJRUrLG2RgFqYYjawfn/AcAgacSXpLFrmfYYQnuzE="
 //      },
 //      "voting_power": 10
+//    },
+//    "relay_info": {
+//      "ready": false,
+//      "error": "can not get main chain URL",
+//      "failures": 3,
+//      "last_attempt": "2018-04-27T23:18:38.459766485-04:00"
 //    }
 //  }
 //}
@@ -111,6 +117,10 @@ func Status() (*ctypes.ResultStatus, error) {
 			Name:        nodeName,
 		},
 	}
+	if rc := relayController; rc != nil {
+		health := rc.Health()
+		result.RelayInfo = &health
+	}
 
 	return result, nil
 }
@@ -10,6 +10,8 @@ import (
 	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
 
 	"github.com/bcbchain/tendermint/p2p"
+	"github.com/bcbchain/tendermint/relay"
+	"github.com/bcbchain/tendermint/softforks"
 	"github.com/bcbchain/tendermint/state"
 	"github.com/bcbchain/tendermint/types"
 )
@@ -83,6 +85,7 @@ type ResultStatus struct {
 	NodeInfo      p2p.NodeInfo  `json:"node_info"`
 	SyncInfo      SyncInfo      `json:"sync_info"`
 	ValidatorInfo ValidatorInfo `json:"validator_info"`
+	RelayInfo     *relay.Health `json:"relay_info,omitempty"`
 }
 
 // Is TxIndexing enabled
@@ -220,3 +223,32 @@ type ResultHealth struct {
 type ResultConfFile struct {
 	F json.RawMessage `json:"f"`
 }
+
+// Status of the cross-chain relay
+type ResultRelayStatus struct {
+	Health  relay.Health         `json:"health"`
+	Queues  []relay.QueueStatus  `json:"queues"`
+	Remotes []relay.RemoteStatus `json:"remotes"`
+}
+
+// Lifecycle of a cross-chain packet
+type ResultRelayPacket struct {
+	Packet relay.PacketStatus `json:"packet"`
+}
+
+// Fork schedule of the node, with the peers whose schedule differs
+type ResultForks struct {
+	Source     string                 `json:"source"`
+	Verified   bool                   `json:"verified"`
+	Hash       string                 `json:"hash"`
+	Height     int64                  `json:"height"`
+	Forks      []softforks.ForkStatus `json:"forks"`
+	Mismatched []ForkPeer             `json:"mismatched_peers"`
+}
+
+// A peer and the hash of its fork schedule
+type ForkPeer struct {
+	ID      p2p.ID `json:"id"`
+	Moniker string `json:"moniker"`
+	Hash    string `json:"hash"`
+}
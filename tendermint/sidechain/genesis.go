@@ -43,39 +43,9 @@ func NewSideChain(genesisInfo *abci.SideChainGenesis) *SideChain {
 	return sc
 }
 
-// Genesis side chain genesis, copy prepare file to desitination.
-func (sc *SideChain) Genesis() error {
-	// copy all side chain genesis file
-	desContractPath := configPath()
-	err := filepath.Walk(sc.TempPath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && info.Name() != "needgenesis" {
-			_, err := fs.CopyFile(path, filepath.Join(desContractPath, info.Name()))
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	// remove tmcore db
-	dbDir := dbDir()
-	if err := os.RemoveAll(dbDir); err != nil {
-		return err
-	}
-
-	// remove addrbook.json
-	addrBook := filepath.Join(configPath(), "addrbook.json")
-	if err := os.RemoveAll(addrBook); err != nil {
-		return err
-	}
-	return os.RemoveAll(sc.TempPath)
-}
-
-// NeedSCGenesis return true if has side chain need genesis
-func (sc *SideChain) NeedSCGenesis() bool {
+// hasLegacyMarker returns true if the temp path was prepared by a node that
+// did not keep a journal
+func (sc *SideChain) hasLegacyMarker() bool {
 	exist, err := fs.PathExists(filepath.Join(sc.TempPath, "needgenesis"))
 	if err != nil {
 		panic(err)
@@ -84,7 +54,8 @@ func (sc *SideChain) NeedSCGenesis() bool {
 	return exist
 }
 
-// PrepareSCGenesis generate temp files for side chain genesis.
+// PrepareSCGenesis generate temp files for side chain genesis. It does not
+// refuse what Validate would, the governance tx has taken effect already.
 func (sc *SideChain) PrepareSCGenesis() error {
 	var err error
 
@@ -108,19 +79,7 @@ func (sc *SideChain) PrepareSCGenesis() error {
 		return err
 	}
 
-	if err = sc.genConfigToml(); err != nil {
-		return err
-	}
-
-	if err = sc.delForksFiles(); err != nil {
-		return err
-	}
-
-	if _, err = os.Create(filepath.Join(sc.TempPath, "needgenesis")); err != nil {
-		return err
-	}
-
-	return nil
+	return sc.genConfigToml()
 }
 
 // CopyGenesisFiles copy config files to genesis dir
@@ -174,21 +133,18 @@ func (sc *SideChain) getChainID() (string, error) {
 	return g.ChainID, nil
 }
 
-func (sc *SideChain) delForksFiles() error {
+// forksFiles returns the forks files of the main chain, next to the executable
+func forksFiles() ([]string, error) {
 	currentPath, err := os.Executable()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	currentDir := path.Dir(currentPath)
-	if err = os.RemoveAll(filepath.Join(currentDir, "tendermint-forks.json")); err != nil {
-		return err
-	}
-
-	if err = os.RemoveAll(filepath.Join(currentDir, "tendermint-forks.json.sig")); err != nil {
-		return err
-	}
-	return nil
+	return []string{
+		filepath.Join(currentDir, "tendermint-forks.json"),
+		filepath.Join(currentDir, "tendermint-forks.json.sig"),
+	}, nil
 }
 
 func (sc *SideChain) genContratTarGZ() error {
@@ -264,21 +220,11 @@ func (sc *SideChain) genGenesisJson() error {
 }
 
 func (sc *SideChain) genValidatorJson() error {
-	if len(sc.GenesisInfo.Validators) == 0 {
-		return errors.New("invalid side chain validator")
-	}
-	v := sc.GenesisInfo.Validators[0]
-
-	gv := types.GenesisValidator{
-		PubKey:     crypto.PubKeyEd25519FromBytes(v.PubKey),
-		RewardAddr: v.RewardAddr,
-		Power:      int64(v.Power),
-		Name:       v.Name,
+	result, err := sc.genesisValidators()
+	if err != nil {
+		return err
 	}
 
-	result := make([]types.GenesisValidator, 0, 1)
-	result = append(result, gv)
-
 	outByte, err := cdc.MarshalJSONIndent(result, "", "  ")
 	if err != nil {
 		return err
@@ -293,6 +239,26 @@ func (sc *SideChain) genValidatorJson() error {
 	return nil
 }
 
+// genesisValidators returns the validators of the side chain genesis, it
+// starts with the first one only
+func (sc *SideChain) genesisValidators() ([]types.GenesisValidator, error) {
+	if len(sc.GenesisInfo.Validators) == 0 {
+		return nil, errors.New("invalid side chain validator")
+	}
+	v := sc.GenesisInfo.Validators[0]
+
+	gv := types.GenesisValidator{
+		PubKey:     crypto.PubKeyEd25519FromBytes(v.PubKey),
+		RewardAddr: v.RewardAddr,
+		Power:      int64(v.Power),
+		Name:       v.Name,
+	}
+
+	result := make([]types.GenesisValidator, 0, 1)
+	result = append(result, gv)
+	return result, nil
+}
+
 func (sc *SideChain) genPrivValidatorJson() error {
 	privValidatorFile := privValidatorFile()
 	tempPrivValJson := filepath.Join(sc.TempPath, filepath.Base(privValidatorFile))
@@ -317,34 +283,34 @@ func (sc *SideChain) genConfigToml() error {
 	_, configFile, _, _, _ := ConfigPathFunc()
 	tempConfig := filepath.Join(sc.TempPath, filepath.Base(configFile))
 
-	configContent, err := ioutil.ReadFile(configFile)
+	_, configContent, err := renderConfigToml()
 	if err != nil {
 		return err
 	}
+	return ioutil.WriteFile(tempConfig, configContent, 0600)
+}
 
-	tempFile, err := os.Create(tempConfig)
+// renderConfigToml returns the current config.toml, and the one of the side
+// chain: the same without the persistent peers of the main chain
+func renderConfigToml() (current, rendered []byte, err error) {
+	_, configFile, _, _, _ := ConfigPathFunc()
+	current, err = ioutil.ReadFile(configFile)
 	if err != nil {
-		return err
+		return
 	}
-	defer tempFile.Close()
 
-	configSplit := strings.Split(string(configContent), "\n")
-	for _, line := range configSplit {
+	configSplit := strings.Split(string(current), "\n")
+	for i, line := range configSplit {
 		if strings.HasPrefix(line, "persistent_peers") {
 			if strings.HasSuffix(line, "\r") {
-				line = `persistent_peers = ""\r`
+				configSplit[i] = `persistent_peers = ""\r`
 			} else {
-				line = `persistent_peers = ""`
+				configSplit[i] = `persistent_peers = ""`
 			}
 		}
-		line += "\n"
-		_, err = tempFile.WriteString(line)
-		if err != nil {
-			return err
-		}
 	}
-
-	return nil
+	rendered = []byte(strings.Join(configSplit, "\n"))
+	return
 }
 
 // ContainsCurrentNode if genesisInfoList contains current node,
@@ -354,12 +320,8 @@ func ContainsCurrentNode(genesisInfoList []*abci.SideChainGenesis) (genesisInfo
 	currentNodePubKey := pvm.LoadFilePV(privValidatorFile).GetPubKey()
 
 	for _, info := range genesisInfoList {
-		for _, v := range info.Validators {
-			if currentNodePubKey.Equals(crypto.PubKeyEd25519FromBytes(v.PubKey)) {
-				genesisInfo = info
-				ok = true
-				return
-			}
+		if hasNode(info, currentNodePubKey) {
+			return info, true
 		}
 	}
 
@@ -371,6 +333,10 @@ func genesisFile() string {
 	return genesisFile
 }
 
+func homePath() string {
+	return filepath.Dir(configPath())
+}
+
 func configPath() string {
 	_, configFile, _, _, _ := ConfigPathFunc()
 	return filepath.Dir(configFile)
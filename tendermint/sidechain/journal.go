@@ -0,0 +1,287 @@
+package sidechain
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bcbchain/bclib/fs"
+	"github.com/bcbchain/bclib/jsoniter"
+	"github.com/lzwisbadbad/targz/useTar"
+)
+
+// Stage is the last step of a side chain genesis done on this node. Each step
+// is idempotent, so after a crash the journal tells which step to run again.
+type Stage string
+
+const (
+	StagePrepared     Stage = "prepared"      // genesis files written to the temp path
+	StageAppCleaned   Stage = "app_cleaned"   // the app dropped its data
+	StageFilesSwapped Stage = "files_swapped" // old config in the backup, new one in place
+	StageDBReset      Stage = "db_reset"      // old data in the backup
+	StageArchived     Stage = "archived"      // the backup packed in a tarball
+	StageRestarted    Stage = "restarted"     // the node booted as the side chain
+)
+
+var stages = []Stage{StagePrepared, StageAppCleaned, StageFilesSwapped, StageDBReset, StageArchived, StageRestarted}
+
+// ErrRestart is returned by the block that makes this node a side chain, once
+// the steps that can run before the node stops are done
+var ErrRestart = errors.New("side chain genesis prepared, restart the node to finish it")
+
+// ExitCodeRestart is the exit code of a node stopped by ErrRestart. It is not
+// zero, so a supervisor that restarts a failed node starts it again, and the
+// genesis is finished by Resume.
+const ExitCodeRestart = 75
+
+// Journal is the progress of a side chain genesis, kept on disk next to the
+// config directory
+type Journal struct {
+	SideChainID string    `json:"side_chain_id"`
+	Stage       Stage     `json:"stage"`
+	Backup      string    `json:"backup"` // where the old config and data go
+	Updated     time.Time `json:"updated"`
+	RolledBack  bool      `json:"rolled_back,omitempty"` // the backup was restored
+}
+
+// Archive returns the tarball of the backup
+func (j *Journal) Archive() string {
+	return j.Backup + ".tar.gz"
+}
+
+// newJournal starts the journal of a genesis, its backup goes in a directory
+// named after the time it starts
+func newJournal(sideChainID string) *Journal {
+	return &Journal{
+		SideChainID: sideChainID,
+		Backup:      filepath.Join(homePath(), "backup", "sidechain-"+time.Now().Format("20060102-150405")),
+	}
+}
+
+func (j *Journal) done(stage Stage) bool {
+	return stageIndex(j.Stage) >= stageIndex(stage)
+}
+
+func stageIndex(stage Stage) int {
+	for i, s := range stages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+func journalFile() string {
+	return filepath.Join(homePath(), "sidechain_genesis.json")
+}
+
+// LoadJournal returns the journal of the last side chain genesis, nil if this
+// node never was part of one
+func LoadJournal() (*Journal, error) {
+	b, err := ioutil.ReadFile(journalFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	j := new(Journal)
+	if err = jsoniter.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("invalid side chain genesis journal: %v", err)
+	}
+	if stageIndex(j.Stage) < 0 {
+		return nil, fmt.Errorf("invalid side chain genesis stage %q", j.Stage)
+	}
+	return j, nil
+}
+
+// save writes the journal at stage, replacing the old one only once the new
+// one is on disk
+func (j *Journal) save(stage Stage) error {
+	j.Stage = stage
+	j.Updated = time.Now().UTC()
+	b, err := jsoniter.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	p := journalFile()
+	tmp := p + ".tmp"
+	fi, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = fi.Write(b); err == nil {
+		err = fi.Sync()
+	}
+	if e := fi.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// Begin runs the steps of a side chain genesis that run before the node
+// stops: the genesis files are prepared and the app cleans its data. It
+// returns ErrRestart when they are done; the rest runs in Resume.
+func (sc *SideChain) Begin(cleanApp func() error) error {
+	j, err := LoadJournal()
+	if err != nil {
+		return err
+	}
+	if j == nil || j.SideChainID != sc.GenesisInfo.SideChainID || j.done(StageRestarted) {
+		// a block that did not clean the app yet is replayed after a crash,
+		// so a missing journal means preparing from scratch
+		if err = os.RemoveAll(sc.TempPath); err != nil {
+			return err
+		}
+		if err = sc.PrepareSCGenesis(); err != nil {
+			return err
+		}
+		j = newJournal(sc.GenesisInfo.SideChainID)
+		if err = j.save(StagePrepared); err != nil {
+			return err
+		}
+	}
+
+	if err = sc.advance(j, StageAppCleaned, cleanApp); err != nil {
+		return err
+	}
+	return ErrRestart
+}
+
+// Resume finishes the side chain genesis left by the last run, if any. It is
+// called at boot, before the config and the database are opened.
+func (sc *SideChain) Resume(cleanApp func() error) error {
+	j, err := LoadJournal()
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		if !sc.hasLegacyMarker() {
+			return nil
+		}
+		// prepared by a node without the journal, the app may not be clean
+		j = newJournal("")
+		if err = j.save(StagePrepared); err != nil {
+			return err
+		}
+	}
+
+	return sc.advance(j, StageRestarted, cleanApp)
+}
+
+// advance runs the steps after the stage of j, up to until
+func (sc *SideChain) advance(j *Journal, until Stage, cleanApp func() error) error {
+	for _, stage := range stages {
+		if j.done(stage) {
+			continue
+		}
+		if stageIndex(stage) > stageIndex(until) {
+			return nil
+		}
+
+		var err error
+		switch stage {
+		case StageAppCleaned:
+			err = cleanApp()
+		case StageFilesSwapped:
+			err = sc.swapFiles(j.Backup)
+		case StageDBReset:
+			err = moveToBackup(dbDir(), filepath.Join(j.Backup, filepath.Base(dbDir())))
+		case StageArchived:
+			err = archive(j)
+		case StageRestarted:
+			err = os.RemoveAll(sc.TempPath)
+		}
+		if err != nil {
+			return fmt.Errorf("side chain genesis, %s: %v", stage, err)
+		}
+		if err = j.save(stage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swapFiles moves the config files the genesis replaces, the address book
+// and the forks files to the backup, then copies the prepared ones in place
+func (sc *SideChain) swapFiles(backup string) error {
+	configDir := configPath()
+	backupDir := filepath.Join(backup, filepath.Base(configDir))
+	if err := os.MkdirAll(backupDir, 0750); err != nil {
+		return err
+	}
+
+	infos, err := ioutil.ReadDir(sc.TempPath)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || info.Name() == "needgenesis" {
+			continue
+		}
+		des := filepath.Join(configDir, info.Name())
+		if err = moveToBackup(des, filepath.Join(backupDir, info.Name())); err != nil {
+			return err
+		}
+		if _, err = fs.CopyFile(filepath.Join(sc.TempPath, info.Name()), des); err != nil {
+			return err
+		}
+	}
+
+	forks, err := forksFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range forks {
+		if err = moveToBackup(f, filepath.Join(backup, "forks", filepath.Base(f))); err != nil {
+			return err
+		}
+	}
+
+	return moveToBackup(filepath.Join(configDir, "addrbook.json"), filepath.Join(backupDir, "addrbook.json"))
+}
+
+// archive packs the backup in its tarball, with the backup directory as its
+// root, and removes the directory. Links, modes and times are kept.
+func archive(j *Journal) error {
+	exist, err := fs.PathExists(j.Backup)
+	if err != nil || !exist {
+		// packed already
+		return err
+	}
+
+	tmp := j.Archive() + ".tmp"
+	if err = useTar.TarGz(j.Backup, tmp, 1); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.Archive()); err != nil {
+		return err
+	}
+	return os.RemoveAll(j.Backup)
+}
+
+// moveToBackup moves path to backup. Once a file is in the backup it is not
+// replaced, so running it again after a crash keeps the old file.
+func moveToBackup(path, backup string) error {
+	exist, err := fs.PathExists(path)
+	if err != nil || !exist {
+		return err
+	}
+	if exist, err = fs.PathExists(backup); err != nil {
+		return err
+	} else if exist {
+		return os.RemoveAll(path)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(backup), 0750); err != nil {
+		return err
+	}
+	return os.Rename(path, backup)
+}
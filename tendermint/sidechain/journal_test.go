@@ -0,0 +1,179 @@
+package sidechain
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupHome(t *testing.T) string {
+	home, err := ioutil.TempDir("", "sidechain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(home, "config")
+	data := filepath.Join(home, "data")
+	ConfigPathFunc = func() (string, string, string, string, string) {
+		return filepath.Join(config, "genesis.json"), filepath.Join(config, "config.toml"), data,
+			filepath.Join(config, "validators.json"), filepath.Join(config, "priv_validator.json")
+	}
+
+	writeFile(t, filepath.Join(config, "genesis.json"), "main")
+	writeFile(t, filepath.Join(config, "config.toml"), "main")
+	writeFile(t, filepath.Join(config, "addrbook.json"), "main")
+	writeFile(t, filepath.Join(data, "blockstore.db", "000001.log"), "main")
+	return home
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestResume(t *testing.T) {
+	home := setupHome(t)
+	defer os.RemoveAll(home)
+
+	sc := NewSideChain(nil)
+	writeFile(t, filepath.Join(sc.TempPath, "genesis.json"), "side")
+	writeFile(t, filepath.Join(sc.TempPath, "config.toml"), "side")
+	j := newJournal("side[1]")
+	if err := j.save(StagePrepared); err != nil {
+		t.Fatal(err)
+	}
+
+	// the app is down at the first boot
+	if err := sc.Resume(func() error { return errors.New("app down") }); err == nil {
+		t.Fatal("resumed without cleaning the app")
+	}
+	if j, _ := LoadJournal(); j.Stage != StagePrepared {
+		t.Fatalf("stage %s", j.Stage)
+	}
+
+	// the boot crashes after swapping part of the files
+	if err := moveToBackup(filepath.Join(home, "config", "genesis.json"),
+		filepath.Join(j.Backup, "config", "genesis.json")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(home, "config", "genesis.json"), "side")
+
+	cleaned := 0
+	if err := sc.Resume(func() error { cleaned++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if cleaned != 1 {
+		t.Fatalf("app cleaned %d times", cleaned)
+	}
+	if j, _ := LoadJournal(); j.Stage != StageRestarted {
+		t.Fatalf("stage %s", j.Stage)
+	}
+
+	// the backup is packed
+	packed, err := ioutil.TempDir("", "sidechain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(packed)
+	if err = unpack(j.Archive(), packed); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(packed, filepath.Base(j.Backup))
+
+	for name, want := range map[string]string{
+		filepath.Join(home, "config", "genesis.json"):                "side",
+		filepath.Join(home, "config", "config.toml"):                 "side",
+		filepath.Join(backup, "config", "genesis.json"):              "main",
+		filepath.Join(backup, "config", "config.toml"):               "main",
+		filepath.Join(backup, "config", "addrbook.json"):             "main",
+		filepath.Join(backup, "data", "blockstore.db", "000001.log"): "main",
+	} {
+		if got := readFile(t, name); got != want {
+			t.Errorf("%s: %s, want %s", name, got, want)
+		}
+	}
+	for _, gone := range []string{sc.TempPath, j.Backup, filepath.Join(home, "data"), filepath.Join(home, "config", "addrbook.json")} {
+		if _, err := os.Stat(gone); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", gone, err)
+		}
+	}
+
+	// nothing left to do
+	if err := sc.Resume(func() error { t.Fatal("cleaned the app again"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	home := setupHome(t)
+	defer os.RemoveAll(home)
+
+	if _, err := Rollback(); err == nil {
+		t.Fatal("rolled back without a side chain genesis")
+	}
+
+	sc := NewSideChain(nil)
+	writeFile(t, filepath.Join(sc.TempPath, "genesis.json"), "side")
+	j := newJournal("side[1]")
+	if err := j.save(StageAppCleaned); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Rollback(); err == nil {
+		t.Fatal("rolled back an unfinished genesis")
+	}
+	// links and modes of the node survive the tarball
+	if err := os.Symlink("blockstore.db", filepath.Join(home, "data", "latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Resume(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the side chain ran for a while
+	writeFile(t, filepath.Join(home, "data", "blockstore.db", "000001.log"), "side")
+
+	if _, err := Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		filepath.Join(home, "config", "genesis.json"):              "main",
+		filepath.Join(home, "config", "config.toml"):               "main",
+		filepath.Join(home, "config", "addrbook.json"):             "main",
+		filepath.Join(home, "data", "blockstore.db", "000001.log"): "main",
+	} {
+		if got := readFile(t, name); got != want {
+			t.Errorf("%s: %s, want %s", name, got, want)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(home, "data", "latest")); err != nil || link != "blockstore.db" {
+		t.Errorf("link not restored: %s, %v", link, err)
+	}
+	if fi, err := os.Stat(filepath.Join(home, "config", "genesis.json")); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode not restored: %v", err)
+	}
+	if j, _ := LoadJournal(); !j.RolledBack {
+		t.Error("rollback not recorded")
+	}
+	if _, err := Rollback(); err == nil {
+		t.Error("rolled back twice")
+	}
+
+	// what the side chain wrote is kept aside
+	aside, _ := filepath.Glob(filepath.Join(home, "backup", "rollback-*", "data", "blockstore.db", "000001.log"))
+	if len(aside) != 1 || readFile(t, aside[0]) != "side" {
+		t.Errorf("side chain data: %v", aside)
+	}
+}
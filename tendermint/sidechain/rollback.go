@@ -0,0 +1,103 @@
+package sidechain
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bcbchain/bclib/fs"
+	"github.com/lzwisbadbad/targz/useTar"
+)
+
+// Rollback restores the node as it was before the last side chain genesis,
+// from the tarball of its backup. The node must be stopped. What the side
+// chain wrote in its place goes to a backup of its own.
+func Rollback() (*Journal, error) {
+	j, err := LoadJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j == nil {
+		return nil, errors.New("no side chain genesis to roll back")
+	}
+	if j.RolledBack {
+		return nil, fmt.Errorf("side chain genesis of %s rolled back already", j.SideChainID)
+	}
+	if !j.done(StageArchived) {
+		return nil, fmt.Errorf("side chain genesis stopped at %s, start the node to finish it first", j.Stage)
+	}
+
+	tmp := j.Backup + ".restore"
+	if err = os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err = unpack(j.Archive(), tmp); err != nil {
+		return nil, err
+	}
+	restored := filepath.Join(tmp, filepath.Base(j.Backup))
+	aside := filepath.Join(homePath(), "backup", "rollback-"+time.Now().Format("20060102-150405"))
+
+	configDir := configPath()
+	infos, err := ioutil.ReadDir(filepath.Join(restored, filepath.Base(configDir)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, info := range infos {
+		err = restore(filepath.Join(restored, filepath.Base(configDir), info.Name()),
+			filepath.Join(configDir, info.Name()),
+			filepath.Join(aside, filepath.Base(configDir), info.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = restore(filepath.Join(restored, filepath.Base(dbDir())), dbDir(), filepath.Join(aside, filepath.Base(dbDir())))
+	if err != nil {
+		return nil, err
+	}
+
+	forks, err := forksFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range forks {
+		err = restore(filepath.Join(restored, "forks", filepath.Base(f)), f, filepath.Join(aside, "forks", filepath.Base(f)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	j.RolledBack = true
+	return j, j.save(j.Stage)
+}
+
+// unpack extracts the tarball of a backup. It is the node's own, so its size
+// is not bounded, but no entry may leave dst all the same.
+func unpack(archive, dst string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return useTar.UnTarGzSafe(dst, f, useTar.Limits{})
+}
+
+// restore moves src to dst, after moving what is at dst to aside. Nothing
+// happens if src is not in the backup.
+func restore(src, dst, aside string) error {
+	exist, err := fs.PathExists(src)
+	if err != nil || !exist {
+		return err
+	}
+	if err = moveToBackup(dst, aside); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,183 @@
+package sidechain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bcbchain/bclib/algorithm"
+	"github.com/bcbchain/bclib/jsoniter"
+	abci "github.com/bcbchain/bclib/tendermint/abci/types"
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	cfg "github.com/bcbchain/tendermint/config"
+	"github.com/bcbchain/tendermint/types"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
+	"github.com/spf13/viper"
+)
+
+// Preview is what a side chain genesis writes on this node
+type Preview struct {
+	ChainID    string                   `json:"chain_id"`
+	Validators []types.GenesisValidator `json:"validators"`
+	Contracts  []string                 `json:"contracts"` // tarballs written in the config directory
+	Diff       []string                 `json:"diff"`      // changes to the current config, "-" before and "+" after
+}
+
+// genesisContract is a contract of the app state in the genesis
+type genesisContract struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Code     string `json:"code"`
+	CodeHash string `json:"codeHash"`
+}
+
+// Validate checks the side chain genesis without writing anything: the
+// genesis doc, the code of its contracts, that this node is a validator and
+// that its config renders. It returns what the genesis would change.
+func (sc *SideChain) Validate() (*Preview, error) {
+	if sc.GenesisInfo == nil {
+		return nil, errors.New("no side chain genesis")
+	}
+
+	genDoc, err := sc.genesisDoc()
+	if err != nil {
+		return nil, err
+	}
+
+	contracts, err := sc.checkContracts(genDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey := pvm.LoadFilePV(privValidatorFile()).GetPubKey()
+	if !hasNode(sc.GenesisInfo, pubKey) {
+		return nil, fmt.Errorf("this node is not a validator of side chain %s", sc.GenesisInfo.SideChainID)
+	}
+
+	current, rendered, err := renderConfigToml()
+	if err != nil {
+		return nil, err
+	}
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err = v.ReadConfig(bytes.NewReader(rendered)); err != nil {
+		return nil, fmt.Errorf("side chain config.toml does not parse: %v", err)
+	}
+	if err = v.Unmarshal(cfg.DefaultConfig()); err != nil {
+		return nil, fmt.Errorf("side chain config.toml does not parse: %v", err)
+	}
+
+	preview := &Preview{
+		ChainID:    genDoc.ChainID,
+		Validators: genDoc.Validators,
+		Contracts:  contracts,
+	}
+	if chainID, err := sc.getChainID(); err != nil {
+		return nil, err
+	} else if chainID != genDoc.ChainID {
+		preview.Diff = append(preview.Diff, "- chain_id "+chainID, "+ chain_id "+genDoc.ChainID)
+	}
+	preview.Diff = append(preview.Diff, lineDiff(string(current), string(rendered))...)
+	return preview, nil
+}
+
+// genesisDoc parses the genesis of the side chain with its validators, as
+// the node loads it after the genesis
+func (sc *SideChain) genesisDoc() (*types.GenesisDoc, error) {
+	genDoc := new(types.GenesisDoc)
+	if err := cdc.UnmarshalJSON([]byte(sc.GenesisInfo.GenesisInfo), genDoc); err != nil {
+		return nil, fmt.Errorf("invalid side chain genesis: %v", err)
+	}
+
+	validators, err := sc.genesisValidators()
+	if err != nil {
+		return nil, err
+	}
+	genDoc.Validators = validators
+	if err = genDoc.ValidateAndComplete(); err != nil {
+		return nil, fmt.Errorf("invalid side chain genesis: %v", err)
+	}
+	if genDoc.ChainID != sc.GenesisInfo.SideChainID {
+		return nil, fmt.Errorf("side chain genesis is for chain %s, not %s", genDoc.ChainID, sc.GenesisInfo.SideChainID)
+	}
+	return genDoc, nil
+}
+
+// checkContracts checks that each contract of the genesis has its code, and
+// that the code hashes to the codeHash of the genesis. It returns the names
+// of the tarballs.
+func (sc *SideChain) checkContracts(genDoc *types.GenesisDoc) ([]string, error) {
+	var appState struct {
+		Contracts []genesisContract `json:"contracts"`
+	}
+	if len(genDoc.AppStateJSON) != 0 {
+		if err := jsoniter.Unmarshal(genDoc.AppStateJSON, &appState); err != nil {
+			return nil, fmt.Errorf("invalid side chain app state: %v", err)
+		}
+	}
+
+	codes := make(map[string][]byte, len(sc.GenesisInfo.ContractData))
+	for _, v := range sc.GenesisInfo.ContractData {
+		codes[v.Name+"-"+v.Version] = v.CodeData
+	}
+
+	var names []string
+	for _, c := range appState.Contracts {
+		key := c.Name + "-" + c.Version
+		code, ok := codes[key]
+		if !ok {
+			return nil, fmt.Errorf("no code for contract %s", key)
+		}
+		delete(codes, key)
+
+		codeHash := hex.EncodeToString(algorithm.CalcCodeHash(string(code)))
+		if !strings.EqualFold(codeHash, c.CodeHash) {
+			return nil, fmt.Errorf("code of contract %s hashes to %s, the genesis has %s", key, codeHash, c.CodeHash)
+		}
+		names = append(names, key+".tar.gz")
+	}
+	for key := range codes {
+		return nil, fmt.Errorf("code of contract %s is not in the genesis", key)
+	}
+	return names, nil
+}
+
+// hasNode returns true if pubKey is a validator of the side chain
+func hasNode(info *abci.SideChainGenesis, pubKey crypto.PubKey) bool {
+	for _, v := range info.Validators {
+		if pubKey.Equals(crypto.PubKeyEd25519FromBytes(v.PubKey)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineDiff returns the lines that differ between before and after. Rendering
+// the config only rewrites lines, so they are compared one by one.
+func lineDiff(before, after string) []string {
+	b := strings.Split(before, "\n")
+	a := strings.Split(after, "\n")
+
+	var diff []string
+	for i := 0; i < len(b) || i < len(a); i++ {
+		var bl, al string
+		if i < len(b) {
+			bl = b[i]
+		}
+		if i < len(a) {
+			al = a[i]
+		}
+		if bl == al {
+			continue
+		}
+		if i < len(b) {
+			diff = append(diff, "- "+bl)
+		}
+		if i < len(a) {
+			diff = append(diff, "+ "+al)
+		}
+	}
+	return diff
+}
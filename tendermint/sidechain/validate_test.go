@@ -0,0 +1,81 @@
+package sidechain
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bcbchain/bclib/algorithm"
+	abci "github.com/bcbchain/bclib/tendermint/abci/types"
+	"github.com/bcbchain/bclib/tendermint/go-crypto"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
+)
+
+func testGenesisInfo(t *testing.T, home string) *abci.SideChainGenesis {
+	crypto.SetChainId("main")
+	pv := pvm.GenFilePV(filepath.Join(home, "config", "priv_validator.json"))
+	pv.Save()
+	writeFile(t, filepath.Join(home, "config", "genesis.json"), `{"chain_id":"main"}`)
+	writeFile(t, filepath.Join(home, "config", "config.toml"), "moniker = \"a\"\npersistent_peers = \"id@1.2.3.4:46656\"\n")
+
+	code := []byte("contract code")
+	codeHash := hex.EncodeToString(algorithm.CalcCodeHash(string(code)))
+	pubKey := pv.GetPubKey().(crypto.PubKeyEd25519)
+	return &abci.SideChainGenesis{
+		SideChainID: "main[side]",
+		GenesisInfo: `{"chain_id":"main[side]","genesis_time":"2026-10-18T00:00:00Z",` +
+			`"app_state":{"contracts":[{"name":"token","version":"1.0","code":"token-1.0.tar.gz","codeHash":"` + codeHash + `"}]}}`,
+		ContractData: []abci.ContractData{{Name: "token", Version: "1.0", CodeData: code}},
+		Validators:   []abci.Validator{{PubKey: pubKey[:], Power: 10, Name: "a"}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	home := setupHome(t)
+	defer os.RemoveAll(home)
+	info := testGenesisInfo(t, home)
+
+	preview, err := NewSideChain(info).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.ChainID != "main[side]" || len(preview.Validators) != 1 ||
+		!reflect.DeepEqual(preview.Contracts, []string{"token-1.0.tar.gz"}) {
+		t.Fatalf("preview %+v", preview)
+	}
+	want := []string{
+		"- chain_id main", "+ chain_id main[side]",
+		`- persistent_peers = "id@1.2.3.4:46656"`, `+ persistent_peers = ""`,
+	}
+	if !reflect.DeepEqual(preview.Diff, want) {
+		t.Fatalf("diff %q", preview.Diff)
+	}
+
+	bad := *info
+	bad.ContractData = []abci.ContractData{{Name: "token", Version: "1.0", CodeData: []byte("other code")}}
+	if _, err = NewSideChain(&bad).Validate(); err == nil || !strings.Contains(err.Error(), "hashes to") {
+		t.Errorf("tampered code: %v", err)
+	}
+
+	bad = *info
+	bad.SideChainID = "main[other]"
+	if _, err = NewSideChain(&bad).Validate(); err == nil {
+		t.Error("genesis of another chain accepted")
+	}
+
+	bad = *info
+	other := crypto.GenPrivKeyEd25519().PubKey().(crypto.PubKeyEd25519)
+	bad.Validators = []abci.Validator{{PubKey: other[:], Power: 10}}
+	if _, err = NewSideChain(&bad).Validate(); err == nil || !strings.Contains(err.Error(), "not a validator") {
+		t.Errorf("other validators: %v", err)
+	}
+
+	bad = *info
+	bad.GenesisInfo = `{"chain_id":"main[side]"`
+	if _, err = NewSideChain(&bad).Validate(); err == nil {
+		t.Error("broken genesis accepted")
+	}
+}
@@ -0,0 +1,15 @@
+package softforks
+
+// The fork schedules of the public chains, as shipped in
+// bundle/.config/<chainID>/tendermint-forks.json. A node of these chains
+// without a forks file still activates the forks at the heights the rest of
+// the chain does.
+func init() {
+	RegisterDefaults("bcb", []ForkInfo{
+		{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 60610, Description: "Add random number to block header"},
+		{Tag: "fork-block#2.1.1.16261", EffectBlockHeight: 32398195, Description: "correct validators set"},
+	})
+	RegisterDefaults("bcbtest", []ForkInfo{
+		{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 1, Description: "Add random number to block header"},
+	})
+}
@@ -3,18 +3,40 @@ package softforks
 // initial version copied from gichain
 
 import (
-	"github.com/bcbchain/bclib/sig"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-
 	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/bcbchain/bclib/sig"
+	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
 	"github.com/pkg/errors"
 )
 
-var TagToForkInfo map[string]ForkInfo
+// Features changed by a fork. A feature is active from the effect height of
+// its fork on, and always when the schedule does not have its fork.
+const (
+	// blocks carry a random number, fork-block#1.0.2.3233
+	FeatureBlockRandom = "block_random"
+	// a new validator with no power is not added, fork-block#2.1.1.16261
+	FeatureNoZeroPowerValidator = "no_zero_power_validator"
+)
+
+// tagToFeature names the feature of each known fork tag
+var tagToFeature = map[string]string{
+	"fork-block#1.0.2.3233":  FeatureBlockRandom,
+	"fork-block#2.1.1.16261": FeatureNoZeroPowerValidator,
+}
+
+// NodeInfoKey is the key of the schedule hash in the Other fields of the
+// node info peers exchange, as forks=<hash>
+const NodeInfoKey = "forks"
+
+// defaultForks is the fork schedule of a chain without a forks file
+var defaultForks = make(map[string][]ForkInfo)
 
 //具体含义请参考 gichain.yaml
 type ForkInfo struct {
@@ -23,75 +45,170 @@ type ForkInfo struct {
 	Description       string `json:"description,omitempty"`       // Description for the fork
 }
 
-// 不自動init了，會給很多其他引用模塊帶來麻煩
-func Init() {
+// ForkStatus is a fork of the schedule and whether it is active at a height
+type ForkStatus struct {
+	ForkInfo
+	Feature string `json:"feature"`
+	Active  bool   `json:"active"`
+}
 
-	if len(TagToForkInfo) == 0 {
-		TagToForkInfo = make(map[string]ForkInfo)
-	} else {
-		return
-	}
+// RegisterDefaults embeds the fork schedule of chainID, used when the node
+// has no forks file
+func RegisterDefaults(chainID string, forks []ForkInfo) {
+	defaultForks[chainID] = forks
+}
 
-	ex, err := os.Executable()
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
+// Registry is the fork schedule of a chain. A nil Registry has no fork, all
+// features are active.
+type Registry struct {
+	forks     []ForkInfo
+	byFeature map[string]ForkInfo
+	source    string // the forks file, or why there is none
+	verified  bool   // the signature of the forks file verified
+}
 
-	dir := filepath.Dir(ex)
-	if dir == "" {
-		panic(errors.New("Failed to get path of forks file"))
+// NewRegistry checks a fork schedule: each tag is known and used once, and
+// the effect heights do not decrease in the order of the forks.
+func NewRegistry(forks []ForkInfo) (*Registry, error) {
+	r := &Registry{
+		byFeature: make(map[string]ForkInfo, len(forks)),
+		source:    "none",
+	}
+	var last int64
+	for _, f := range forks {
+		feature, ok := tagToFeature[f.Tag]
+		if !ok {
+			return nil, fmt.Errorf("unknown fork %q", f.Tag)
+		}
+		if _, ok := r.byFeature[feature]; ok {
+			return nil, fmt.Errorf("fork %q is in the schedule twice", f.Tag)
+		}
+		if f.EffectBlockHeight < last {
+			return nil, fmt.Errorf("fork %q takes effect at %d, before the fork above it at %d", f.Tag, f.EffectBlockHeight, last)
+		}
+		last = f.EffectBlockHeight
+		r.byFeature[feature] = f
+		r.forks = append(r.forks, f)
 	}
+	return r, nil
+}
 
-	forksFile := dir + "/tendermint-forks.json"
-	if _, err = os.Stat(forksFile); err != nil {
-		//File doesn't exist, terminate the process
-		//panic(err.Error())
-		return
+// Load reads the fork schedule from the forks file at path, next to the
+// executable if path is empty. Without the file it uses the defaults of
+// chainID, if any.
+func Load(path, chainID string) (*Registry, error) {
+	if path == "" {
+		ex, err := os.Executable()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get path of forks file")
+		}
+		path = filepath.Join(filepath.Dir(ex), "tendermint-forks.json")
 	}
-	sigFile := dir + "/tendermint-forks.json.sig"
-	if _, err = os.Stat(forksFile); err != nil {
-		//File doesn't exist, terminate the process
-		panic(err.Error())
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		r, err := NewRegistry(defaultForks[chainID])
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid default forks of "+chainID)
+		}
+		if _, ok := defaultForks[chainID]; ok {
+			r.source = "defaults of " + chainID
+		}
+		return r, nil
 	}
+
 	// Verify Fork.json
-	_, err = sig.VerifyTextFile(forksFile, sigFile)
-	if err != nil {
-		// Failed to verify, terminate the process
-		panic(err.Error())
+	if _, err := sig.VerifyTextFile(path, path+".sig"); err != nil {
+		return nil, errors.Wrap(err, "Failed to verify forks file")
 	}
 
 	// Notes: be careful of permission of the file, should be 444 or 644
-	data, err := ioutil.ReadFile(forksFile)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
+	}
+
+	forks := make([]ForkInfo, 0)
+	if err = json.Unmarshal(data, &forks); err != nil {
+		return nil, errors.Wrap(err, "Invalid forks file")
 	}
 
-	AppForkInfo := make([]ForkInfo, 1)
-	err = json.Unmarshal(data, &AppForkInfo)
+	r, err := NewRegistry(forks)
 	if err != nil {
-		panic(err.Error())
+		return nil, errors.Wrap(err, "Invalid forks file")
+	}
+	r.source = path
+	r.verified = true
+	return r, nil
+}
+
+// IsActive returns true if feature is active at height
+func (r *Registry) IsActive(feature string, height int64) bool {
+	if r == nil {
+		return true
+	}
+	if f, ok := r.byFeature[feature]; ok {
+		return height >= f.EffectBlockHeight
 	}
+	return true
+}
 
-	for _, v := range AppForkInfo {
-		TagToForkInfo[v.Tag] = v
+// Forks returns the forks of the schedule, in order
+func (r *Registry) Forks() []ForkInfo {
+	if r == nil {
+		return nil
 	}
+	return append([]ForkInfo(nil), r.forks...)
 }
 
-// V1_0_2_3233 softfork version for 1.0.2.3233
-func V1_0_2_3233(blockHeight int64) bool {
-	if forkInfo, ok := TagToForkInfo["fork-block#1.0.2.3233"]; ok {
-		return blockHeight < forkInfo.EffectBlockHeight
+// Source returns where the schedule comes from
+func (r *Registry) Source() string {
+	if r == nil {
+		return "none"
 	}
+	return r.source
+}
+
+// Verified returns true if the schedule comes from a forks file with a valid
+// signature
+func (r *Registry) Verified() bool {
+	return r != nil && r.verified
+}
 
-	return false
+// Hash identifies the schedule: two nodes with the same hash activate the
+// same forks at the same heights. Descriptions are left out.
+func (r *Registry) Hash() string {
+	h := sha256.New()
+	for _, f := range r.Forks() {
+		fmt.Fprintf(h, "%s@%d\n", f.Tag, f.EffectBlockHeight)
+	}
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-// V2_1_1_16261 softfork version for 2.1.1.16261
-func V2_1_1_16261(blockHeight int64) bool {
-	if forkInfo, ok := TagToForkInfo["fork-block#2.1.1.16261"]; ok {
-		return blockHeight < forkInfo.EffectBlockHeight
+// Status returns the forks of the schedule, in order, with whether each is
+// active at height
+func (r *Registry) Status(height int64) []ForkStatus {
+	forks := r.Forks()
+	status := make([]ForkStatus, 0, len(forks))
+	for _, f := range forks {
+		status = append(status, ForkStatus{
+			ForkInfo: f,
+			Feature:  tagToFeature[f.Tag],
+			Active:   height >= f.EffectBlockHeight,
+		})
 	}
+	return status
+}
 
-	return false
+// LogSchedule logs the forks and whether they are active at height. A chain
+// without a schedule is logged as an error: every fork is active from genesis
+// on, which splits the node from a chain that activated them later.
+func (r *Registry) LogSchedule(logger log.Logger, height int64) {
+	if r.Source() == "none" {
+		logger.Error("No forks file and no default fork schedule for the chain, all forks are active from genesis")
+	}
+	logger.Info("Fork schedule", "source", r.Source(), "verified", r.Verified(), "hash", r.Hash(), "forks", len(r.Forks()))
+	for _, f := range r.Status(height) {
+		logger.Info("Fork", "tag", f.Tag, "feature", f.Feature, "effectBlockHeight", f.EffectBlockHeight,
+			"active", f.Active, "description", f.Description)
+	}
 }
@@ -0,0 +1,158 @@
+package softforks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r, err := NewRegistry([]ForkInfo{
+		{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 100},
+		{Tag: "fork-block#2.1.1.16261", EffectBlockHeight: 200},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		feature string
+		height  int64
+		active  bool
+	}{
+		{FeatureBlockRandom, 99, false},
+		{FeatureBlockRandom, 100, true},
+		{FeatureNoZeroPowerValidator, 100, false},
+		{FeatureNoZeroPowerValidator, 200, true},
+		{"unknown", 1, true},
+	}
+	for _, c := range cases {
+		if got := r.IsActive(c.feature, c.height); got != c.active {
+			t.Errorf("%s at %d: active %v", c.feature, c.height, got)
+		}
+	}
+
+	// without a schedule every feature is active
+	var none *Registry
+	if !none.IsActive(FeatureBlockRandom, 1) || len(none.Forks()) != 0 {
+		t.Error("nil registry")
+	}
+}
+
+func TestRegistryInvalid(t *testing.T) {
+	for name, forks := range map[string][]ForkInfo{
+		"unknown tag": {{Tag: "fork-block#9.9.9", EffectBlockHeight: 1}},
+		"twice": {
+			{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 1},
+			{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 2},
+		},
+		"decreasing": {
+			{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 200},
+			{Tag: "fork-block#2.1.1.16261", EffectBlockHeight: 100},
+		},
+	} {
+		if _, err := NewRegistry(forks); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "softforks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "tendermint-forks.json")
+
+	RegisterDefaults("test-chain", []ForkInfo{{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 10}})
+	defer delete(defaultForks, "test-chain")
+
+	r, err := Load(missing, "test-chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IsActive(FeatureBlockRandom, 9) || r.Verified() || r.Source() != "defaults of test-chain" {
+		t.Errorf("defaults: %+v", r)
+	}
+
+	r, err = Load(missing, "other-chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.IsActive(FeatureBlockRandom, 1) || len(r.Forks()) != 0 {
+		t.Errorf("no schedule: %+v", r)
+	}
+
+	// a forks file without its signature is refused
+	if err = ioutil.WriteFile(missing, []byte(`[]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(missing, "test-chain"); err == nil {
+		t.Error("unsigned forks file accepted")
+	}
+}
+
+func TestHashAndStatus(t *testing.T) {
+	forks := []ForkInfo{
+		{Tag: "fork-block#1.0.2.3233", EffectBlockHeight: 100, Description: "random"},
+		{Tag: "fork-block#2.1.1.16261", EffectBlockHeight: 200},
+	}
+	r, err := NewRegistry(forks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// descriptions do not change the hash, heights do
+	forks[0].Description = "other"
+	same, _ := NewRegistry(forks)
+	forks[1].EffectBlockHeight = 201
+	later, _ := NewRegistry(forks)
+	if r.Hash() != same.Hash() || r.Hash() == later.Hash() {
+		t.Errorf("hashes %s %s %s", r.Hash(), same.Hash(), later.Hash())
+	}
+	var none *Registry
+	empty, _ := NewRegistry(nil)
+	if none.Hash() != empty.Hash() {
+		t.Error("nil and empty schedules differ")
+	}
+
+	status := r.Status(150)
+	if len(status) != 2 || !status[0].Active || status[1].Active ||
+		status[0].Feature != FeatureBlockRandom || status[0].Description != "random" {
+		t.Errorf("status %+v", status)
+	}
+}
+
+func TestDefaultsMatchBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "softforks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, chainID := range []string{"bcb", "bcbtest"} {
+		data, err := ioutil.ReadFile(filepath.Join("..", "bundle", ".config", chainID, "tendermint-forks.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bundled []ForkInfo
+		if err = json.Unmarshal(data, &bundled); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(defaultForks[chainID], bundled) {
+			t.Errorf("%s: defaults %+v, bundle %+v", chainID, defaultForks[chainID], bundled)
+		}
+
+		r, err := Load(filepath.Join(dir, "tendermint-forks.json"), chainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Source() != "defaults of "+chainID || r.IsActive(FeatureBlockRandom, 0) {
+			t.Errorf("%s: %+v", chainID, r)
+		}
+	}
+}
@@ -92,9 +92,9 @@ func (e ErrNoABCITxResponseForTxHash) Error() string {
 }
 
 func (e ErrNoLastQueueHashForQueueID) Error() string {
-	return cmn.Fmt("Could not find LastQueueHash for QueueID #%d", e.QueueID)
+	return cmn.Fmt("Could not find LastQueueHash for QueueID %s", e.QueueID)
 }
 
 func (e ErrNoLastQueueHeightForQueueID) Error() string {
-	return cmn.Fmt("Could not find LastQueueHeight for QueueID #%d", e.QueueID)
+	return cmn.Fmt("Could not find LastQueueHeight for QueueID %s", e.QueueID)
 }
@@ -30,7 +30,6 @@ var (
 
 	//return: config.GenesisFile(), config.ConfigFilePath(), config.DBDir(),config.ValidatorsFile(),config.PrivValidatorFile()
 	ConfigPath    func()
-	NodeStop      func()
 	SetConfigFunc func(bool, bool, int) (*config.Config, string)
 )
 
@@ -57,6 +56,16 @@ type BlockExecutor struct {
 
 	logger log.Logger
 	cfg    config.Config
+
+	// the fork schedule of the chain, all features are active without it
+	forks *softforks.Registry
+
+	// the relay of the node, told about the blocks and the open urls in
+	// their receipts
+	relay *relay.RelayController
+
+	// asks the node to stop for a restart, see sidechain.ErrRestart
+	restart func()
 }
 
 // Modify tendermint config and configFile  by smart contract
@@ -88,6 +97,41 @@ func (blockExec *BlockExecutor) SetEventBus(eventBus types.BlockEventPublisher)
 	blockExec.eventBus = eventBus
 }
 
+// SetForks sets the fork schedule of the chain
+func (blockExec *BlockExecutor) SetForks(forks *softforks.Registry) {
+	blockExec.forks = forks
+}
+
+// Forks returns the fork schedule of the chain
+func (blockExec *BlockExecutor) Forks() *softforks.Registry {
+	return blockExec.forks
+}
+
+// SetRelay sets the relay controller of the node
+func (blockExec *BlockExecutor) SetRelay(rc *relay.RelayController) {
+	blockExec.relay = rc
+}
+
+// Relay returns the relay controller of the node, nil if it has none
+func (blockExec *BlockExecutor) Relay() *relay.RelayController {
+	return blockExec.relay
+}
+
+// SetRestart sets how the node is asked to stop when ApplyBlock returns
+// sidechain.ErrRestart. It must not wait for the node to stop.
+func (blockExec *BlockExecutor) SetRestart(restart func()) {
+	blockExec.restart = restart
+}
+
+// Restart asks the node to stop, it is started again into sidechain.Resume.
+// Without a node to stop, the process exits with sidechain.ExitCodeRestart.
+func (blockExec *BlockExecutor) Restart() {
+	if blockExec.restart == nil {
+		os.Exit(sidechain.ExitCodeRestart)
+	}
+	blockExec.restart()
+}
+
 // ValidateBlock validates the given block against the given state.
 // If the block is invalid, it returns an error.
 // Validation does not mutate state, but does require historical information from the stateDB,
@@ -112,7 +156,7 @@ func (blockExec *BlockExecutor) ApplyBlock(s State, blockID types.BlockID, block
 
 	//blockExec.logger.Info("block apply","height",block.Height,"block header apphash",block.Header.AppHash,"block proposer",block.Header.ProposerAddress)
 
-	abciResponses, err := execBlockOnProxyApp(blockExec.logger, blockExec.proxyApp, block)
+	abciResponses, err := execBlockOnProxyApp(blockExec.logger, blockExec.proxyApp, block, blockExec.relay)
 	if err != nil {
 		return s, ErrProxyAppConn(err)
 	}
@@ -128,14 +172,17 @@ func (blockExec *BlockExecutor) ApplyBlock(s State, blockID types.BlockID, block
 	filterConfigSetReceipts(abciResponses)
 
 	// update the state with the block and responses
-	s, err = updateState(s, blockID, block.Header, abciResponses, blockExec.db)
+	s, err = updateState(s, blockID, block.Header, abciResponses, blockExec.db, blockExec.forks)
 	if err != nil {
 		return s, fmt.Errorf("Commit failed for application: %v", err)
 	}
 
 	if len(abciResponses.EndBlock.SCGenesis) > 0 {
 		blockExec.logger.Debug("side chain genesis", "genesisInfo", abciResponses.EndBlock.SCGenesis)
-		sideChainGenesis(abciResponses.EndBlock.SCGenesis, blockExec)
+		if err := sideChainGenesis(abciResponses.EndBlock.SCGenesis, blockExec); err != nil {
+			// the app is not committed, the node finishes the genesis at its next boot
+			return s, err
+		}
 	}
 
 	// lock mempool, commit state, update mempoool
@@ -271,8 +318,7 @@ func makeQueueChain(db dbm.DB, abciResponses *ABCIResponses, currentHeight int64
 
 // Executes block's transactions on proxyAppConn.
 // Returns a list of transaction results and updates to the validator set
-func execBlockOnProxyApp(logger log.Logger, proxyAppConn proxy.AppConnConsensus, block *types.Block) (*ABCIResponses, error) {
-	rc := relay.GetRelayController()
+func execBlockOnProxyApp(logger log.Logger, proxyAppConn proxy.AppConnConsensus, block *types.Block, rc *relay.RelayController) (*ABCIResponses, error) {
 	if rc != nil {
 		rc.SetNewHeader(block.Header)
 	}
@@ -362,14 +408,14 @@ func execBlockOnProxyApp(logger log.Logger, proxyAppConn proxy.AppConnConsensus,
 		logger.Info("Updates to validators", "updates", abci.ValidatorsString(valUpdates))
 	}
 
-	go filterReceipts(abciResponses) // TODO 开一个线程专门解析收据
+	go filterReceipts(rc, abciResponses) // TODO 开一个线程专门解析收据
 	return abciResponses, nil
 }
 
 // If more or equal than 1/3 of total voting power changed in one block, then
 // a light client could never prove the transition externally. See
 // ./lite/doc.go for details on how a light client tracks validators.
-func updateValidators(currentSet *types.ValidatorSet, updates []abci.Validator, height int64) error {
+func updateValidators(currentSet *types.ValidatorSet, updates []abci.Validator, height int64, forks *softforks.Registry) error {
 	for _, v := range updates {
 		pubkey, err := crypto.PubKeyFromBytes(v.PubKey) // NOTE: expects go-amino encoded pubkey
 		if err != nil {
@@ -386,18 +432,11 @@ func updateValidators(currentSet *types.ValidatorSet, updates []abci.Validator,
 		_, val := currentSet.GetByAddress(address)
 		if val == nil {
 			// add val
-			if softforks.V2_1_1_16261(height) {
+			if !forks.IsActive(softforks.FeatureNoZeroPowerValidator, height) || power != 0 {
 				added := currentSet.Add(types.NewValidator(pubkey, power, v.RewardAddr, v.Name))
 				if !added {
 					return fmt.Errorf("Failed to add new validator %X with voting power %d", address, power)
 				}
-			} else {
-				if power != 0 {
-					added := currentSet.Add(types.NewValidator(pubkey, power, v.RewardAddr, v.Name))
-					if !added {
-						return fmt.Errorf("Failed to add new validator %X with voting power %d", address, power)
-					}
-				}
 			}
 		} else if v.Power == 0 {
 			// remove val
@@ -419,7 +458,7 @@ func updateValidators(currentSet *types.ValidatorSet, updates []abci.Validator,
 
 // updateState returns a new State updated according to the header and responses.
 func updateState(s State, blockID types.BlockID, header *types.Header,
-	abciResponses *ABCIResponses, db dbm.DB) (State, error) {
+	abciResponses *ABCIResponses, db dbm.DB, forks *softforks.Registry) (State, error) {
 
 	// copy the valset so we can apply changes from EndBlock
 	// and update s.LastValidators and s.Validators
@@ -429,7 +468,7 @@ func updateState(s State, blockID types.BlockID, header *types.Header,
 	// update the validator set with the latest abciResponses
 	lastHeightValsChanged := s.LastHeightValidatorsChanged
 	if len(abciResponses.EndBlock.ValidatorUpdates) > 0 {
-		err := updateValidators(nextValSet, abciResponses.EndBlock.ValidatorUpdates, header.Height)
+		err := updateValidators(nextValSet, abciResponses.EndBlock.ValidatorUpdates, header.Height, forks)
 		if err != nil {
 			return s, fmt.Errorf("Error changing validator set: %v", err)
 		}
@@ -520,9 +559,9 @@ func fireEvents(logger log.Logger, eventBus types.BlockEventPublisher, block *ty
 // Execute block without state. TODO: eliminate
 
 // ExecCommitBlock executes and commits a block on the proxyApp without validating or mutating the state.
-// It returns the application root hash (result of abci.Commit).
-func ExecCommitBlock(appConnConsensus proxy.AppConnConsensus, block *types.Block, logger log.Logger) (*abci.ResponseCommit, error) {
-	_, err := execBlockOnProxyApp(logger, appConnConsensus, block)
+// It returns the application root hash (result of abci.Commit). rc, if not nil, is told about the block.
+func ExecCommitBlock(appConnConsensus proxy.AppConnConsensus, block *types.Block, logger log.Logger, rc *relay.RelayController) (*abci.ResponseCommit, error) {
+	_, err := execBlockOnProxyApp(logger, appConnConsensus, block, rc)
 	if err != nil {
 		logger.Error("Error executing block on proxy app", "height", block.Height, "err", err)
 		return nil, err
@@ -537,7 +576,7 @@ func ExecCommitBlock(appConnConsensus proxy.AppConnConsensus, block *types.Block
 	return res, nil
 }
 
-func sideChainGenesis(genesisInfos []*abci.SideChainGenesis, blockExec *BlockExecutor) {
+func sideChainGenesis(genesisInfos []*abci.SideChainGenesis, blockExec *BlockExecutor) error {
 	genesisInfo, ok := sidechain.ContainsCurrentNode(genesisInfos)
 	if !ok {
 		for _, gInfo := range genesisInfos {
@@ -547,27 +586,31 @@ func sideChainGenesis(genesisInfos []*abci.SideChainGenesis, blockExec *BlockExe
 			}
 			delLastQueueInfo(blockExec.db, temp[0]+"->"+gInfo.SideChainID)
 		}
-		return
-	}
-	if NodeStop != nil {
-		NodeStop()
+		return nil
 	}
 
 	sc := sidechain.NewSideChain(genesisInfo)
-	err := sc.PrepareSCGenesis()
-	if err != nil {
-		panic(err)
-	}
+	// the checks are for operators before the tx takes effect, a failed one
+	// must not halt the chain here
+	if _, err := sc.Validate(); err != nil {
+		blockExec.logger.Error("Side chain genesis does not validate, applying it anyway",
+			"sideChainID", genesisInfo.SideChainID, "err", err)
+	}
+	return sc.Begin(func() error {
+		return CleanAppData(blockExec.proxyApp)
+	})
+}
 
-	response, err := blockExec.proxyApp.CleanDataSync()
+// CleanAppData asks the app to drop its data for a side chain genesis
+func CleanAppData(proxyApp proxy.AppConnConsensus) error {
+	response, err := proxyApp.CleanDataSync()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if response.Code != 200 { // todo 测试 panic
-		panic("bcchain clean data failed:" + response.Log)
+	if response.Code != 200 {
+		return errors.New("bcchain clean data failed:" + response.Log)
 	}
-
-	os.Exit(1)
+	return nil
 }
 
 // -------------------- IBC add 18 Seq. 2019------------------------
@@ -622,23 +665,59 @@ func calcQueueHash(lastQueueHash []byte, packets [][]byte) []byte {
 	return lastQueueHash
 }
 
-func filterReceipts(abciResponse *ABCIResponses) {
+func filterReceipts(rc *relay.RelayController, abciResponse *ABCIResponses) {
+	if rc == nil {
+		return
+	}
+
 	for _, deliverTx := range abciResponse.DeliverTx {
 		if deliverTx.Code == 200 {
 			chainIDToURLs, chainIDToAddrVer := getOpenURLFromReceipts(deliverTx)
 			for chainID, urls := range chainIDToURLs {
-				rc := relay.GetRelayController()
 				if ver, ok := chainIDToAddrVer[chainID]; ok {
 					rc.UpdateOpenURL(chainID, urls, ver)
 				} else {
 					rc.UpdateOpenURL(chainID, urls, 0)
 				}
 			}
+
+			for chainID, status := range getSideChainStatusFromReceipts(deliverTx) {
+				if status != "ready" && status != "clear" {
+					rc.RemoveQueue(chainID)
+				}
+			}
 		}
 	}
 }
 
-// TODO 检查侧链状态更改收据
+// getSideChainStatusFromReceipts returns the side chains whose status changed
+func getSideChainStatusFromReceipts(deliverTx *abci.ResponseDeliverTx) (chainIDToStatus map[string]string) {
+	chainIDToStatus = make(map[string]string)
+
+	for _, tag := range deliverTx.Tags {
+		if strings.HasSuffix(string(tag.Key), "/netgovernance.setStatus") {
+			var receipt relay.Receipt
+			err := jsoniter.Unmarshal(tag.Value, &receipt)
+			if err != nil {
+				continue
+			}
+
+			type setStatus struct {
+				SideChainID string `json:"sideChainID"`
+				Status      string `json:"status"`
+			}
+
+			r := new(setStatus)
+			err = jsoniter.Unmarshal(receipt.Bytes, r)
+			if err != nil {
+				continue
+			}
+			chainIDToStatus[r.SideChainID] = r.Status
+		}
+	}
+	return
+}
+
 func getOpenURLFromReceipts(deliverTx *abci.ResponseDeliverTx) (chainIDToURLs map[string][]string, chainIDToAddrVer map[string]int32) {
 	chainIDToURLs = make(map[string][]string)
 	chainIDToAddrVer = make(map[string]int32)
@@ -1,6 +1,10 @@
 package state
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,7 +15,9 @@ import (
 	abci "github.com/bcbchain/bclib/tendermint/abci/types"
 	"github.com/bcbchain/bclib/tendermint/go-crypto"
 	"github.com/bcbchain/tendermint/proxy"
+	"github.com/bcbchain/tendermint/sidechain"
 	"github.com/bcbchain/tendermint/types"
+	pvm "github.com/bcbchain/tendermint/types/priv_validator"
 	cmn "github.com/bcbchain/bclib/tendermint/tmlibs/common"
 	dbm "github.com/bcbchain/bclib/tendermint/tmlibs/db"
 	"github.com/bcbchain/bclib/tendermint/tmlibs/log"
@@ -74,8 +80,8 @@ func TestBeginBlockAbsentValidators(t *testing.T) {
 	for _, tc := range testCases {
 		lastCommit := &types.Commit{BlockID: prevBlockID, Precommits: tc.lastCommitPrecommits}
 
-		block, _ := state.MakeBlock(2, makeTxs(2), lastCommit, "", "", nil, nil)
-		_, err = ExecCommitBlock(proxyApp.Consensus(), block, log.TestingLogger())
+		block, _ := state.MakeBlock(2, makeTxs(2), lastCommit, "", "", nil, nil, nil)
+		_, err = ExecCommitBlock(proxyApp.Consensus(), block, log.TestingLogger(), nil)
 		require.Nil(t, err, tc.desc)
 
 		// -> app must receive an index of the absent validator
@@ -118,9 +124,9 @@ func TestBeginBlockByzantineValidators(t *testing.T) {
 	for _, tc := range testCases {
 		lastCommit := &types.Commit{BlockID: prevBlockID}
 
-		block, _ := state.MakeBlock(10, makeTxs(2), lastCommit, "", "", nil, nil)
+		block, _ := state.MakeBlock(10, makeTxs(2), lastCommit, "", "", nil, nil, nil)
 		block.Evidence.Evidence = tc.evidence
-		_, err = ExecCommitBlock(proxyApp.Consensus(), block, log.TestingLogger())
+		_, err = ExecCommitBlock(proxyApp.Consensus(), block, log.TestingLogger(), nil)
 		require.Nil(t, err, tc.desc)
 
 		// -> app must receive an index of the byzantine validator
@@ -150,7 +156,7 @@ func state() State {
 }
 
 func makeBlock(state State, height int64) *types.Block {
-	block, _ := state.MakeBlock(height, makeTxs(state.LastBlockHeight), new(types.Commit), "", "", nil, nil)
+	block, _ := state.MakeBlock(height, makeTxs(state.LastBlockHeight), new(types.Commit), "", "", nil, nil, nil)
 	return block
 }
 
@@ -198,3 +204,79 @@ func (app *testApp) Query(reqQuery abci.RequestQuery) (resQuery abci.ResponseQue
 func (app *testApp) QueryEx(reqQueryEx abci.RequestQueryEx) (resQuery abci.ResponseQueryEx) {
 	return
 }
+
+// scApp makes the side chain genesis of its validators at the first block
+type scApp struct {
+	testApp
+
+	genesis *abci.SideChainGenesis
+	cleaned int
+	commits int
+}
+
+func (app *scApp) BeginBlock(req abci.RequestBeginBlock) abci.ResponseBeginBlock {
+	return abci.ResponseBeginBlock{Code: abci.CodeTypeOK}
+}
+
+func (app *scApp) EndBlock(req abci.RequestEndBlock) abci.ResponseEndBlock {
+	return abci.ResponseEndBlock{SCGenesis: []*abci.SideChainGenesis{app.genesis}}
+}
+
+func (app *scApp) CleanData() abci.ResponseCleanData {
+	app.cleaned++
+	return abci.ResponseCleanData{Code: 200}
+}
+
+func (app *scApp) Commit() abci.ResponseCommit {
+	app.commits++
+	return abci.ResponseCommit{}
+}
+
+func TestApplyBlockSideChainGenesis(t *testing.T) {
+	crypto.SetChainId(chainID)
+	home, err := ioutil.TempDir("", "execution_test")
+	require.Nil(t, err)
+	defer os.RemoveAll(home)
+	config := filepath.Join(home, "config")
+	defer func(f func() (string, string, string, string, string)) { sidechain.ConfigPathFunc = f }(sidechain.ConfigPathFunc)
+	sidechain.ConfigPathFunc = func() (string, string, string, string, string) {
+		return filepath.Join(config, "genesis.json"), filepath.Join(config, "config.toml"), filepath.Join(home, "data"),
+			filepath.Join(config, "validators.json"), filepath.Join(config, "priv_validator.json")
+	}
+	require.Nil(t, os.MkdirAll(config, 0750))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config, "config.toml"), []byte("moniker = \"node\"\n"), 0600))
+	pv := pvm.GenFilePV(filepath.Join(config, "priv_validator.json"))
+	pv.Save()
+
+	// the side chain names this node as a validator
+	pubKey := pv.GetPubKey().(crypto.PubKeyEd25519)
+	app := &scApp{genesis: &abci.SideChainGenesis{
+		SideChainID: chainID + "[side]",
+		GenesisInfo: `{"chain_id":"` + chainID + `[side]"}`,
+		Validators:  []abci.Validator{{PubKey: pubKey[:], Power: 10, Name: "node"}},
+	}}
+	proxyApp := proxy.NewAppConns(proxy.NewLocalClientCreator(app), nil)
+	require.Nil(t, proxyApp.Start())
+	defer proxyApp.Stop()
+
+	state, stateDB := state(), dbm.NewMemDB()
+	blockExec := NewBlockExecutor(stateDB, stateDB, log.TestingLogger(), proxyApp.Consensus(),
+		types.MockMempool{}, types.MockEvidencePool{})
+	block := makeBlock(state, 1)
+	blockID := types.BlockID{Hash: block.Hash(), PartsHeader: block.MakePartSet(testPartSize).Header()}
+
+	// the callers stop the node on ErrRestart, the app is cleaned and not committed
+	_, err = blockExec.ApplyBlock(state, blockID, block)
+	require.True(t, errors.Is(err, sidechain.ErrRestart), "err: %v", err)
+	assert.Equal(t, 1, app.cleaned)
+	assert.Equal(t, 0, app.commits)
+	j, err := sidechain.LoadJournal()
+	require.Nil(t, err)
+	require.NotNil(t, j)
+	assert.Equal(t, sidechain.StageAppCleaned, j.Stage)
+
+	restarted := 0
+	blockExec.SetRestart(func() { restarted++ })
+	blockExec.Restart()
+	assert.Equal(t, 1, restarted)
+}
@@ -11,6 +11,7 @@ import (
 	cfg "github.com/bcbchain/tendermint/config"
 
 	abci "github.com/bcbchain/bclib/tendermint/abci/types"
+	"github.com/bcbchain/tendermint/softforks"
 	"github.com/bcbchain/tendermint/types"
 )
 
@@ -129,11 +130,11 @@ func (s State) GetValidators() (last *types.ValidatorSet, current *types.Validat
 //todo 截取apphash
 // MakeBlock builds a block with the given txs and commit from the current state.
 func (s State) MakeBlock(height int64, txs []types.Tx, commit *types.Commit, proposer crypto.Address, rewardAddr string, allocation []abci.Allocation,
-	relayer *types.Relayer) (*types.Block, *types.PartSet) {
+	relayer *types.Relayer, forks *softforks.Registry) (*types.Block, *types.PartSet) {
 	// build base block
 	//block := types.MakeBlock(height, txs, commit)
 
-	block := types.GIMakeBlock(height, txs, commit, s.LastTxsHashList, proposer, s.LastFee, rewardAddr, allocation, s.ChainVersion, s.LastMining)
+	block := types.GIMakeBlock(height, txs, commit, s.LastTxsHashList, proposer, s.LastFee, rewardAddr, allocation, s.ChainVersion, s.LastMining, forks)
 
 	// fill header with state data
 	block.ChainID = s.ChainID
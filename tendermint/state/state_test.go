@@ -222,7 +222,7 @@ func TestOneValidatorChangesSaveLoad(t *testing.T) {
 			power++
 		}
 		header, blockID, responses := makeHeaderPartsResponsesValPowerChange(state, i, int64(power))
-		state, err = updateState(state, blockID, header, responses)
+		state, err = updateState(state, blockID, header, responses, stateDB, nil)
 		assert.Nil(t, err)
 		nextHeight := state.LastBlockHeight + 1
 		saveValidatorsInfo(stateDB, nextHeight, state.LastHeightValidatorsChanged, state.Validators)
@@ -267,7 +267,7 @@ func TestManyValidatorChangesSaveLoad(t *testing.T) {
 	// swap the first validator with a new one ^^^ (validator set size stays the same)
 	header, blockID, responses := makeHeaderPartsResponsesValPubKeyChange(state, height, pubkey)
 	var err error
-	state, err = updateState(state, blockID, header, responses)
+	state, err = updateState(state, blockID, header, responses, stateDB, nil)
 	require.Nil(t, err)
 	nextHeight := state.LastBlockHeight + 1
 	saveValidatorsInfo(stateDB, nextHeight, state.LastHeightValidatorsChanged, state.Validators)
@@ -324,7 +324,7 @@ func TestConsensusParamsChangesSaveLoad(t *testing.T) {
 			cp = params[changeIndex]
 		}
 		header, blockID, responses := makeHeaderPartsResponsesParams(state, i, cp)
-		state, err = updateState(state, blockID, header, responses)
+		state, err = updateState(state, blockID, header, responses, stateDB, nil)
 
 		require.Nil(t, err)
 		nextHeight := state.LastBlockHeight + 1
@@ -50,7 +50,7 @@ func MakeBlock(height int64, txs []Tx, commit *Commit) *Block {
 //将上一次交易hashlist存入到下一个block的data中
 func GIMakeBlock(height int64, txs []Tx, commit *Commit, txHashList [][]byte,
 	proposer string, lastFee uint64, rewardAddr string, lastAllocation []types.Allocation,
-	chainVersion int64, lastMining *int64) *Block {
+	chainVersion int64, lastMining *int64, forks *softforks.Registry) *Block {
 
 	blockVersion := BlockVersion
 	block := &Block{
@@ -72,10 +72,7 @@ func GIMakeBlock(height int64, txs []Tx, commit *Commit, txHashList [][]byte,
 		},
 	}
 
-	if softforks.V1_0_2_3233(height) {
-		// old code
-	} else {
-		// new code
+	if forks.IsActive(softforks.FeatureBlockRandom, height) {
 		r := make([]byte, 32)
 		_, e := rand.Read(r)
 		if e != nil {
@@ -0,0 +1,249 @@
+package useTar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Names of the codecs known to the package. Gzip, zstd, xz, bzip2 (read
+// only) and plain tar are built in.
+const (
+	CodecGzip  = "gzip"
+	CodecBzip2 = "bzip2"
+	CodecZstd  = "zstd"
+	CodecXz    = "xz"
+	CodecNone  = "tar"
+)
+
+// ErrUnknownFormat is returned when the compression of a stream is not
+// recognised by any registered codec.
+var ErrUnknownFormat = errors.New("useTar: unknown archive format")
+
+// Codec compresses the tar stream written by TarGzTo and decompresses the one
+// read by UnTarGzFrom.
+type Codec struct {
+	// Name selects the codec in Options.Codec.
+	Name string
+
+	// Magic starts every stream of this format, it is used for detection.
+	Magic []byte
+
+	// NewWriter compresses to w at the given level, 0 meaning the codec's
+	// default. It is nil for codecs that can only be read.
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+
+	// NewReader decompresses r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMtx sync.RWMutex
+	codecs    = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(Codec{
+		Name:  CodecGzip,
+		Magic: []byte{0x1f, 0x8b},
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			gw, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+			// these are the defaults today, pin them since archive hashes depend on them
+			gw.Header = gzip.Header{OS: 255}
+			return gw, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	RegisterCodec(Codec{
+		Name:  CodecBzip2,
+		Magic: []byte("BZh"),
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		},
+	})
+	RegisterCodec(Codec{
+		Name:  CodecZstd,
+		Magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			// levels as the zstd command line has them, 1 to 22
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zstdReadCloser{zr}, nil
+		},
+	})
+	RegisterCodec(Codec{
+		Name:  CodecXz,
+		Magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level < 0 || level >= len(xzDictCaps) {
+				return nil, fmt.Errorf("useTar: invalid xz level %d", level)
+			}
+			return xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(xr), nil
+		},
+	})
+	RegisterCodec(Codec{
+		Name: CodecNone,
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	})
+}
+
+// RegisterCodec adds c to the registry, replacing any codec of the same name.
+func RegisterCodec(c Codec) {
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+	codecs[c.Name] = c
+}
+
+// LookupCodec returns the codec registered under name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// newCompressor opens the codec selected by opts on w, gzip by default.
+func newCompressor(w io.Writer, opts Options) (io.WriteCloser, error) {
+	name := opts.Codec
+	if name == "" {
+		name = CodecGzip
+	}
+	c, ok := LookupCodec(name)
+	if !ok {
+		return nil, fmt.Errorf("useTar: unknown codec %q", name)
+	}
+	if c.NewWriter == nil {
+		return nil, fmt.Errorf("useTar: codec %q can not compress, register an implementation with RegisterCodec", name)
+	}
+	if name == CodecGzip && opts.Workers > 1 {
+		return newParallelGzipWriter(w, opts.Level, opts.Workers, opts.BlockSize)
+	}
+	return c.NewWriter(w, opts.Level)
+}
+
+// newDecompressor opens the codec named name on r, or the one matching the
+// first bytes of r if name is empty.
+func newDecompressor(r io.Reader, name string) (io.ReadCloser, error) {
+	var c Codec
+	if name == "" {
+		br := bufio.NewReader(r)
+		var err error
+		if c, err = detectCodec(br); err != nil {
+			return nil, err
+		}
+		r = br
+	} else {
+		var ok bool
+		if c, ok = LookupCodec(name); !ok {
+			return nil, fmt.Errorf("useTar: unknown codec %q", name)
+		}
+	}
+	if c.NewReader == nil {
+		return nil, fmt.Errorf("useTar: codec %q can not decompress, register an implementation with RegisterCodec", c.Name)
+	}
+	return c.NewReader(r)
+}
+
+// detectCodec picks the codec whose magic starts br, the longest magic
+// winning. A stream without known magic is taken as plain tar if it carries
+// the ustar signature or is an empty archive.
+func detectCodec(br *bufio.Reader) (Codec, error) {
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		return Codec{}, err
+	}
+
+	codecsMtx.RLock()
+	candidates := make([]Codec, 0, len(codecs))
+	for _, c := range codecs {
+		if len(c.Magic) > 0 {
+			candidates = append(candidates, c)
+		}
+	}
+	codecsMtx.RUnlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		return len(candidates[i].Magic) > len(candidates[j].Magic)
+	})
+
+	for _, c := range candidates {
+		if bytes.HasPrefix(head, c.Magic) {
+			return c, nil
+		}
+	}
+	if isTar(head) {
+		if c, ok := LookupCodec(CodecNone); ok {
+			return c, nil
+		}
+	}
+	return Codec{}, ErrUnknownFormat
+}
+
+// isTar reports whether head is the start of an uncompressed tar stream.
+func isTar(head []byte) bool {
+	if len(head) < 512 {
+		return false
+	}
+	if bytes.HasPrefix(head[257:], []byte("ustar")) {
+		return true
+	}
+	// an empty archive is just zero blocks
+	return bytes.Count(head, []byte{0}) == len(head)
+}
+
+// xzDictCaps are the dictionary sizes of the xz presets 1 to 9, the level
+// of the xz codec; 0 keeps the default of the xz package.
+var xzDictCaps = []int{0, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// zstdReadCloser releases the goroutines of a zstd decoder on Close.
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
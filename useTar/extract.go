@@ -0,0 +1,387 @@
+package useTar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractor creates the entries of a tar stream below root. A safe extractor
+// refuses entries that would escape root and enforces limits; an unsafe one
+// trusts entry names as UnTarGz always did.
+type extractor struct {
+	root     string
+	realRoot string
+	safe     bool
+	opts     Options
+
+	entries int
+	total   int64
+	dirs    []*tar.Header // directory metadata, applied once their content is written
+	links   []*tar.Header // symlinks created, checked again once all entries are written
+
+	// the manifest at the start of the archive, verified if opts has trusted
+	// keys, and what ApplyChain expects of it
+	manifest        map[string]ManifestEntry
+	seen            map[string]bool
+	deleted         []string
+	incremental     bool
+	manifestSum     string
+	requireManifest bool
+	expectBase      string
+}
+
+func newExtractor(dst string, safe bool, opts Options) (*extractor, error) {
+	x := &extractor{root: dst, safe: safe, opts: opts}
+	if !safe {
+		return x, nil
+	}
+
+	root, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0750); err != nil {
+		return nil, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	x.root, x.realRoot = root, realRoot
+	return x, nil
+}
+
+// unpack extracts a compressed tar stream.
+func (x *extractor) unpack(r io.Reader) (err error) {
+	cr, err := newDecompressor(r, x.opts.Codec)
+	if err != nil {
+		return err
+	}
+	if x.opts.Workers > 1 {
+		cr = newReadAhead(cr, x.opts.Workers, x.opts.BlockSize)
+	}
+	defer func() {
+		if e := cr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	return x.run(tar.NewReader(cr))
+}
+
+// run loops over the tar stream until its end.
+func (x *extractor) run(tr *tar.Reader) error {
+	// the manifest comes first, nothing is written before it is checked
+	pending, err := x.readManifest(tr)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header := pending
+		pending = nil
+		err = nil
+		if header == nil {
+			header, err = tr.Next()
+		}
+
+		switch {
+
+		// if no more files are found return
+		case err == io.EOF:
+			if x.manifest != nil {
+				if err := x.checkComplete(); err != nil {
+					return err
+				}
+				if err := x.deleteRemoved(); err != nil {
+					return err
+				}
+			}
+			return x.finish()
+
+		// return any other error
+		case err != nil:
+			return err
+
+		// if the header is nil, just skip it (not sure how this happens)
+		case header == nil:
+			continue
+		}
+
+		var sum string
+		if x.manifest != nil {
+			want, err := x.checkEntry(header)
+			if err != nil {
+				return err
+			}
+			sum = want.SHA256
+		}
+
+		if x.opts.StripComponents > 0 {
+			if header = stripComponents(header, x.opts.StripComponents); header == nil {
+				continue
+			}
+		}
+		if !x.opts.keep(header.Name, header.Typeflag == tar.TypeDir) {
+			continue
+		}
+		if err := x.extract(tr, header, sum); err != nil {
+			return err
+		}
+		x.opts.progress(header)
+	}
+}
+
+// extract creates a single entry, tr is positioned on its content. A regular
+// file is only put in place if its content has the digest sum, when given.
+func (x *extractor) extract(tr io.Reader, header *tar.Header, sum string) error {
+	var size int64
+	if header.Typeflag == tar.TypeReg {
+		size = header.Size
+	}
+
+	// the target location where the dir/file should be created
+	target := filepath.Join(x.root, header.Name)
+	if x.safe {
+		if err := x.account(header.Name, size); err != nil {
+			return err
+		}
+		var err error
+		if target, err = x.safeTarget(header.Name); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+	if x.incremental {
+		if err := replaceType(target, header); err != nil {
+			return err
+		}
+	}
+
+	// check the file type
+	switch header.Typeflag {
+
+	// if its a dir and it doesn't exist create it, its mode and times are set
+	// at the end, otherwise a read-only dir could not be filled. A symlink
+	// where the dir goes is replaced, its metadata would land on what it
+	// points to.
+	case tar.TypeDir:
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if _, err := os.Lstat(target); err != nil {
+			if err := os.MkdirAll(target, 0750); err != nil {
+				return err
+			}
+		}
+		x.dirs = append(x.dirs, header)
+		return nil
+
+	// if it's a file create it, truncating whatever was there before but never
+	// writing through a symlink that happens to sit where the file goes
+	case tar.TypeReg:
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if sum != "" {
+			if err := x.writeChecked(target, tr, header, sum); err != nil {
+				return err
+			}
+			break
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.FileInfo().Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		// copy over contents
+		if _, err = io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+
+		// manually close here after each file operation; defering would cause each file close
+		// to wait until all operations have completed.
+		if err = f.Close(); err != nil {
+			return err
+		}
+
+	case tar.TypeSymlink:
+		if x.safe {
+			if err := x.checkSymlink(header.Name, target, header.Linkname); err != nil {
+				return err
+			}
+		}
+		if err := removeIfExists(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+		if x.safe {
+			x.links = append(x.links, header)
+		}
+		// the mode and times of a symlink itself can't be set portably
+		return x.chown(target, header)
+
+	case tar.TypeLink:
+		source := filepath.Join(x.root, header.Linkname)
+		if x.safe {
+			var err error
+			if source, err = x.checkHardlink(header.Name, header.Linkname); err != nil {
+				return err
+			}
+		}
+		if err := removeIfExists(target); err != nil {
+			return err
+		}
+		// a hard link shares the metadata of the file it points to
+		return os.Link(source, target)
+
+	default:
+		return nil
+	}
+	return x.setMeta(target, header)
+}
+
+// writeChecked writes a file next to target and only renames it into place
+// once its content is known to have the digest sum.
+func (x *extractor) writeChecked(target string, r io.Reader, header *tar.Header, sum string) error {
+	f, err := ioutil.TempFile(filepath.Dir(target), ".useTar-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != sum {
+		return &ArchiveError{Name: header.Name, Err: ErrManifestMismatch}
+	}
+	return os.Rename(f.Name(), target)
+}
+
+// finish checks the symlinks again, now that every path they go through is
+// in place, then applies directory metadata, deepest first so that setting
+// the mtime of a parent is not undone by touching its children.
+func (x *extractor) finish() error {
+	if err := x.recheckLinks(); err != nil {
+		return err
+	}
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		header := x.dirs[i]
+		target := filepath.Join(x.root, header.Name)
+		// a later entry may have put a link where the dir was
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return &ArchiveError{Name: header.Name, Err: ErrUnsafeLink}
+		}
+		if x.safe {
+			if target, err = x.safeTarget(header.Name); err != nil {
+				return err
+			}
+		}
+		if err := x.setMeta(target, header); err != nil {
+			return err
+		}
+	}
+	x.dirs = nil
+	return nil
+}
+
+// setMeta restores ownership, permissions and times of a file or directory.
+func (x *extractor) setMeta(target string, header *tar.Header) error {
+	if err := x.chown(target, header); err != nil {
+		return err
+	}
+	// chmod after chown, which may clear the setuid and setgid bits
+	if err := os.Chmod(target, header.FileInfo().Mode()&modeBits); err != nil {
+		return err
+	}
+	mtime := header.ModTime
+	if mtime.IsZero() {
+		return nil
+	}
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = mtime
+	}
+	return os.Chtimes(target, atime, mtime)
+}
+
+// chown restores the owner when the extractor is asked to.
+func (x *extractor) chown(target string, header *tar.Header) error {
+	if !x.opts.PreserveOwner {
+		return nil
+	}
+	return os.Lchown(target, header.Uid, header.Gid)
+}
+
+// modeBits are the bits of a FileMode that chmod understands.
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// stripComponents returns a copy of header with the first n elements of its
+// name removed, or nil when nothing is left of it. Hard link targets are
+// stripped alike since they are archive paths too.
+func stripComponents(header *tar.Header, n int) *tar.Header {
+	strip := func(name string) string {
+		parts := strings.Split(cleanName(name), "/")
+		if len(parts) <= n {
+			return ""
+		}
+		return strings.Join(parts[n:], "/")
+	}
+
+	h := *header
+	if h.Name = strip(header.Name); h.Name == "" {
+		return nil
+	}
+	if h.Typeflag == tar.TypeLink {
+		if h.Linkname = strip(header.Linkname); h.Linkname == "" {
+			return nil
+		}
+	}
+	return &h
+}
+
+// replaceType removes what is at target when an incremental archive changes
+// a directory into something else or the other way round.
+func replaceType(target string, header *tar.Header) error {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() == (header.Typeflag == tar.TypeDir) {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+// removeIfExists deletes whatever is at path so that a link can take its place.
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
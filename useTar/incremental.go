@@ -0,0 +1,93 @@
+package useTar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ApplyChain extracts a full archive followed by incremental archives made
+// with Options.Base, in order, leaving dst as the source was when the last one
+// was made. Every archive must carry a manifest, and each incremental one must
+// be based on the manifest of the archive before it, which is checked before
+// anything of it is written. Files listed as deleted are removed.
+func ApplyChain(dst string, archives []io.Reader, opts Options) error {
+	var prev string
+	for _, r := range archives {
+		x, err := newExtractor(dst, true, opts)
+		if err != nil {
+			return err
+		}
+		x.requireManifest = true
+		x.expectBase = prev
+		if err := x.unpack(r); err != nil {
+			return err
+		}
+		prev = x.manifestSum
+	}
+	return nil
+}
+
+// deleteRemoved removes the paths an incremental archive lists as deleted.
+func (x *extractor) deleteRemoved() error {
+	for _, name := range x.deleted {
+		target := filepath.Join(x.root, name)
+		if x.safe {
+			var err error
+			if target, err = x.safeTarget(name); err != nil {
+				return err
+			}
+		}
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchanged reports whether the entry described by hdr is as in the base
+// snapshot, in which case it is recorded in the manifest but not written.
+// Entries are compared by type, size, mtime, mode and owner; in deterministic
+// mode, where mtimes are all the same, the content of regular files is hashed
+// instead.
+// Hard links are always written, the file they share may have been replaced.
+func (a *archiver) unchanged(hdr *tar.Header, srcFile string) (bool, error) {
+	if a.base == nil || hdr.Typeflag == tar.TypeLink {
+		return false, nil
+	}
+	e := manifestEntry(hdr, "")
+	b, ok := a.base[e.Path]
+	if !ok || b.Type != e.Type || b.Size != e.Size || b.ModTime != e.ModTime || b.Linkname != e.Linkname ||
+		b.Mode != e.Mode || b.Uid != e.Uid || b.Gid != e.Gid {
+		return false, nil
+	}
+	if e.Type == EntryFile && e.ModTime == 0 {
+		sum, err := fileSum(srcFile)
+		if err != nil {
+			return false, err
+		}
+		if sum != b.SHA256 {
+			return false, nil
+		}
+	}
+	b.Unchanged = true
+	return true, a.recordEntry(b)
+}
+
+// fileSum returns the hex encoded SHA-256 of a file.
+func fileSum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
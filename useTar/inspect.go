@@ -0,0 +1,140 @@
+package useTar
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FileDigest is the SHA-256 of a regular file found by Verify.
+type FileDigest struct {
+	Name   string
+	Size   int64
+	SHA256 string // hex encoded
+}
+
+// VerifyReport describes an archive that Verify read to the end without error.
+type VerifyReport struct {
+	Entries int          // entries of any type
+	Size    int64        // sum of the regular file sizes
+	Files   []FileDigest // regular files, in archive order
+}
+
+// List returns the header of every entry of the archive r, in archive order.
+// The compression is detected as by UnTarGzFrom.
+func List(r io.Reader) ([]*tar.Header, error) {
+	tr, closer, err := openTar(r)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var headers []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return headers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+}
+
+// ExtractFile returns the content of the regular file called name, "./" and
+// trailing slashes ignored. The returned reader reads from r, so r must not be
+// used until it is drained, and must be closed to release the decompressor.
+// An error wrapping os.ErrNotExist is returned when there is no such file.
+func ExtractFile(r io.Reader, name string) (io.ReadCloser, error) {
+	tr, cr, err := openTar(r)
+	if err != nil {
+		return nil, err
+	}
+
+	want := cleanName(name)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			cr.Close()
+			return nil, &os.PathError{Op: "extract", Path: name, Err: os.ErrNotExist}
+		}
+		if err != nil {
+			cr.Close()
+			return nil, err
+		}
+		if cleanName(header.Name) != want {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			cr.Close()
+			return nil, fmt.Errorf("useTar: %s: not a regular file", name)
+		}
+		return memberReader{tr, cr}, nil
+	}
+}
+
+// memberReader reads a member of an archive and closes its decompressor.
+type memberReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Verify reads the whole archive r, checking the tar headers and the checksums
+// of the compression layer, and digests every regular file. Nothing is written
+// to disk, so a downloaded archive can be checked before it is used.
+func Verify(r io.Reader) (*VerifyReport, error) {
+	tr, cr, err := openTar(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	report := new(VerifyReport)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Entries++
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return nil, err
+		}
+		report.Size += n
+		report.Files = append(report.Files, FileDigest{
+			Name:   header.Name,
+			Size:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	// the tar reader stops at the end-of-archive marker, read on so that the
+	// decompressor reaches its trailer and checks it
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// openTar detects the compression of r and returns a tar reader on it, along
+// with the decompressor.
+func openTar(r io.Reader) (*tar.Reader, io.ReadCloser, error) {
+	cr, err := newDecompressor(r, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return tar.NewReader(cr), cr, nil
+}
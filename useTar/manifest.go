@@ -0,0 +1,398 @@
+package useTar
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the manifest entries, which come first in an archive made with
+// Options.Manifest or Options.SignKey. The signature file has the format of
+// bclib's sig.Sign2File, so sig.VerifyTextFile accepts the extracted pair.
+const (
+	ManifestName    = ".manifest.json"
+	ManifestSigName = ".manifest.json.sig"
+)
+
+// Errors reported when an archive does not match its manifest or the manifest
+// is not signed by a trusted key. Like the other archive errors they come
+// wrapped in an *ArchiveError.
+var (
+	ErrNoManifest       = errors.New("archive has no signed manifest")
+	ErrBadSignature     = errors.New("manifest signature is invalid")
+	ErrUntrustedKey     = errors.New("manifest is signed by an untrusted key")
+	ErrManifestMismatch = errors.New("entry does not match the manifest")
+	ErrChainOrder       = errors.New("archive is not based on the previous one")
+)
+
+// maxManifestSize bounds what is read into memory for the manifest entries.
+const maxManifestSize = 64 << 20
+
+// Types of manifest entries.
+const (
+	EntryDir     = "dir"
+	EntryFile    = "file"
+	EntrySymlink = "symlink"
+	EntryLink    = "link"
+)
+
+// ManifestEntry describes one entry of an archive.
+type ManifestEntry struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Size     int64  `json:"size,omitempty"`
+	ModTime  int64  `json:"mtime,omitempty"` // Unix seconds
+	SHA256   string `json:"sha256,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+
+	// Mode holds the permission, setuid, setgid and sticky bits, as in the
+	// tar header. Uid and Gid are the numeric owner.
+	Mode int64 `json:"mode"`
+	Uid  int   `json:"uid"`
+	Gid  int   `json:"gid"`
+
+	// Unchanged entries of an incremental archive are not stored in it, they
+	// are as in the base snapshot.
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+// Manifest lists every entry of an archive, in archive order. The manifest of
+// an incremental archive describes the whole tree, so that it can be the base
+// of the next one.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+
+	// Base is the Sum of the manifest an incremental archive was made against,
+	// and Deleted lists the paths of the base that no longer exist.
+	Base    string   `json:"base,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// ManifestSig is the signature of a manifest.
+type ManifestSig struct {
+	PubKey    string `json:"pubkey"`
+	Signature string `json:"signature"`
+}
+
+// BuildManifest lists what TarGzTo would archive from src with opts, for a
+// manifest shipped alongside the archive rather than inside it.
+func BuildManifest(src string, opts Options) (*Manifest, error) {
+	opts.Progress = nil
+	a := newArchiver(tar.NewWriter(ioutil.Discard), opts)
+	a.manifest = new(Manifest)
+	if err := a.tarGzRoot(src); err != nil {
+		return nil, err
+	}
+	if opts.Base == nil {
+		return a.manifest, nil
+	}
+
+	sum, err := opts.Base.Sum()
+	if err != nil {
+		return nil, err
+	}
+	a.manifest.Base = sum
+	current := a.manifest.index()
+	for _, e := range opts.Base.Entries {
+		if _, ok := current[e.Path]; !ok {
+			a.manifest.Deleted = append(a.manifest.Deleted, e.Path)
+		}
+	}
+	sort.Strings(a.manifest.Deleted)
+	return a.manifest, nil
+}
+
+// ReadManifest returns the manifest stored at the start of the archive r,
+// typically to use it as Options.Base for the next incremental archive. The
+// signature, if any, is not checked.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	tr, cr, err := openTar(r)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	header, err := tr.Next()
+	if err == io.EOF || err == nil && cleanName(header.Name) != ManifestName {
+		return nil, &ArchiveError{Name: ManifestName, Err: ErrNoManifest}
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := readManifestData(tr, ManifestName)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, &ArchiveError{Name: ManifestName, Err: err}
+	}
+	return m, nil
+}
+
+// Marshal returns the JSON form of the manifest, which is what gets signed.
+func (m *Manifest) Marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// Sum is the hex encoded SHA-256 of the marshalled manifest, which identifies
+// the base of an incremental archive.
+func (m *Manifest) Sum() (string, error) {
+	data, err := m.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return sha256Hex(data), nil
+}
+
+// SignManifest signs the marshalled manifest data with key and returns the
+// content of the signature file.
+func SignManifest(data []byte, key ed25519.PrivateKey) ([]byte, error) {
+	pub := key.Public().(ed25519.PublicKey)
+	return json.MarshalIndent(ManifestSig{
+		PubKey:    hex.EncodeToString(pub),
+		Signature: strings.ToUpper(hex.EncodeToString(ed25519.Sign(key, data))),
+	}, "", "  ")
+}
+
+// VerifyManifest checks that sigData is a signature of data by one of the
+// trusted keys and returns the parsed manifest.
+func VerifyManifest(data, sigData []byte, trusted []ed25519.PublicKey) (*Manifest, error) {
+	si := new(ManifestSig)
+	if err := json.Unmarshal(sigData, si); err != nil {
+		return nil, &ArchiveError{Name: ManifestSigName, Err: ErrBadSignature}
+	}
+	pub, err := hex.DecodeString(si.PubKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, &ArchiveError{Name: ManifestSigName, Err: ErrBadSignature}
+	}
+	signature, err := hex.DecodeString(si.Signature)
+	if err != nil {
+		return nil, &ArchiveError{Name: ManifestSigName, Err: ErrBadSignature}
+	}
+
+	isTrusted := false
+	for _, key := range trusted {
+		if bytes.Equal(key, pub) {
+			isTrusted = true
+			break
+		}
+	}
+	if !isTrusted {
+		return nil, &ArchiveError{Name: ManifestSigName, Err: ErrUntrustedKey}
+	}
+	if !ed25519.Verify(pub, data, signature) {
+		return nil, &ArchiveError{Name: ManifestSigName, Err: ErrBadSignature}
+	}
+
+	m := new(Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, &ArchiveError{Name: ManifestName, Err: err}
+	}
+	return m, nil
+}
+
+// index maps the cleaned path of every entry to its description.
+func (m *Manifest) index() map[string]ManifestEntry {
+	idx := make(map[string]ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		idx[e.Path] = e
+	}
+	return idx
+}
+
+// manifestEntry describes hdr, whose content has the given digest.
+func manifestEntry(hdr *tar.Header, sum string) ManifestEntry {
+	e := ManifestEntry{
+		Path: cleanName(hdr.Name),
+		Mode: hdr.Mode & 07777,
+		Uid:  hdr.Uid,
+		Gid:  hdr.Gid,
+	}
+	if !hdr.ModTime.IsZero() {
+		// as the tar writer rounds it
+		e.ModTime = hdr.ModTime.Round(time.Second).Unix()
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		e.Type = EntryDir
+	case tar.TypeSymlink:
+		e.Type, e.Linkname = EntrySymlink, hdr.Linkname
+	case tar.TypeLink:
+		e.Type, e.Linkname = EntryLink, cleanName(hdr.Linkname)
+	default:
+		e.Type, e.Size, e.SHA256 = EntryFile, hdr.Size, sum
+	}
+	return e
+}
+
+// sha256Hex returns the hex encoded SHA-256 of data.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeManifest writes the manifest, and its signature if opts has a key, as
+// the first entries of tw.
+func writeManifest(tw *tar.Writer, m *Manifest, opts Options) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := writeMemFile(tw, ManifestName, data, opts); err != nil {
+		return err
+	}
+	if opts.SignKey == nil {
+		return nil
+	}
+	sigData, err := SignManifest(data, opts.SignKey)
+	if err != nil {
+		return err
+	}
+	return writeMemFile(tw, ManifestSigName, sigData, opts)
+}
+
+// writeMemFile writes a regular file held in memory.
+func writeMemFile(tw *tar.Writer, name string, data []byte, opts Options) error {
+	mtime := time.Now()
+	if opts.Deterministic {
+		mtime = deterministicTime
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  mtime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readManifest reads the manifest entries at the start of tr, verifying the
+// signature when opts has trusted keys, and returns the first header that
+// follows them. An archive without manifest is refused if it needs one.
+func (x *extractor) readManifest(tr *tar.Reader) (*tar.Header, error) {
+	required := x.requireManifest || len(x.opts.TrustedKeys) > 0
+
+	header, err := tr.Next()
+	if err == io.EOF || err == nil && cleanName(header.Name) != ManifestName {
+		if required {
+			return nil, &ArchiveError{Name: ManifestName, Err: ErrNoManifest}
+		}
+		return header, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := readManifestData(tr, ManifestName)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigData []byte
+	header, err = tr.Next()
+	if err == nil && cleanName(header.Name) == ManifestSigName {
+		if sigData, err = readManifestData(tr, ManifestSigName); err != nil {
+			return nil, err
+		}
+		header, err = tr.Next()
+	}
+	if err == io.EOF {
+		header = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := new(Manifest)
+	if len(x.opts.TrustedKeys) > 0 {
+		if sigData == nil {
+			return nil, &ArchiveError{Name: ManifestSigName, Err: ErrNoManifest}
+		}
+		if m, err = VerifyManifest(data, sigData, x.opts.TrustedKeys); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(data, m); err != nil {
+		return nil, &ArchiveError{Name: ManifestName, Err: err}
+	}
+	if x.expectBase != "" && m.Base != x.expectBase {
+		return nil, &ArchiveError{Name: ManifestName, Err: ErrChainOrder}
+	}
+	x.manifest = m.index()
+	x.seen = make(map[string]bool, len(x.manifest))
+	x.deleted = m.Deleted
+	x.incremental = m.Base != ""
+	x.manifestSum = sha256Hex(data)
+
+	if !x.opts.KeepManifest {
+		return header, nil
+	}
+	// the unsafe extractor has not created dst yet
+	if err := os.MkdirAll(x.root, 0750); err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{ManifestName: data}
+	if sigData != nil {
+		files[ManifestSigName] = sigData
+	}
+	for name, b := range files {
+		target := filepath.Join(x.root, name)
+		if err := removeIfExists(target); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(target, b, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// readManifestData reads a manifest entry into memory.
+func readManifestData(r io.Reader, name string) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxManifestSize {
+		return nil, &ArchiveError{Name: name, Err: ErrFileTooLarge}
+	}
+	return b, nil
+}
+
+// checkEntry refuses an entry that the manifest does not list as it is, down
+// to its mode and owner. The digest of a regular file is checked once its
+// content is written.
+func (x *extractor) checkEntry(header *tar.Header) (ManifestEntry, error) {
+	name := cleanName(header.Name)
+	want, ok := x.manifest[name]
+	got := manifestEntry(header, want.SHA256)
+	if !ok || x.seen[name] || want.Unchanged || got != want {
+		return want, &ArchiveError{Name: header.Name, Err: ErrManifestMismatch}
+	}
+	x.seen[name] = true
+	return want, nil
+}
+
+// checkComplete refuses an archive missing some of its manifest entries.
+func (x *extractor) checkComplete() error {
+	for name, e := range x.manifest {
+		if !x.seen[name] && !e.Unchanged {
+			return &ArchiveError{Name: name, Err: ErrManifestMismatch}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package useTar
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"path"
+	"strings"
+)
+
+// Options controls TarGzTo and UnTarGzFrom. The zero value archives the content
+// of a directory without the directory itself, and extracts without limits.
+type Options struct {
+	// IncludeRoot stores the source directory itself as the top entry, as flag 1
+	// of TarGz does. A single source file is always stored under its base name.
+	IncludeRoot bool
+
+	// RootName, when set, is the archive path of the source in place of its
+	// base name, such as the b/c of tar -C a b/c. It implies IncludeRoot.
+	RootName string
+
+	// Include and Exclude are path.Match patterns, tried against the archive
+	// path of an entry and against its base name. An entry is kept when it
+	// matches no Exclude pattern and, unless it is a directory, matches one of
+	// the Include patterns or Include is empty. An excluded directory is skipped
+	// with everything below it.
+	Include []string
+	Exclude []string
+
+	// FollowSymlinks archives what symlinks point to instead of the links.
+	FollowSymlinks bool
+
+	// Codec names the compression, see RegisterCodec. When archiving it
+	// defaults to gzip, when extracting the format is detected from the data.
+	Codec string
+
+	// Level is the compression level of the codec, 0 selects its default.
+	Level int
+
+	// Workers above 1 compresses gzip archives on that many goroutines, in
+	// independent blocks of BlockSize bytes that still form one gzip stream,
+	// and reads the next file of a directory while the current one is written.
+	// On extraction it decompresses ahead of the file writes, keeping up to
+	// Workers blocks ready. BlockSize defaults to DefaultBlockSize.
+	Workers   int
+	BlockSize int
+
+	// Deterministic makes the archive depend only on the content of the files:
+	// entries are sorted, mtimes are set to the Unix epoch, owners are cleared,
+	// permissions are reduced to 0644 or 0755, and the gzip header is fixed.
+	// Archives of the same tree made on different nodes are then bit-identical
+	// for a given Level.
+	Deterministic bool
+
+	// Progress, when set, is called with the header of every entry written to
+	// or extracted from the archive.
+	Progress func(hdr *tar.Header)
+
+	// StripComponents drops that many leading elements from entry names on
+	// extraction, as tar --strip-components does. Shorter entries are skipped.
+	StripComponents int
+
+	// Limits bounds what extraction may write.
+	Limits Limits
+
+	// PreserveOwner restores the uid and gid of entries on extraction.
+	PreserveOwner bool
+
+	// Manifest stores a list of every entry with its SHA-256 as the first entry
+	// of the archive. SignKey, an ed25519 key such as the one of the node's
+	// priv_validator loaded by LoadPrivValidatorKey, implies Manifest and adds
+	// a signature of it.
+	Manifest bool
+	SignKey  ed25519.PrivateKey
+
+	// Base makes an incremental archive: entries whose type, size and mtime
+	// are as in this manifest of a previous snapshot are left out, and the
+	// paths it lists that are gone are recorded as deleted. Base implies
+	// Manifest. Use ApplyChain to restore from such archives.
+	Base *Manifest
+
+	// TrustedKeys makes extraction require a manifest signed by one of them.
+	// The signature is checked before anything is written, and every entry
+	// must then match the manifest.
+	TrustedKeys []ed25519.PublicKey
+
+	// KeepManifest writes the manifest entries of the archive into the
+	// destination, where sig.VerifyTextFile accepts the pair. Otherwise they
+	// are only checked, and the destination gets nothing but the entries.
+	KeepManifest bool
+}
+
+// keep reports whether an entry passes the Include and Exclude patterns.
+func (o *Options) keep(name string, isDir bool) bool {
+	name = cleanName(name)
+	if name == "" {
+		return true
+	}
+	// an entry below an excluded directory is excluded too
+	for p := name; p != "."; p = path.Dir(p) {
+		if matchAny(o.Exclude, p) {
+			return false
+		}
+	}
+	if isDir || len(o.Include) == 0 {
+		return true
+	}
+	return matchAny(o.Include, name)
+}
+
+// progress reports an entry to the Progress callback, if any.
+func (o *Options) progress(hdr *tar.Header) {
+	if o.Progress != nil {
+		o.Progress(hdr)
+	}
+}
+
+// matchAny reports whether name or its base name matches one of patterns.
+func matchAny(patterns []string, name string) bool {
+	base := path.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanName turns an entry name such as "./a/b/" into "a/b".
+func cleanName(name string) string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	return strings.TrimPrefix(name, "/")
+}
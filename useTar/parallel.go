@@ -0,0 +1,320 @@
+package useTar
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// DefaultBlockSize is the amount of data compressed or read ahead as one unit
+// when Options.Workers asks for parallelism.
+const DefaultBlockSize = 1 << 20
+
+// parallelGzipWriter compresses blocks of its input on several goroutines, the
+// way pigz does. Every block becomes a complete gzip member, and a sequence of
+// members is itself a valid gzip stream (RFC 1952, section 2.2), so the output
+// is read by gzip -d and tar xzf like any other. The output depends on the
+// block size but not on the number of workers.
+type parallelGzipWriter struct {
+	level     int
+	blockSize int
+	buf       []byte
+	blocks    int
+
+	pending chan chan []byte // compressed blocks, in input order
+	sem     chan struct{}    // bounds the blocks being compressed
+	done    chan struct{}    // closed when the output goroutine returns
+
+	mtx sync.Mutex
+	err error
+}
+
+func newParallelGzipWriter(w io.Writer, level, workers, blockSize int) (*parallelGzipWriter, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	// fail early on a bad level rather than in a worker
+	if _, err := gzip.NewWriterLevel(nil, level); err != nil {
+		return nil, err
+	}
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	pw := &parallelGzipWriter{
+		level:     level,
+		blockSize: blockSize,
+		buf:       make([]byte, 0, blockSize),
+		pending:   make(chan chan []byte, workers),
+		sem:       make(chan struct{}, workers),
+		done:      make(chan struct{}),
+	}
+	go pw.output(w)
+	return pw, nil
+}
+
+// Write buffers p and hands every full block to a worker.
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := pw.getErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := pw.blockSize - len(pw.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		pw.buf = append(pw.buf, p[:room]...)
+		p = p[room:]
+		if len(pw.buf) == pw.blockSize {
+			pw.flush()
+		}
+	}
+	return n, nil
+}
+
+// Close compresses what is left and waits until everything is written. The
+// underlying writer is not closed.
+func (pw *parallelGzipWriter) Close() error {
+	// an empty input still needs one member to be a gzip stream
+	if len(pw.buf) > 0 || pw.blocks == 0 {
+		pw.flush()
+	}
+	close(pw.pending)
+	<-pw.done
+	return pw.getErr()
+}
+
+// abort stops the output goroutine without compressing what is buffered, for
+// an archive that failed half way.
+func (pw *parallelGzipWriter) abort() {
+	pw.setErr(errAborted)
+	close(pw.pending)
+	<-pw.done
+}
+
+// errAborted ends the output of an aborted parallelGzipWriter.
+var errAborted = errors.New("useTar: compression aborted")
+
+// abortCompressor releases a compressor whose output is no longer wanted.
+func abortCompressor(cw io.WriteCloser) {
+	if pw, ok := cw.(*parallelGzipWriter); ok {
+		pw.abort()
+		return
+	}
+	cw.Close()
+}
+
+// flush starts compressing the buffered block.
+func (pw *parallelGzipWriter) flush() {
+	block := pw.buf
+	pw.buf = make([]byte, 0, pw.blockSize)
+	pw.blocks++
+
+	result := make(chan []byte, 1)
+	pw.sem <- struct{}{}
+	pw.pending <- result
+	go func() {
+		defer func() { <-pw.sem }()
+		var out bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&out, pw.level)
+		gw.Header = gzip.Header{OS: 255}
+		if _, err := gw.Write(block); err != nil {
+			pw.setErr(err)
+		} else if err := gw.Close(); err != nil {
+			pw.setErr(err)
+		}
+		result <- out.Bytes()
+	}()
+}
+
+// output writes the compressed blocks in the order they were read.
+func (pw *parallelGzipWriter) output(w io.Writer) {
+	defer close(pw.done)
+	for result := range pw.pending {
+		data := <-result
+		if pw.getErr() != nil {
+			continue
+		}
+		if _, err := w.Write(data); err != nil {
+			pw.setErr(err)
+		}
+	}
+}
+
+func (pw *parallelGzipWriter) getErr() error {
+	pw.mtx.Lock()
+	defer pw.mtx.Unlock()
+	return pw.err
+}
+
+func (pw *parallelGzipWriter) setErr(err error) {
+	pw.mtx.Lock()
+	defer pw.mtx.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// readAhead decompresses on its own goroutine, keeping up to depth blocks
+// ready, so that decompression overlaps with writing files to disk.
+type readAhead struct {
+	rc     io.ReadCloser
+	blocks chan []byte
+	quit   chan struct{}
+	cur    []byte
+	err    error // set by the reading goroutine before blocks is closed
+}
+
+func newReadAhead(rc io.ReadCloser, depth, blockSize int) *readAhead {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	ra := &readAhead{
+		rc:     rc,
+		blocks: make(chan []byte, depth),
+		quit:   make(chan struct{}),
+	}
+	go ra.fill(blockSize)
+	return ra
+}
+
+func (ra *readAhead) fill(blockSize int) {
+	defer close(ra.blocks)
+	for {
+		block := make([]byte, blockSize)
+		n := 0
+		var err error
+		for n < blockSize && err == nil {
+			var m int
+			m, err = ra.rc.Read(block[n:])
+			n += m
+		}
+		if n > 0 {
+			select {
+			case ra.blocks <- block[:n]:
+			case <-ra.quit:
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			ra.err = err
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		block, ok := <-ra.blocks
+		if !ok {
+			if ra.err != nil {
+				return 0, ra.err
+			}
+			return 0, io.EOF
+		}
+		ra.cur = block
+	}
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+	return n, nil
+}
+
+// Close stops reading ahead and closes the decompressor.
+func (ra *readAhead) Close() error {
+	close(ra.quit)
+	// wait for the goroutine, it may be in the middle of a read
+	for range ra.blocks {
+	}
+	return ra.rc.Close()
+}
+
+// prefetch reads the files of a directory ahead of the tar writer, in the
+// order they are archived: the next file is opened and read into blocks while
+// the current one is written, so that reading overlaps with compression.
+type prefetch struct {
+	paths map[string]bool
+	files chan *prefetched
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// prefetched is a file opened by a prefetch, or the error opening it.
+type prefetched struct {
+	path string
+	ra   *readAhead
+	err  error
+}
+
+func newPrefetch(paths []string, depth, blockSize int) *prefetch {
+	pf := &prefetch{
+		paths: make(map[string]bool, len(paths)),
+		files: make(chan *prefetched, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for _, p := range paths {
+		pf.paths[p] = true
+	}
+	go pf.run(paths, depth, blockSize)
+	return pf
+}
+
+func (pf *prefetch) run(paths []string, depth, blockSize int) {
+	defer close(pf.done)
+	defer close(pf.files)
+	for _, p := range paths {
+		next := &prefetched{path: p}
+		if f, err := os.Open(p); err != nil {
+			next.err = err
+		} else {
+			next.ra = newReadAhead(f, depth, blockSize)
+		}
+		select {
+		case pf.files <- next:
+		case <-pf.quit:
+			next.close()
+			return
+		}
+	}
+}
+
+// open returns a reader of the file at path, prefetched if it is in the
+// list, skipping the files of the list before it that were not asked for.
+// A nil prefetch opens the file directly.
+func (pf *prefetch) open(path string) (io.ReadCloser, error) {
+	if pf == nil || !pf.paths[path] {
+		return os.Open(path)
+	}
+	for next := range pf.files {
+		if next.path == path {
+			if next.err != nil {
+				return nil, next.err
+			}
+			return next.ra, nil
+		}
+		next.close()
+	}
+	return os.Open(path)
+}
+
+// close stops reading ahead and closes the files not asked for.
+func (pf *prefetch) close() {
+	close(pf.quit)
+	for next := range pf.files {
+		next.close()
+	}
+	<-pf.done
+}
+
+func (p *prefetched) close() {
+	if p.ra != nil {
+		p.ra.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package useTar
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Types the ed25519 private key of a priv_validator.json may have: the amino
+// prefix tendermint writes, and the name older files carry.
+var privValidatorKeyTypes = map[string]bool{
+	"954568A3288910": true,
+	"ed25519":        true,
+}
+
+// privValidatorFile is the part of a priv_validator.json holding the key.
+type privValidatorFile struct {
+	PrivKey struct {
+		Type  string `json:"type"`
+		Value string `json:"value"` // base64
+		Data  string `json:"data"`  // hex, in older files
+	} `json:"priv_key"`
+}
+
+// LoadPrivValidatorKey reads the ed25519 private key of a node from its
+// priv_validator.json, to sign manifests with Options.SignKey.
+func LoadPrivValidatorKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pv := new(privValidatorFile)
+	if err := json.Unmarshal(data, pv); err != nil {
+		return nil, fmt.Errorf("useTar: %s: %v", path, err)
+	}
+	if !privValidatorKeyTypes[pv.PrivKey.Type] {
+		return nil, fmt.Errorf("useTar: %s: private key of type %q is not ed25519", path, pv.PrivKey.Type)
+	}
+
+	var key []byte
+	if pv.PrivKey.Value != "" {
+		key, err = base64.StdEncoding.DecodeString(pv.PrivKey.Value)
+	} else {
+		key, err = hex.DecodeString(pv.PrivKey.Data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("useTar: %s: %v", path, err)
+	}
+	// the key is the seed followed by the public key, which must match it
+	if len(key) != ed25519.PrivateKeySize ||
+		!bytes.Equal(ed25519.NewKeyFromSeed(key[:ed25519.SeedSize]), key) {
+		return nil, fmt.Errorf("useTar: %s: invalid ed25519 private key", path)
+	}
+	return ed25519.PrivateKey(key), nil
+}
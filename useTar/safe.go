@@ -0,0 +1,210 @@
+package useTar
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Errors reported when an archive tries to write outside its destination or
+// to exhaust the disk. They are always wrapped in an *ArchiveError, so use
+// errors.Is to match them.
+var (
+	ErrPathTraversal   = errors.New("entry path escapes destination")
+	ErrUnsafeLink      = errors.New("link target escapes destination")
+	ErrTooManyEntries  = errors.New("archive has too many entries")
+	ErrFileTooLarge    = errors.New("entry exceeds maximum file size")
+	ErrArchiveTooLarge = errors.New("archive exceeds maximum total size")
+)
+
+// ArchiveError reports an entry rejected because the archive itself is
+// malformed or malicious, as opposed to an I/O failure while extracting it.
+type ArchiveError struct {
+	Name string
+	Err  error
+}
+
+func (e *ArchiveError) Error() string {
+	return "useTar: " + e.Name + ": " + e.Err.Error()
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// IsArchiveError reports whether err was caused by the content of the archive
+// rather than by the filesystem or the underlying reader.
+func IsArchiveError(err error) bool {
+	var ae *ArchiveError
+	return errors.As(err, &ae)
+}
+
+// Limits bounds what a single archive may write while it is extracted.
+// A zero field means no limit.
+type Limits struct {
+	MaxTotalSize int64 // sum of the sizes of all regular files
+	MaxFileSize  int64 // size of any one regular file
+	MaxEntries   int   // number of entries of any type
+}
+
+// DefaultLimits is a conservative setting for archives fetched from other nodes.
+var DefaultLimits = Limits{
+	MaxTotalSize: 4 << 30,
+	MaxFileSize:  1 << 30,
+	MaxEntries:   100000,
+}
+
+// UnTarGzSafe is like UnTarGz but for archives that can not be trusted: entries
+// and link targets that would leave dst are refused, links already present
+// below dst are never followed out of it, and limits are enforced before any
+// data is written. Rejections are returned as *ArchiveError.
+func UnTarGzSafe(dst string, r io.Reader, limits Limits) error {
+	x, err := newExtractor(dst, true, Options{Limits: limits, PreserveOwner: os.Geteuid() == 0})
+	if err != nil {
+		return err
+	}
+	return x.unpack(r)
+}
+
+// account checks an entry against the limits before it is written.
+func (x *extractor) account(name string, size int64) error {
+	x.entries++
+	if x.opts.Limits.MaxEntries > 0 && x.entries > x.opts.Limits.MaxEntries {
+		return &ArchiveError{Name: name, Err: ErrTooManyEntries}
+	}
+	if x.opts.Limits.MaxFileSize > 0 && size > x.opts.Limits.MaxFileSize {
+		return &ArchiveError{Name: name, Err: ErrFileTooLarge}
+	}
+	x.total += size
+	if x.opts.Limits.MaxTotalSize > 0 && x.total > x.opts.Limits.MaxTotalSize {
+		return &ArchiveError{Name: name, Err: ErrArchiveTooLarge}
+	}
+	return nil
+}
+
+// safeTarget maps an entry name to a path below the destination, refusing
+// absolute names, names climbing out with "..", and names whose existing
+// parent directories are links pointing elsewhere.
+func (x *extractor) safeTarget(name string) (string, error) {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, "/") {
+		return "", &ArchiveError{Name: name, Err: ErrPathTraversal}
+	}
+	target := filepath.Join(x.root, name)
+	if !within(x.root, target) {
+		return "", &ArchiveError{Name: name, Err: ErrPathTraversal}
+	}
+	ok, err := x.realWithin(filepath.Dir(target))
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", &ArchiveError{Name: name, Err: ErrUnsafeLink}
+	}
+	return target, nil
+}
+
+// checkSymlink refuses a symlink at target whose content would resolve outside
+// the destination, either lexically or through links already on disk.
+func (x *extractor) checkSymlink(name, target, linkname string) error {
+	if filepath.IsAbs(linkname) || filepath.VolumeName(linkname) != "" || strings.HasPrefix(linkname, "/") {
+		return &ArchiveError{Name: name, Err: ErrUnsafeLink}
+	}
+	if !within(x.root, filepath.Join(filepath.Dir(target), linkname)) {
+		return &ArchiveError{Name: name, Err: ErrUnsafeLink}
+	}
+	// filepath.Join cleans "a/.." lexically, the kernel does not
+	ok, err := x.realWithin(filepath.Dir(target) + string(filepath.Separator) + linkname)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &ArchiveError{Name: name, Err: ErrUnsafeLink}
+	}
+	return nil
+}
+
+// recheckLinks checks every symlink created against the final tree, since
+// entries written after a link can change where it resolves. A link that now
+// leaves the destination is removed before the archive is refused.
+func (x *extractor) recheckLinks() error {
+	for _, header := range x.links {
+		target := filepath.Join(x.root, header.Name)
+		fi, err := os.Lstat(target)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// replaced by a later entry, which was checked on its own
+			continue
+		}
+		linkname, err := os.Readlink(target)
+		if err != nil {
+			return err
+		}
+		if err := x.checkSymlink(header.Name, target, linkname); err != nil {
+			if e := os.Remove(target); e != nil {
+				return e
+			}
+			return err
+		}
+	}
+	x.links = nil
+	return nil
+}
+
+// checkHardlink refuses a hard link whose source is outside the destination.
+// Hard link names are relative to the archive root, not to the entry.
+func (x *extractor) checkHardlink(name, linkname string) (string, error) {
+	source, err := x.safeTarget(linkname)
+	if err != nil {
+		return "", &ArchiveError{Name: name, Err: ErrUnsafeLink}
+	}
+	return source, nil
+}
+
+// realWithin resolves the longest existing prefix of p through the filesystem
+// and reports whether the result still lies below the destination. A ".."
+// after a component that does not exist yet is refused: that component may
+// still become a link, and ".." would then climb from wherever it points.
+func (x *extractor) realWithin(p string) (bool, error) {
+	// the missing components, not cleaned: "s/.." is not "." if s is a link
+	var rest []string
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		// split by hand, filepath.Dir would clean "s/.." away as well
+		i := strings.LastIndex(p, string(filepath.Separator))
+		if i <= 0 {
+			break
+		}
+		base := p[i+1:]
+		p = p[:i]
+		if base == "" || base == "." {
+			continue
+		}
+		if base != ".." && len(rest) > 0 && rest[0] == ".." {
+			return false, nil
+		}
+		rest = append([]string{base}, rest...)
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// a dangling link; where it points is checked lexically
+			return true, nil
+		}
+		return false, err
+	}
+	return within(x.realRoot, filepath.Join(append([]string{real}, rest...)...)), nil
+}
+
+// within reports whether p is root or lies below it.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package useTar
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies an inode, to detect files with several hard links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// getFileID returns the inode of fi when it has more than one name.
+func getFileID(fi os.FileInfo) (fileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -2,154 +2,178 @@ package useTar
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"time"
 )
 
 // UnTarGz takes a destination path and a reader; a tar reader loops over the tar.gz file
-// creating the file structure at 'dst' along the way, and writing any files
+// creating the file structure at 'dst' along the way, and writing any files.
+// Other formats known to the codec registry are detected and read as well.
+// Entry names are trusted as they are, use UnTarGzSafe for archives from elsewhere.
 func UnTarGz(dst string, r io.Reader) error {
+	x, err := newExtractor(dst, false, Options{PreserveOwner: os.Geteuid() == 0})
+	if err != nil {
+		return err
+	}
+	return x.unpack(r)
+}
 
-	gzr, err := gzip.NewReader(r)
+// UnTarGzFrom extracts the tar stream r below dst, decompressing it with
+// opts.Codec or the codec detected from its first bytes. Entries are checked
+// as by UnTarGzSafe, and filtered and limited according to opts.
+func UnTarGzFrom(r io.Reader, dst string, opts Options) error {
+	x, err := newExtractor(dst, true, opts)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if e := gzr.Close(); e != nil {
-			return
-		}
-	}()
+	return x.unpack(r)
+}
 
-	tr := tar.NewReader(gzr)
+// TarGz tar for srcPath and create destFile
+// flag = 0,not contains srcPath dir, flag = 1, contains srcPath
+func TarGz(srcPath string, destFile string, flag int) error {
+	if flag != 0 && flag != 1 {
+		return errors.New("Invlaid flag")
+	}
 
-	for {
-		header, err := tr.Next()
+	fw, err := os.Create(destFile)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
 
-		switch {
+	err = TarGzTo(fw, srcPath, Options{IncludeRoot: flag == 1})
+	if err != nil {
+		return err
+	}
+	return fw.Close()
+}
 
-		// if no more files are found return
-		case err == io.EOF:
-			return nil
+// TarGzTo writes src, a file or a directory, as a tar.gz stream to w, or in
+// the format of opts.Codec. The writer is not closed, so it can be an HTTP
+// response, a pipe or a buffer.
+func TarGzTo(w io.Writer, src string, opts Options) error {
+	// Compressing writer, gzip unless another codec is asked for
+	cw, err := newCompressor(w, opts)
+	if err != nil {
+		return err
+	}
+	// on any failure stop the compressor, a parallel one has goroutines to end
+	closed := false
+	defer func() {
+		if !closed {
+			abortCompressor(cw)
+		}
+	}()
 
-		// return any other error
-		case err != nil:
-			return err
+	// Tar writer
+	tw := tar.NewWriter(cw)
+	a := newArchiver(tw, opts)
 
-		// if the header is nil, just skip it (not sure how this happens)
-		case header == nil:
-			continue
+	if opts.Manifest || opts.SignKey != nil || opts.Base != nil {
+		m, err := BuildManifest(src, opts)
+		if err != nil {
+			return err
 		}
+		if err := writeManifest(tw, m, opts); err != nil {
+			return err
+		}
+		a.expect = m.index()
+	}
 
-		// the target location where the dir/file should be created
-		target := filepath.Join(dst, header.Name)
+	if err := a.tarGzRoot(src); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	closed = true
+	return cw.Close()
+}
 
-		// the following switch could also be done using fi.Mode(), not sure if there
-		// a benefit of using one vs. the other.
-		// fi := header.FileInfo()
+// archiver writes files to a tar stream, remembering which inodes were already
+// written so that further names for them become hard links.
+type archiver struct {
+	tw    *tar.Writer
+	opts  Options
+	links map[fileID]string
 
-		// check the file type
-		switch header.Typeflag {
+	// real paths of the directories being walked, to stop symlink loops
+	walking map[string]bool
 
-		// if its a dir and it doesn't exist create it
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0750); err != nil {
-					return err
-				}
-			}
+	// manifest collects the entries written, expect holds those of a manifest
+	// already written, which the entries must still match
+	manifest *Manifest
+	expect   map[string]ManifestEntry
 
-		// if it's a file create it
-		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
+	// entries of the snapshot an incremental archive is made against
+	base map[string]ManifestEntry
 
-			// copy over contents
-			if _, err = io.Copy(f, tr); err != nil {
-				return err
-			}
+	// files of the directory being walked, read ahead when Workers > 1
+	prefetch *prefetch
+}
 
-			// manually close here after each file operation; defering would cause each file close
-			// to wait until all operations have completed.
-			if err = f.Close(); err != nil {
-				return err
-			}
-		}
+func newArchiver(tw *tar.Writer, opts Options) *archiver {
+	a := &archiver{
+		tw:      tw,
+		opts:    opts,
+		links:   make(map[fileID]string),
+		walking: make(map[string]bool),
 	}
+	if opts.Base != nil {
+		a.base = opts.Base.index()
+	}
+	return a
 }
 
-// TarGz tar for srcPath and create destFile
-// flag = 0,not contains srcPath dir, flag = 1, contains srcPath
-func TarGz(srcPath string, destFile string, flag int) error {
-	fw, err := os.Create(destFile)
+// tarGzRoot writes the source given to TarGzTo.
+func (a *archiver) tarGzRoot(srcPath string) error {
+	// Check if it's a file or a directory
+	fi, err := os.Stat(srcPath)
 	if err != nil {
 		return err
 	}
-	defer fw.Close()
-
-	// Gzip writer
-	gw := gzip.NewWriter(fw)
-	defer gw.Close()
-
-	// Tar writer
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	name := path.Base(srcPath)
+	if a.opts.RootName != "" {
+		name = a.opts.RootName
+	}
+	if !fi.IsDir() {
+		// handle file directly
+		return a.tarGzFile(srcPath, name, fi)
+	}
 
-	// Check if it's a file or a directory
-	f, err := os.Open(srcPath)
-	if err != nil {
-		return err
+	// handle source directory
+	if !a.opts.IncludeRoot && a.opts.RootName == "" {
+		return a.tarGzDir(srcPath, path.Base(""))
 	}
-	fi, err := f.Stat()
+	err = a.tarGzFile(srcPath, name, fi)
 	if err != nil {
 		return err
 	}
-	if fi.IsDir() {
-		// handle source directory
-		if flag == 0 {
-			err := tarGzDir(srcPath, path.Base(""), tw)
-			if err != nil {
-				return err
-			}
-		} else if flag == 1 {
-			err := tarGzFile(srcPath, path.Base(srcPath), tw, fi)
-			if err != nil {
-				return err
-			}
-			err = tarGzDir(srcPath, path.Base(srcPath), tw)
-			if err != nil {
-				return err
-			}
-		} else {
-			return errors.New("Invlaid flag")
-		}
+	return a.tarGzDir(srcPath, name)
+}
 
-	} else {
-		// handle file directly
-		if flag == 0 {
-			err := tarGzFile(srcPath, path.Base(""), tw, fi)
-			if err != nil {
-				return err
-			}
-		} else if flag == 1 {
-			err := tarGzFile(srcPath, path.Base(srcPath), tw, fi)
-			if err != nil {
-				return err
-			}
-		} else {
-			return errors.New("Invlaid flag")
+func (a *archiver) tarGzDir(srcDir string, recPath string) error {
+	if a.opts.FollowSymlinks {
+		real, err := filepath.EvalSymlinks(srcDir)
+		if err != nil {
+			return err
+		}
+		if a.walking[real] {
+			return fmt.Errorf("useTar: %s: symlink loop", srcDir)
 		}
+		a.walking[real] = true
+		defer delete(a.walking, real)
 	}
 
-	return nil
-}
-
-func tarGzDir(srcDir string, recPath string, tw *tar.Writer) error {
 	// Open source diretory
 	dir, err := os.Open(srcDir)
 	if err != nil {
@@ -162,12 +186,46 @@ func tarGzDir(srcDir string, recPath string, tw *tar.Writer) error {
 	if err != nil {
 		return err
 	}
+	if a.opts.Deterministic {
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	}
+
+	if a.opts.Workers > 1 {
+		var paths []string
+		for _, fi := range fis {
+			curPath := srcDir + "/" + fi.Name()
+			if a.opts.FollowSymlinks && fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(curPath); err != nil {
+					return err
+				}
+			}
+			if fi.Mode().IsRegular() && a.opts.keep(recPath+"/"+fi.Name(), false) {
+				paths = append(paths, curPath)
+			}
+		}
+		parent := a.prefetch
+		a.prefetch = newPrefetch(paths, a.opts.Workers, a.opts.BlockSize)
+		defer func() {
+			a.prefetch.close()
+			a.prefetch = parent
+		}()
+	}
 
 	for _, fi := range fis {
 		// Append path
 		curPath := srcDir + "/" + fi.Name()
+		curRec := recPath + "/" + fi.Name()
+
+		if a.opts.FollowSymlinks && fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(curPath); err != nil {
+				return err
+			}
+		}
+		if !a.opts.keep(curRec, fi.IsDir()) {
+			continue
+		}
 
-		err := tarGzFile(curPath, recPath+"/"+fi.Name(), tw, fi)
+		err := a.tarGzFile(curPath, curRec, fi)
 		if err != nil {
 			return err
 		}
@@ -176,7 +234,7 @@ func tarGzDir(srcDir string, recPath string, tw *tar.Writer) error {
 		if fi.IsDir() {
 			// Directory
 			// (Directory won't add unitl all subfiles are added)
-			err := tarGzDir(curPath, recPath+"/"+fi.Name(), tw)
+			err := a.tarGzDir(curPath, curRec)
 			if err != nil {
 				return err
 			}
@@ -185,50 +243,142 @@ func tarGzDir(srcDir string, recPath string, tw *tar.Writer) error {
 	return nil
 }
 
-func tarGzFile(srcFile string, recPath string, tw *tar.Writer, fi os.FileInfo) error {
-	if fi.IsDir() {
-		// Create tar header
-		hdr := new(tar.Header)
+// tarGzFile writes one entry. fi comes from Lstat unless symlinks are followed,
+// so symlinks are archived as links, and regular files sharing an inode with
+// an earlier one as hard links. Sockets, devices and pipes are skipped.
+func (a *archiver) tarGzFile(srcFile string, recPath string, fi os.FileInfo) error {
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
 		// if last character of header name is '/' it also can be directory
 		// but if you don't set Typeflag, error will occur when you untargz
-		hdr.Name = recPath + "/"
-		hdr.Typeflag = tar.TypeDir
-		hdr.Size = 0
-		hdr.Mode = int64(fi.Mode())
-		hdr.ModTime = fi.ModTime()
+		hdr, err := a.fileHeader(fi, "", recPath+"/")
+		if err != nil {
+			return err
+		}
 
 		// Write hander
-		err := tw.WriteHeader(hdr)
+		return a.writeHeader(hdr)
+
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(srcFile)
 		if err != nil {
 			return err
 		}
-	} else {
-		// File reader
-		fr, err := os.Open(srcFile)
+		hdr, err := a.fileHeader(fi, link, recPath)
 		if err != nil {
 			return err
 		}
-		defer fr.Close()
+		return a.writeHeader(hdr)
 
-		// Create tar header
-		hdr := new(tar.Header)
-		hdr.Typeflag = tar.TypeReg
-		hdr.Name = recPath
-		hdr.Size = fi.Size()
-		hdr.Mode = int64(fi.Mode())
-		hdr.ModTime = fi.ModTime()
+	case mode.IsRegular():
+		hdr, err := a.fileHeader(fi, "", recPath)
+		if err != nil {
+			return err
+		}
 
-		// Write hander
-		err = tw.WriteHeader(hdr)
+		if id, ok := getFileID(fi); ok {
+			if first, seen := a.links[id]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				return a.writeHeader(hdr)
+			}
+			a.links[id] = recPath
+		}
+		if skip, err := a.unchanged(hdr, srcFile); skip || err != nil {
+			return err
+		}
+
+		// File reader, already reading if prefetched
+		fr, err := a.prefetch.open(srcFile)
 		if err != nil {
 			return err
 		}
+		defer fr.Close()
 
-		// Write file data
-		_, err = io.Copy(tw, fr)
+		// Write hander
+		err = a.tw.WriteHeader(hdr)
 		if err != nil {
 			return err
 		}
+
+		// Write file data, hashing it for the manifest
+		var sum string
+		if a.manifest != nil || a.expect != nil {
+			h := sha256.New()
+			if _, err = io.Copy(io.MultiWriter(a.tw, h), fr); err != nil {
+				return err
+			}
+			sum = hex.EncodeToString(h.Sum(nil))
+		} else if _, err = io.Copy(a.tw, fr); err != nil {
+			return err
+		}
+		if err := a.record(hdr, sum); err != nil {
+			return err
+		}
+		a.opts.progress(hdr)
+	}
+	return nil
+}
+
+// record adds an entry to the manifest, or checks it against the one written.
+func (a *archiver) record(hdr *tar.Header, sum string) error {
+	return a.recordEntry(manifestEntry(hdr, sum))
+}
+
+func (a *archiver) recordEntry(e ManifestEntry) error {
+	if a.manifest != nil {
+		a.manifest.Entries = append(a.manifest.Entries, e)
+	}
+	if a.expect != nil && a.expect[e.Path] != e {
+		return fmt.Errorf("useTar: %s changed while archiving", e.Path)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// fileHeader builds the header of an entry, normalized in deterministic mode
+// so that it only depends on the name, type, size and executable bit.
+func (a *archiver) fileHeader(fi os.FileInfo, link string, name string) (*tar.Header, error) {
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if !a.opts.Deterministic {
+		return hdr, nil
+	}
+
+	hdr.ModTime = deterministicTime
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		hdr.Mode = 0777
+	case fi.IsDir(), fi.Mode()&0111 != 0:
+		hdr.Mode = 0755
+	default:
+		hdr.Mode = 0644
+	}
+	return hdr, nil
+}
+
+// deterministicTime is the mtime of every entry of a deterministic archive.
+var deterministicTime = time.Unix(0, 0)
+
+// writeHeader writes an entry that has no content.
+func (a *archiver) writeHeader(hdr *tar.Header) error {
+	if skip, err := a.unchanged(hdr, ""); skip || err != nil {
+		return err
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if err := a.record(hdr, ""); err != nil {
+		return err
+	}
+	a.opts.progress(hdr)
+	return nil
+}
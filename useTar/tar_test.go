@@ -1,24 +1,846 @@
 package useTar
 
 import (
-	"fmt"
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTarGz(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "factory")
+	if err := os.MkdirAll(filepath.Join(path, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "sub", "a.txt"), []byte("factory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "factory.tar.gz")
+
+	err := TarGz(path, name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
 
-	defer func() {
-		if err := recover(); err != nil {
-			fmt.Println(err)
+// dirNames returns the sorted names in dir.
+func dirNames(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+// countingCloser counts down the open decompressors of TestInspect.
+type countingCloser struct {
+	io.Reader
+	open *int
+}
+
+func (c countingCloser) Close() error {
+	*c.open--
+	return nil
+}
+
+// entry describes one member of an archive built by buildTarGz.
+type entry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64 // 0644 if not set
+}
+
+func buildTarGz(t *testing.T, entries []entry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: e.mode}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
 		}
-	}()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
 
-	path := "/home/wjk/go/studyProject/base/factory"
-	name := "factory.tar.gz"
+func TestUnTarGzSafe(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []entry
+		limits  Limits
+		want    error
+	}{
+		{"parent", []entry{{name: "../evil", typeflag: tar.TypeReg, body: "x"}}, Limits{}, ErrPathTraversal},
+		{"nested parent", []entry{{name: "a/../../evil", typeflag: tar.TypeReg, body: "x"}}, Limits{}, ErrPathTraversal},
+		{"absolute", []entry{{name: "/tmp/evil", typeflag: tar.TypeReg, body: "x"}}, Limits{}, ErrPathTraversal},
+		{"absolute symlink", []entry{{name: "l", typeflag: tar.TypeSymlink, linkname: "/etc"}}, Limits{}, ErrUnsafeLink},
+		{"relative symlink", []entry{{name: "a/l", typeflag: tar.TypeSymlink, linkname: "../../etc"}}, Limits{}, ErrUnsafeLink},
+		{"symlink via link", []entry{
+			{name: "d", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "e", typeflag: tar.TypeSymlink, linkname: "d/.."},
+		}, Limits{}, ErrUnsafeLink},
+		{"symlink via missing link", []entry{
+			{name: "x", typeflag: tar.TypeSymlink, linkname: "s/.."},
+			{name: "s", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "x", typeflag: tar.TypeDir},
+		}, Limits{}, ErrUnsafeLink},
+		{"link changed later", []entry{
+			{name: "d", typeflag: tar.TypeDir},
+			{name: "x", typeflag: tar.TypeSymlink, linkname: "d/.."},
+			{name: "d", typeflag: tar.TypeSymlink, linkname: "."},
+		}, Limits{}, ErrUnsafeLink},
+		{"hardlink", []entry{{name: "h", typeflag: tar.TypeLink, linkname: "../evil"}}, Limits{}, ErrUnsafeLink},
+		{"entries", []entry{
+			{name: "a", typeflag: tar.TypeDir},
+			{name: "b", typeflag: tar.TypeDir},
+		}, Limits{MaxEntries: 1}, ErrTooManyEntries},
+		{"file size", []entry{{name: "f", typeflag: tar.TypeReg, body: "12345"}}, Limits{MaxFileSize: 4}, ErrFileTooLarge},
+		{"total size", []entry{
+			{name: "f", typeflag: tar.TypeReg, body: "123"},
+			{name: "g", typeflag: tar.TypeReg, body: "456"},
+		}, Limits{MaxTotalSize: 5}, ErrArchiveTooLarge},
+	}
 
-	err := TarGz(path, name, 0)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dst := filepath.Join(parent, "dst")
+			err := UnTarGzSafe(dst, buildTarGz(t, c.entries), c.limits)
+			if !errors.Is(err, c.want) || !IsArchiveError(err) {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "evil")); err == nil {
+				t.Fatal("file written outside destination")
+			}
+		})
+	}
+}
+
+func TestUnTarGzSafeExistingLink(t *testing.T) {
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	outside := filepath.Join(parent, "outside")
+	if err := os.MkdirAll(dst, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(outside, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dst, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := UnTarGzSafe(dst, buildTarGz(t, []entry{{name: "d/f", typeflag: tar.TypeReg, body: "x"}}), Limits{})
+	if !errors.Is(err, ErrUnsafeLink) {
+		t.Fatalf("got %v, want %v", err, ErrUnsafeLink)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "f")); err == nil {
+		t.Fatal("file written through link")
+	}
+
+	// a dir entry replaces the link instead of setting the mode of its target
+	err = UnTarGzSafe(dst, buildTarGz(t, []entry{{name: "d", typeflag: tar.TypeDir}}), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dst, "d")); err != nil || !fi.IsDir() {
+		t.Fatalf("link not replaced: %v", err)
+	}
+	if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("mode of the link target changed: %v", fi.Mode())
+	}
+}
+
+func TestUnTarGzSafeValid(t *testing.T) {
+	dst := t.TempDir()
+	err := UnTarGzSafe(dst, buildTarGz(t, []entry{
+		{name: "a/", typeflag: tar.TypeDir},
+		{name: "a/f", typeflag: tar.TypeReg, body: "hello"},
+		{name: "a/l", typeflag: tar.TypeSymlink, linkname: "f"},
+		{name: "h", typeflag: tar.TypeLink, linkname: "a/f"},
+	}), DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/f", "a/l", "h"} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "hello" {
+			t.Fatalf("%s: got %q", name, b)
+		}
+	}
+}
+
+func TestTarGzRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	mtime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "f"), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "sub", "f"), filepath.Join(src, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/f", filepath.Join(src, "soft")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sub/f", "sub", "."} {
+		if err := os.Chtimes(filepath.Join(src, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := filepath.Join(t.TempDir(), "src.tar.gz")
+	if err := TarGz(src, archive, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	// stale content must be truncated, not left as a tail
+	if err := os.MkdirAll(filepath.Join(dst, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "sub", "f"), []byte("much longer content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := UnTarGz(dst, f); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, "sub", "f"))
+	if err != nil || string(b) != "short" {
+		t.Fatalf("content %q, %v", b, err)
+	}
+	fi, err := os.Stat(filepath.Join(dst, "sub", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("metadata %v %v", fi.Mode(), fi.ModTime())
+	}
+	if di, err := os.Stat(filepath.Join(dst, "sub")); err != nil || !di.ModTime().Equal(mtime) {
+		t.Fatalf("dir mtime %v, %v", di.ModTime(), err)
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "soft"))
+	if err != nil || link != "sub/f" {
+		t.Fatalf("symlink %q, %v", link, err)
+	}
+	hi, err := os.Stat(filepath.Join(dst, "hard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi, hi) {
+		t.Fatal("hard link not restored")
+	}
+}
+
+func TestTarGzToOptions(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "genesis")
+	for name, body := range map[string]string{
+		"a.json":       "a",
+		"b.json":       "b",
+		"notes.txt":    "n",
+		"tmp/c.json":   "c",
+		"keep/d.json":  "d",
+		"keep/e.other": "e",
+	} {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var names []string
+	buf := new(bytes.Buffer)
+	err := TarGzTo(buf, src, Options{
+		IncludeRoot: true,
+		Include:     []string{"*.json"},
+		Exclude:     []string{"tmp", "b.json"},
+		Level:       gzip.BestSpeed,
+		Progress:    func(hdr *tar.Header) { names = append(names, hdr.Name) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 4 {
+		t.Fatalf("progress reported %v", names)
+	}
+
+	dst := t.TempDir()
+	if err := UnTarGzFrom(buf, dst, Options{Exclude: []string{"keep"}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"genesis/a.json":      true,
+		"genesis/b.json":      false,
+		"genesis/notes.txt":   false,
+		"genesis/tmp":         false,
+		"genesis/keep/d.json": false,
+	} {
+		_, err := os.Stat(filepath.Join(dst, name))
+		if (err == nil) != want {
+			t.Errorf("%s: exists %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestTarGzToDeterministic(t *testing.T) {
+	var sums [2][sha256.Size]byte
+	for i := range sums {
+		src := t.TempDir()
+		// create in a different order, with different times and modes
+		names := []string{"b", "a", "c/d"}
+		if i == 1 {
+			names = []string{"c/d", "a", "b"}
+		}
+		for _, name := range names {
+			p := filepath.Join(src, name)
+			if err := os.MkdirAll(filepath.Dir(p), 0700+os.FileMode(i)*050); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(name), 0600+os.FileMode(i)*044); err != nil {
+				t.Fatal(err)
+			}
+			mtime := time.Now().Add(time.Duration(i) * time.Hour)
+			if err := os.Chtimes(p, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		buf := new(bytes.Buffer)
+		if err := TarGzTo(buf, src, Options{Deterministic: true}); err != nil {
+			t.Fatal(err)
+		}
+		sums[i] = sha256.Sum256(buf.Bytes())
+	}
+	if sums[0] != sums[1] {
+		t.Fatal("deterministic archives differ")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a toy codec that xors every byte, to check registration and detection
+	RegisterCodec(Codec{
+		Name:  "xor",
+		Magic: []byte("XOR!"),
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if _, err := w.Write([]byte("XOR!")); err != nil {
+				return nil, err
+			}
+			return nopWriteCloser{xorWriter{w}}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(xorReader{r}), nil
+		},
+	})
+
+	for _, codec := range []string{CodecGzip, CodecZstd, CodecXz, CodecNone, "xor"} {
+		buf := new(bytes.Buffer)
+		if err := TarGzTo(buf, src, Options{Codec: codec, Level: 3}); err != nil {
+			t.Fatal(codec, err)
+		}
+		dst := t.TempDir()
+		if err := UnTarGzFrom(buf, dst, Options{}); err != nil {
+			t.Fatal(codec, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dst, "f")); err != nil || string(b) != "data" {
+			t.Fatalf("%s: %q, %v", codec, b, err)
+		}
+	}
+
+	if err := TarGzTo(new(bytes.Buffer), src, Options{Codec: CodecBzip2}); err == nil {
+		t.Fatal("bzip2 has no built in writer")
+	}
+	zstd := bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0})
+	if err := UnTarGzFrom(zstd, t.TempDir(), Options{}); err == nil {
+		t.Fatal("broken zstd stream extracted")
+	}
+	if err := UnTarGzFrom(strings.NewReader("garbage"), t.TempDir(), Options{}); err != ErrUnknownFormat {
+		t.Fatalf("got %v", err)
+	}
+}
+
+type xorWriter struct{ w io.Writer }
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	q := make([]byte, len(p))
+	for i, b := range p {
+		q[i] = b ^ 0x5a
+	}
+	return x.w.Write(q)
+}
+
+type xorReader struct{ r io.Reader }
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= 0x5a
+	}
+	return n, err
+}
+
+func TestTarGzToParallel(t *testing.T) {
+	src := t.TempDir()
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i * 7 / 13)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archives [2]*bytes.Buffer
+	for i, workers := range []int{2, 8} {
+		archives[i] = new(bytes.Buffer)
+		opts := Options{Workers: workers, BlockSize: 4096, Deterministic: true}
+		if err := TarGzTo(archives[i], src, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(archives[0].Bytes(), archives[1].Bytes()) {
+		t.Fatal("output depends on the number of workers")
+	}
+
+	// a plain gzip reader sees a single stream
+	gr, err := gzip.NewReader(bytes.NewReader(archives[0].Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	if _, err := tr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(tr); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("content mismatch, %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := UnTarGzFrom(archives[0], dst, Options{Workers: 4, BlockSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dst, "big")); err != nil || !bytes.Equal(b, data) {
+		t.Fatalf("content mismatch, %v", err)
+	}
+
+	// several files are read ahead, skipped ones included
+	for _, name := range []string{"a", "b", "c"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, "d")); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := TarGzTo(buf, src, Options{Workers: 2, BlockSize: 4096, Exclude: []string{"b"}}); err != nil {
+		t.Fatal(err)
+	}
+	dst = t.TempDir()
+	if err := UnTarGzFrom(buf, dst, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "c", "d"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || len(b) != 1 {
+			t.Fatalf("%s: %q, %v", name, b, err)
+		}
+	}
+
+	// a failed archive leaves no compressing goroutine behind
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		if err := TarGzTo(ioutil.Discard, filepath.Join(src, "missing"), Options{Workers: 4}); err == nil {
+			t.Fatal("archived a missing source")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines before, %d after", before, after)
+	}
+
+	// an empty source still makes a readable stream
+	empty := new(bytes.Buffer)
+	if err := TarGzTo(empty, t.TempDir(), Options{Workers: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UnTarGzFrom(empty, t.TempDir(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	archive := buildTarGz(t, []entry{
+		{name: "./chain/", typeflag: tar.TypeDir},
+		{name: "./chain/genesis.json", typeflag: tar.TypeReg, body: "{}"},
+		{name: "./chain/link", typeflag: tar.TypeSymlink, linkname: "genesis.json"},
+	}).Bytes()
+
+	headers, err := List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers[1].Name != "./chain/genesis.json" || headers[1].Size != 2 {
+		t.Fatalf("unexpected listing %v", headers)
+	}
+
+	fr, err := ExtractFile(bytes.NewReader(archive), "chain/genesis.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(fr); err != nil || string(b) != "{}" {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if err := fr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExtractFile(bytes.NewReader(archive), "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("got %v", err)
+	}
+
+	// the decompressor is closed with the reader, and when nothing is returned
+	var open int
+	RegisterCodec(Codec{
+		Name:  "counting",
+		Magic: []byte("CNT!"),
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			_, err := w.Write([]byte("CNT!"))
+			return nopWriteCloser{w}, err
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			if _, err := io.ReadFull(r, make([]byte, 4)); err != nil {
+				return nil, err
+			}
+			open++
+			return countingCloser{r, &open}, nil
+		},
+	})
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	counted := new(bytes.Buffer)
+	if err := TarGzTo(counted, src, Options{Codec: "counting"}); err != nil {
+		t.Fatal(err)
+	}
+	if fr, err = ExtractFile(bytes.NewReader(counted.Bytes()), "f"); err != nil {
+		t.Fatal(err)
+	}
+	fr.Close()
+	if _, err = ExtractFile(bytes.NewReader(counted.Bytes()), "missing"); err == nil {
+		t.Fatal("found a missing file")
+	}
+	if open != 0 {
+		t.Fatalf("%d decompressors left open", open)
+	}
+
+	report, err := Verify(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("{}"))
+	if report.Entries != 3 || len(report.Files) != 1 || report.Files[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// flip a byte of the compressed data: either inflate or the CRC must fail
+	corrupt := append([]byte(nil), archive...)
+	corrupt[len(corrupt)-12] ^= 0xff
+	if _, err := Verify(bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("corruption not detected")
+	}
+	// a truncated archive must fail too
+	if _, err := Verify(bytes.NewReader(archive[:len(archive)-10])); err == nil {
+		t.Fatal("truncation not detected")
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "genesis.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	signed := new(bytes.Buffer)
+	if err := TarGzTo(signed, src, Options{SignKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := UnTarGzFrom(bytes.NewReader(signed.Bytes()), dst, Options{TrustedKeys: []ed25519.PublicKey{pub}}); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(t, dst); !reflect.DeepEqual(names, []string{"genesis.json"}) {
+		t.Fatalf("extracted %v", names)
+	}
+
+	// KeepManifest writes the manifest pair too, creating dst for it
+	fresh := filepath.Join(t.TempDir(), "fresh")
+	if err := UnTarGzFrom(bytes.NewReader(signed.Bytes()), fresh, Options{KeepManifest: true}); err != nil {
+		t.Fatal(err)
+	}
+	if names := dirNames(t, fresh); !reflect.DeepEqual(names, []string{ManifestName, ManifestSigName, "genesis.json"}) {
+		t.Fatalf("extracted %v", names)
+	}
+
+	err = UnTarGzFrom(bytes.NewReader(signed.Bytes()), t.TempDir(), Options{TrustedKeys: []ed25519.PublicKey{other}})
+	if !errors.Is(err, ErrUntrustedKey) {
+		t.Fatalf("got %v", err)
+	}
+
+	// archives whose content differs from what was signed
+	m := &Manifest{Entries: []ManifestEntry{{Path: "f", Type: EntryFile, Size: 4, Mode: 0644, SHA256: sha256Hex([]byte("good"))}}}
+	data, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigData, err := SignManifest(data, priv)
 	if err != nil {
-		panic(err)
+		t.Fatal(err)
+	}
+	wrongSig, err := SignManifest([]byte("something else"), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []entry{
+		{name: ManifestName, typeflag: tar.TypeReg, body: string(data)},
+		{name: ManifestSigName, typeflag: tar.TypeReg, body: string(sigData)},
+	}
+	cases := []struct {
+		name    string
+		entries []entry
+		want    error
+	}{
+		{"unsigned", []entry{{name: "f", typeflag: tar.TypeReg, body: "good"}}, ErrNoManifest},
+		{"content", append(header[:2:2], entry{name: "f", typeflag: tar.TypeReg, body: "evil"}), ErrManifestMismatch},
+		{"extra", append(header[:2:2],
+			entry{name: "f", typeflag: tar.TypeReg, body: "good"},
+			entry{name: "g", typeflag: tar.TypeReg, body: "evil"}), ErrManifestMismatch},
+		{"setuid", append(header[:2:2], entry{name: "f", typeflag: tar.TypeReg, body: "good", mode: 04755}), ErrManifestMismatch},
+		{"missing", header, ErrManifestMismatch},
+		{"signature", []entry{header[0], {name: ManifestSigName, typeflag: tar.TypeReg, body: string(wrongSig)}}, ErrBadSignature},
 	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dst := t.TempDir()
+			err := UnTarGzFrom(buildTarGz(t, c.entries), dst, Options{TrustedKeys: []ed25519.PublicKey{pub}})
+			if !errors.Is(err, c.want) {
+				t.Fatalf("got %v, want %v", err, c.want)
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(dst, "f")); err == nil && string(b) != "good" {
+				t.Fatal("unverified content written")
+			}
+		})
+	}
+}
 
+func TestIncrementalChain(t *testing.T) {
+	src := t.TempDir()
+	write := func(name, body string, age time.Duration) {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-age).Truncate(time.Second)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := func(base *Manifest) ([]byte, *Manifest) {
+		buf := new(bytes.Buffer)
+		if err := TarGzTo(buf, src, Options{Manifest: true, Base: base}); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadManifest(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), m
+	}
+
+	write("blockstore.db/000001.ldb", "blocks", time.Hour)
+	write("state.db/CURRENT", "v1", time.Hour)
+	write("old/gone", "x", time.Hour)
+	full, m0 := snapshot(nil)
+
+	write("state.db/CURRENT", "v2", 0)
+	write("state.db/000002.log", "new", 0)
+	if err := os.RemoveAll(filepath.Join(src, "old")); err != nil {
+		t.Fatal(err)
+	}
+	incr1, m1 := snapshot(m0)
+	if len(m1.Deleted) != 2 || m1.Base == "" {
+		t.Fatalf("unexpected manifest %+v", m1)
+	}
+	headers, err := List(bytes.NewReader(incr1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range headers {
+		if strings.Contains(h.Name, "000001.ldb") {
+			t.Fatal("unchanged file archived again")
+		}
+	}
+
+	write("state.db/CURRENT", "v3-longer", 0)
+	incr2, _ := snapshot(m1)
+
+	dst := t.TempDir()
+	readers := []io.Reader{bytes.NewReader(full), bytes.NewReader(incr1), bytes.NewReader(incr2)}
+	if err := ApplyChain(dst, readers, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"blockstore.db/000001.ldb": "blocks",
+		"state.db/CURRENT":         "v3-longer",
+		"state.db/000002.log":      "new",
+	} {
+		if b, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || string(b) != want {
+			t.Fatalf("%s: %q, %v", name, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old")); !os.IsNotExist(err) {
+		t.Fatal("deleted directory restored")
+	}
+	if _, err := os.Stat(filepath.Join(dst, ManifestName)); !os.IsNotExist(err) {
+		t.Fatal("manifest left in the destination")
+	}
+
+	// the unsafe extraction removes the deleted files as well
+	dst = t.TempDir()
+	for _, archive := range [][]byte{full, incr1} {
+		if err := UnTarGz(dst, bytes.NewReader(archive)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "old")); !os.IsNotExist(err) {
+		t.Fatal("deleted directory kept by UnTarGz")
+	}
+
+	// skipping an archive of the chain is refused
+	readers = []io.Reader{bytes.NewReader(full), bytes.NewReader(incr2)}
+	if err := ApplyChain(t.TempDir(), readers, Options{}); !errors.Is(err, ErrChainOrder) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	dst := t.TempDir()
+	err := UnTarGzFrom(buildTarGz(t, []entry{
+		{name: "./chain/", typeflag: tar.TypeDir},
+		{name: "./chain/config/", typeflag: tar.TypeDir},
+		{name: "./chain/config/genesis.json", typeflag: tar.TypeReg, body: "{}"},
+		{name: "./chain/config/copy.json", typeflag: tar.TypeLink, linkname: "./chain/config/genesis.json"},
+	}), dst, Options{StripComponents: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"genesis.json", "copy.json"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dst, name)); err != nil || string(b) != "{}" {
+			t.Fatalf("%s: %q, %v", name, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "chain")); !os.IsNotExist(err) {
+		t.Fatal("stripped directory created")
+	}
+}
+
+func TestLoadPrivValidatorKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for name, c := range map[string]struct {
+		json string
+		ok   bool
+	}{
+		"amino": {`{"address":"x","priv_key":{"type":"954568A3288910","value":"` + base64.StdEncoding.EncodeToString(priv) + `"}}`, true},
+		"hex":   {`{"priv_key":{"type":"ed25519","data":"` + strings.ToUpper(hex.EncodeToString(priv)) + `"}}`, true},
+		"secp":  {`{"priv_key":{"type":"019E82E1B0F798","value":"` + base64.StdEncoding.EncodeToString(priv[:32]) + `"}}`, false},
+		"pub":   {`{"priv_key":{"type":"ed25519","data":"` + hex.EncodeToString(append(priv.Seed(), make([]byte, 32)...)) + `"}}`, false},
+	} {
+		path := filepath.Join(dir, name+".json")
+		if err := ioutil.WriteFile(path, []byte(c.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		key, err := LoadPrivValidatorKey(path)
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: accepted", name)
+			}
+			continue
+		}
+		if err != nil || !key.Equal(priv) {
+			t.Errorf("%s: %x, %v", name, key, err)
+		}
+	}
 }